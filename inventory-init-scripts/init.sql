@@ -1,6 +1,7 @@
 CREATE TABLE IF NOT EXISTS inventory (
     product_id integer NOT NULL UNIQUE,
-    quantity integer NOT NULL
+    quantity integer NOT NULL CHECK (quantity >= 0),
+    reserved integer NOT NULL DEFAULT 0 CHECK (reserved >= 0 AND reserved <= quantity)
 );
 
 CREATE INDEX ON inventory (product_id);
@@ -9,3 +10,73 @@ INSERT INTO inventory (product_id, quantity) VALUES
     (1,10),
     (2,20);
 
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    headers JSONB,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX ON outbox (id) WHERE sent_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS processed_operations (
+    order_id integer NOT NULL,
+    product_id integer NOT NULL,
+    operation VARCHAR(20) NOT NULL,
+    success boolean NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (order_id, product_id, operation)
+);
+
+CREATE TABLE IF NOT EXISTS reservations (
+    id SERIAL PRIMARY KEY,
+    order_id integer NOT NULL,
+    product_id integer NOT NULL REFERENCES inventory (product_id),
+    quantity integer NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    UNIQUE (order_id, product_id)
+);
+
+CREATE INDEX ON reservations (expires_at) WHERE status = 'RESERVED';
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    partition integer NOT NULL,
+    "offset" bigint NOT NULL,
+    source_topic VARCHAR(255) NOT NULL,
+    source_partition integer NOT NULL,
+    source_offset bigint NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    headers JSONB,
+    payload BYTEA NOT NULL,
+    error TEXT NOT NULL,
+    attempts integer NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    failed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    UNIQUE (topic, partition, "offset")
+);
+
+CREATE INDEX ON dead_letters (status, source_topic);
+
+CREATE TABLE IF NOT EXISTS dead_letter_audit (
+    id BIGSERIAL PRIMARY KEY,
+    dead_letter_id bigint NOT NULL REFERENCES dead_letters (id),
+    action VARCHAR(30) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    note TEXT,
+    payload BYTEA,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX ON dead_letter_audit (dead_letter_id);
@@ -0,0 +1,76 @@
+// Package admin authenticates the admin API. Operators are configured in
+// ADMIN_TOKENS as comma separated actor:token pairs and send their token as a
+// bearer token; the actor of the token is the one recorded for their actions.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tokens maps the admin tokens to their actors
+type Tokens map[string]string
+
+// TokensFromEnv reads the admin tokens from ADMIN_TOKENS. Without tokens the
+// admin API refuses every request.
+func TokensFromEnv() (Tokens, error) {
+	tokens := make(Tokens)
+	value := os.Getenv("ADMIN_TOKENS")
+	if value == "" {
+		return tokens, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		actor, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || actor == "" || token == "" {
+			return nil, fmt.Errorf("invalid ADMIN_TOKENS: %q is not an actor:token pair", pair)
+		}
+		tokens[token] = actor
+	}
+	return tokens, nil
+}
+
+// actorKey is the context key of the authenticated actor
+type actorKey struct{}
+
+// Actor returns the actor authenticated for a request, "" outside the admin API
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// Middleware lets requests carrying a known bearer token through to next and
+// answers all others with 401
+func (t Tokens) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := t.actor(r.Header.Get("Authorization"))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+	}
+}
+
+// actor returns the actor of the bearer token in an Authorization header.
+// Every token is compared in constant time.
+func (t Tokens) actor(header string) (string, bool) {
+	presented, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || presented == "" {
+		return "", false
+	}
+
+	var found string
+	for token, actor := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+			found = actor
+		}
+	}
+	return found, found != ""
+}
@@ -0,0 +1,102 @@
+package deadletter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"inventory/internal/model"
+	"inventory/internal/repository"
+)
+
+var (
+	// ErrNotFound is returned when no dead letter exists with an ID
+	ErrNotFound = repository.ErrDeadLetterNotFound
+	// ErrResolved is returned when a dead letter was already republished or
+	// discarded
+	ErrResolved = errors.New("dead letter already resolved")
+	// ErrActorRequired is returned when an admin action does not name its actor
+	ErrActorRequired = errors.New("actor is required")
+)
+
+// Republish writes a stored dead letter, or its edited payload, back to its
+// source topic through the outbox and records the action
+func Republish(r repository.RepositoryI, id int64, req model.RepublishDeadLetterRequest) error {
+	if req.Actor == "" {
+		return ErrActorRequired
+	}
+
+	return r.WithTx(func(r repository.RepositoryI) error {
+		dl, err := resolvable(r, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		audit := model.DeadLetterAudit{
+			DeadLetterID: id,
+			Action:       model.DeadLetterActionRepublish,
+			Actor:        req.Actor,
+			Note:         req.Note,
+			CreatedAt:    now,
+		}
+		payload := dl.Payload
+		if req.Payload != nil {
+			payload = *req.Payload
+			audit.Action = model.DeadLetterActionEditAndRepublish
+			audit.Payload = payload
+		}
+
+		err = r.CreateOutboxMessage(model.OutboxMessage{
+			Topic:     dl.SourceTopic,
+			Key:       dl.Key,
+			Headers:   OriginalHeaders(dl.Headers),
+			Payload:   []byte(payload),
+			CreatedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := r.UpdateDeadLetterStatus(id, model.DeadLetterStatusRepublished); err != nil {
+			return err
+		}
+		return r.CreateDeadLetterAudit(audit)
+	})
+}
+
+// Discard marks a stored dead letter as discarded and records the action
+func Discard(r repository.RepositoryI, id int64, req model.DiscardDeadLetterRequest) error {
+	if req.Actor == "" {
+		return ErrActorRequired
+	}
+
+	return r.WithTx(func(r repository.RepositoryI) error {
+		if _, err := resolvable(r, id); err != nil {
+			return err
+		}
+
+		if err := r.UpdateDeadLetterStatus(id, model.DeadLetterStatusDiscarded); err != nil {
+			return err
+		}
+		return r.CreateDeadLetterAudit(model.DeadLetterAudit{
+			DeadLetterID: id,
+			Action:       model.DeadLetterActionDiscard,
+			Actor:        req.Actor,
+			Note:         req.Note,
+			CreatedAt:    time.Now(),
+		})
+	})
+}
+
+// resolvable locks a dead letter that is still pending
+func resolvable(r repository.RepositoryI, id int64) (*model.DeadLetter, error) {
+	dl, err := r.GetDeadLetterForUpdate(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != model.DeadLetterStatusPending {
+		return nil, fmt.Errorf("%w: dead letter %d is %s", ErrResolved, id, dl.Status)
+	}
+	return dl, nil
+}
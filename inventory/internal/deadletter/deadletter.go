@@ -0,0 +1,178 @@
+// Package deadletter moves messages that cannot be processed to a dead-letter
+// topic next to the topic they were read from. The original key, payload and
+// headers are kept, and headers describing the failure and the position of
+// the message in its source topic are added, so operators can inspect and
+// replay it.
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"inventory/internal/messaging"
+)
+
+// Suffix is appended to a topic name to get its dead-letter topic
+const Suffix = ".dlq"
+
+// Header names added to dead-lettered messages
+const (
+	HeaderError           = "dlq-error"
+	HeaderSourceTopic     = "dlq-source-topic"
+	HeaderSourcePartition = "dlq-source-partition"
+	HeaderSourceOffset    = "dlq-source-offset"
+	HeaderAttempts        = "dlq-attempts"
+	HeaderFailedAt        = "dlq-failed-at"
+)
+
+// Topic returns the dead-letter topic of a topic
+func Topic(topic string) string {
+	return topic + Suffix
+}
+
+// Publisher writes messages to dead-letter topics
+type Publisher struct {
+	l         *slog.Logger
+	publisher messaging.Publisher
+}
+
+// NewPublisher creates a new dead-letter publisher
+func NewPublisher(l *slog.Logger, broker messaging.Broker) *Publisher {
+	return &Publisher{
+		l:         l,
+		publisher: broker.NewPublisher(),
+	}
+}
+
+// Publish writes msg to the dead-letter topic of its topic together with the
+// error that made it unprocessable and the number of attempts made
+func (p *Publisher) Publish(ctx context.Context, msg messaging.Message, reason error, attempts int) error {
+	headers := make([]messaging.Header, 0, len(msg.Headers)+6)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		messaging.Header{Key: HeaderError, Value: []byte(reason.Error())},
+		messaging.Header{Key: HeaderSourceTopic, Value: []byte(msg.Topic)},
+		messaging.Header{Key: HeaderSourcePartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		messaging.Header{Key: HeaderSourceOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		messaging.Header{Key: HeaderAttempts, Value: []byte(strconv.Itoa(attempts))},
+		messaging.Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	topic := Topic(msg.Topic)
+	err := p.publisher.Publish(ctx, messaging.Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		p.l.Error("failed to dead-letter message", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+		return fmt.Errorf("failed to write to %s: %w", topic, err)
+	}
+
+	p.l.Error("Dead-lettered message", "reason", reason, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "attempts", attempts, "dlq", topic)
+	return nil
+}
+
+// Close closes the publisher
+func (p *Publisher) Close() error {
+	if err := p.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close dead-letter publisher: %w", err)
+	}
+	return nil
+}
+
+// Retry runs fn until it succeeds or attempts runs out, waiting backoff
+// after the first failure and twice as long after each further one. It
+// returns the last error and the number of attempts made.
+func Retry(ctx context.Context, attempts int, backoff time.Duration, fn func() error) (int, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= attempts {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// RetryUntil runs fn until it succeeds or ctx is done, waiting backoff after
+// each failure. It returns the last error when ctx is done first, messages
+// whose dead letter or retry could not be written must then be left
+// uncommitted so they are delivered again.
+func RetryUntil(ctx context.Context, backoff time.Duration, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Record is the failure information a dead-lettered message carries
+type Record struct {
+	SourceTopic     string
+	SourcePartition int
+	SourceOffset    int64
+	Error           string
+	Attempts        int
+	FailedAt        *time.Time
+}
+
+// Parse reads the failure information from a message of a dead-letter topic
+func Parse(msg messaging.Message) Record {
+	rec := Record{
+		SourceTopic: strings.TrimSuffix(msg.Topic, Suffix),
+	}
+	for _, h := range msg.Headers {
+		value := string(h.Value)
+		switch h.Key {
+		case HeaderError:
+			rec.Error = value
+		case HeaderSourceTopic:
+			rec.SourceTopic = value
+		case HeaderSourcePartition:
+			rec.SourcePartition, _ = strconv.Atoi(value)
+		case HeaderSourceOffset:
+			rec.SourceOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderAttempts:
+			rec.Attempts, _ = strconv.Atoi(value)
+		case HeaderFailedAt:
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				rec.FailedAt = &t
+			}
+		}
+	}
+	return rec
+}
+
+// retryHeaderPrefix starts the headers retry topics add to a message
+const retryHeaderPrefix = "retry-"
+
+// OriginalHeaders returns headers without the ones added when the message was
+// dead-lettered or retried, so a republished message starts over with all
+// its retries
+func OriginalHeaders(headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if !strings.HasPrefix(k, "dlq-") && !strings.HasPrefix(k, retryHeaderPrefix) {
+			out[k] = v
+		}
+	}
+	return out
+}
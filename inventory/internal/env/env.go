@@ -0,0 +1,55 @@
+// Package env reads settings from the environment. Every reader returns the
+// default when its variable is unset and an error naming the variable when
+// its value is invalid.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Duration reads a duration such as "30s". Zero is accepted for settings
+// where it turns a feature off, negative durations are rejected.
+func Duration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a duration of zero or more", key, value)
+	}
+	return d, nil
+}
+
+// Interval reads a positive duration such as "30s", for settings that drive
+// a ticker or bound a wait and cannot be zero
+func Interval(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive duration", key, value)
+	}
+	return d, nil
+}
+
+// PositiveInt reads a positive integer
+func PositiveInt(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive integer", key, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,172 @@
+// Package envelope defines the envelope every message is wrapped in. The
+// JSON body carries the metadata next to the payload in data, and the same
+// metadata is repeated in the message headers so it can be read without
+// decoding the body.
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"inventory/internal/messaging"
+)
+
+// Header names carrying the envelope metadata
+const (
+	HeaderMessageID     = "message-id"
+	HeaderMessageType   = "message-type"
+	HeaderSchemaVersion = "schema-version"
+	HeaderCorrelationID = "correlation-id"
+	HeaderProducer      = "producer"
+)
+
+var (
+	// ErrInvalid is returned for a message that is not a valid envelope
+	ErrInvalid = errors.New("invalid envelope")
+	// ErrUnexpectedType is returned for a message of another type than expected
+	ErrUnexpectedType = errors.New("unexpected message type")
+	// ErrUnsupportedVersion is returned for a schema version the consumer does not know
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+// Envelope wraps the payload of a Kafka message
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Producer      string          `json:"producer"`
+	Time          time.Time       `json:"time"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// New wraps data in an envelope with a new message ID
+func New(msgType string, schemaVersion int, producer string, correlationID string, data any) (Envelope, error) {
+	id, err := NewID()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to marshal %s data: %w", msgType, err)
+	}
+
+	return Envelope{
+		ID:            id,
+		Type:          msgType,
+		SchemaVersion: schemaVersion,
+		CorrelationID: correlationID,
+		Producer:      producer,
+		Time:          time.Now(),
+		Data:          raw,
+	}, nil
+}
+
+// Marshal encodes the envelope as the body of a message
+func (e Envelope) Marshal() ([]byte, error) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	return value, nil
+}
+
+// Headers returns the envelope metadata as a header map
+func (e Envelope) Headers() map[string]string {
+	headers := map[string]string{
+		HeaderMessageID:     e.ID,
+		HeaderMessageType:   e.Type,
+		HeaderSchemaVersion: strconv.Itoa(e.SchemaVersion),
+		HeaderProducer:      e.Producer,
+	}
+	if e.CorrelationID != "" {
+		headers[HeaderCorrelationID] = e.CorrelationID
+	}
+	return headers
+}
+
+// MessageHeaders returns the envelope metadata as message headers
+func (e Envelope) MessageHeaders() []messaging.Header {
+	return ToHeaders(e.Headers())
+}
+
+// Open decodes the envelope of msg, checks that it is of type msgType in a
+// schema version up to maxVersion and decodes its data into v. Bare payloads
+// written before messages were enveloped are decoded as version 1.
+func Open(msg messaging.Message, msgType string, maxVersion int, v any) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(msg.Value, &e); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	if e.Type == "" && msg.Header(HeaderMessageType) == "" {
+		if err := json.Unmarshal(msg.Value, v); err != nil {
+			return Envelope{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return Envelope{Type: msgType, SchemaVersion: 1, Data: msg.Value}, nil
+	}
+
+	if err := e.validate(msg); err != nil {
+		return e, err
+	}
+	if e.Type != msgType {
+		return e, fmt.Errorf("%w: got %s, want %s", ErrUnexpectedType, e.Type, msgType)
+	}
+	if e.SchemaVersion > maxVersion {
+		return e, fmt.Errorf("%w: %s version %d, up to %d is supported", ErrUnsupportedVersion, e.Type, e.SchemaVersion, maxVersion)
+	}
+
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return e, fmt.Errorf("%w: failed to unmarshal %s data: %v", ErrInvalid, e.Type, err)
+	}
+	return e, nil
+}
+
+// validate checks that the envelope is complete and agrees with the headers
+// of its message
+func (e Envelope) validate(msg messaging.Message) error {
+	switch {
+	case e.ID == "":
+		return fmt.Errorf("%w: missing message ID", ErrInvalid)
+	case e.Type == "":
+		return fmt.Errorf("%w: missing message type", ErrInvalid)
+	case e.SchemaVersion < 1:
+		return fmt.Errorf("%w: schema version must be positive", ErrInvalid)
+	case e.Producer == "":
+		return fmt.Errorf("%w: missing producer", ErrInvalid)
+	case len(e.Data) == 0:
+		return fmt.Errorf("%w: missing data", ErrInvalid)
+	}
+
+	if t := msg.Header(HeaderMessageType); t != "" && t != e.Type {
+		return fmt.Errorf("%w: header type %s does not match body type %s", ErrInvalid, t, e.Type)
+	}
+	if id := msg.Header(HeaderMessageID); id != "" && id != e.ID {
+		return fmt.Errorf("%w: header ID %s does not match body ID %s", ErrInvalid, id, e.ID)
+	}
+	return nil
+}
+
+// ToHeaders converts a header map to message headers
+func ToHeaders(h map[string]string) []messaging.Header {
+	var out []messaging.Header
+	for k, v := range h {
+		out = append(out, messaging.Header{Key: k, Value: []byte(v)})
+	}
+	return out
+}
+
+// NewID returns a random message ID
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -2,6 +2,10 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"inventory/internal/admin"
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
 	"inventory/internal/model"
 	"inventory/internal/service"
 	"log/slog"
@@ -13,16 +17,25 @@ import (
 type Handler struct {
 	l *slog.Logger
 	s service.ServiceI
+	m *messaging.Monitor
 }
 
-func New(l *slog.Logger, s service.ServiceI) *Handler {
+func New(l *slog.Logger, s service.ServiceI, m *messaging.Monitor) *Handler {
 	return &Handler{
 		l: l,
 		s: s,
+		m: m,
 	}
 }
 
+// Health fails while one of the consumers of the service is stalled
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	if err := h.m.Healthy(); err != nil {
+		h.l.Error("Health check failed", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	_, err := w.Write([]byte("OK"))
 	if err != nil {
 		h.l.Error("Failed to write response", "error", err)
@@ -41,7 +54,7 @@ func (h *Handler) CreateInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.s.CreateInventory(*inventoryReq)
+	err = h.s.CreateInventory(r.Context(), *inventoryReq)
 	if err != nil {
 		h.l.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -59,7 +72,7 @@ func (h *Handler) GetQuantityOfAProduct(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	quantity, err := h.s.GetQuantityOfAProduct(id)
+	quantity, err := h.s.GetQuantityOfAProduct(r.Context(), id)
 	if err != nil {
 		h.l.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -96,7 +109,7 @@ func (h *Handler) GetQuantityOfProducts(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Get products from service
-	products, err := h.s.GetQuantityOfProducts(ids)
+	products, err := h.s.GetQuantityOfProducts(r.Context(), ids)
 	if err != nil {
 		h.l.Error("failed to get products", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -129,7 +142,7 @@ func (h *Handler) ReduceQuantityOfAProduct(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = h.s.ReduceQuantityOfAProduct(id, *amount)
+	err = h.s.ReduceQuantityOfAProduct(r.Context(), id, *amount)
 	if err != nil {
 		h.l.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,3 +150,110 @@ func (h *Handler) ReduceQuantityOfAProduct(w http.ResponseWriter, r *http.Reques
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// GetConsumers returns the lag and progress of the consumers of the service
+func (h *Handler) GetConsumers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.m.Stats()); err != nil {
+		h.l.Error("failed to encode response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deadLetters, err := h.s.GetDeadLetters(r.Context(), query.Get("status"), query.Get("topic"))
+	if err != nil {
+		h.l.Error("failed to get dead letters", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deadLetters); err != nil {
+		h.l.Error("failed to encode response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dl, err := h.s.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		h.l.Error(err.Error())
+		http.Error(w, err.Error(), deadLetterErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dl); err != nil {
+		h.l.Error("failed to encode response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) RepublishDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(model.RepublishDeadLetterRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Actor = admin.Actor(r.Context())
+
+	if err := h.s.RepublishDeadLetter(r.Context(), id, *req); err != nil {
+		h.l.Error(err.Error())
+		http.Error(w, err.Error(), deadLetterErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(model.DiscardDeadLetterRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Actor = admin.Actor(r.Context())
+
+	if err := h.s.DiscardDeadLetter(r.Context(), id, *req); err != nil {
+		h.l.Error(err.Error())
+		http.Error(w, err.Error(), deadLetterErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deadLetterErrorStatus maps dead letter errors to HTTP status codes
+func deadLetterErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, deadletter.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, deadletter.ErrResolved):
+		return http.StatusConflict
+	case errors.Is(err, deadletter.ErrActorRequired):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
+)
+
+// CancelInventoryHandler handles cancel inventory requests
+type CancelInventoryHandler struct {
+	BaseHandler
+	consumer *consumer
+}
+
+// NewCancelInventoryHandler creates a new cancel inventory handler
+func NewCancelInventoryHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, retries *retrytopic.Publisher, cfg ConsumerConfig) (*CancelInventoryHandler, error) {
+	// Create a consumer for cancel inventory requests
+	consumer := newConsumer(l, cfg, CancelInventoryTopic)
+
+	return &CancelInventoryHandler{
+		BaseHandler: BaseHandler{
+			l:       l,
+			r:       r,
+			dlq:     dlq,
+			retries: retries,
+		},
+		consumer: consumer,
+	}, nil
+}
+
+// Start starts the cancel inventory handler
+func (h *CancelInventoryHandler) Start(ctx context.Context) error {
+	h.l.InfoContext(ctx, "Starting cancel inventory handler")
+
+	go h.consumer.run(ctx, h.handle)
+
+	return nil
+}
+
+// Stop stops the cancel inventory handler
+func (h *CancelInventoryHandler) Stop() error {
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close cancel consumer: %w", err)
+	}
+	return nil
+}
+
+// handle processes a single cancel inventory request
+func (h *CancelInventoryHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received cancel inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Reply where the request asks for it, or on the response topic
+	route := reqreply.RouteOf(msg, InventoryResponseTopic)
+
+	// Parse request
+	var request model.CancelInventoryRequest
+	env, ok, err := h.open(ctx, msg, CancelInventoryMessageType, &request, func() error {
+		return validateQuantity(request.Quantity)
+	})
+	if !ok {
+		return err
+	}
+
+	// Get product ID and order ID from the request
+	productID := request.ProductID
+	orderID := request.OrderID
+
+	h.l.InfoContext(ctx, "Processing cancel inventory request", "order_id", orderID, "message_id", env.ID, "product_id", productID, "quantity", request.Quantity)
+
+	return h.processInTx(ctx, msg, func(r repository.RepositoryI) error {
+		claimed, err := r.ClaimOperation(orderID, productID, model.InventoryOperationCancel)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return h.replyDuplicate(ctx, r, route, orderID, productID, model.InventoryOperationCancel)
+		}
+
+		refused, err := h.refuseUnprocessedReservation(ctx, r, orderID, productID, "reservation cancelled before it was processed")
+		if err != nil {
+			return err
+		}
+		if refused {
+			return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationCancel, true, "")
+		}
+
+		// Cancel only drops a reservation that is still held, a
+		// confirmed one has to be released instead
+		cancelled, err := r.ReleaseReservation(orderID, productID, model.ReservationStatusCancelled)
+		if err != nil {
+			return err
+		}
+		if !cancelled {
+			h.l.InfoContext(ctx, "Nothing reserved for the order, nothing to cancel", "order_id", orderID, "product_id", productID)
+		}
+
+		// Send success response
+		h.l.InfoContext(ctx, "Sending success response for cancel inventory", "product_id", productID)
+		return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationCancel, true, "")
+	})
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/envelope"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/reqreply"
+)
+
+// CheckStockHandler answers stock checks of OMS. A check reads the stock
+// without changing it, so its reply is published directly instead of through
+// the outbox; a lost reply only makes the requester time out.
+type CheckStockHandler struct {
+	l         *slog.Logger
+	r         repository.RepositoryI
+	dlq       *deadletter.Publisher
+	publisher messaging.Publisher
+	consumer  *consumer
+}
+
+// NewCheckStockHandler creates a new check stock handler
+func NewCheckStockHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, cfg ConsumerConfig) (*CheckStockHandler, error) {
+	// Create a consumer for stock checks
+	consumer := newConsumer(l, cfg, CheckStockTopic)
+
+	return &CheckStockHandler{
+		l:         l,
+		r:         r,
+		dlq:       dlq,
+		publisher: cfg.Broker.NewPublisher(),
+		consumer:  consumer,
+	}, nil
+}
+
+// Start starts the check stock handler
+func (h *CheckStockHandler) Start(ctx context.Context) error {
+	h.l.InfoContext(ctx, "Starting check stock handler")
+
+	go h.consumer.run(ctx, h.handle)
+
+	return nil
+}
+
+// Stop stops the check stock handler
+func (h *CheckStockHandler) Stop() error {
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close check stock consumer: %w", err)
+	}
+	if err := h.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close check stock publisher: %w", err)
+	}
+	return nil
+}
+
+// handle answers a single stock check
+func (h *CheckStockHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received stock check", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Stock checks are only answered on the reply topic of their requester
+	route := reqreply.RouteOf(msg, InventoryReplyTopic)
+
+	// Undecodable checks are dead-lettered without a reply, the requester
+	// gives up after its timeout
+	var request model.CheckStockRequest
+	if _, err := envelope.Open(msg, CheckStockMessageType, SchemaVersion, &request); err != nil {
+		h.l.ErrorContext(ctx, "failed to open stock check", "error", err)
+		return deadletter.RetryUntil(ctx, publishBackoff, func() error {
+			return h.dlq.Publish(ctx, msg, err, 1)
+		})
+	}
+
+	response, err := h.check(ctx, request)
+	if err != nil {
+		h.l.ErrorContext(ctx, "failed to check stock", "error", err, "correlation_id", route.CorrelationID)
+		response = model.StockCheckResponse{Error: err.Error()}
+	}
+
+	env, err := envelope.New(StockCheckMessageType, SchemaVersion, Producer, route.CorrelationID, response)
+	if err != nil {
+		return err
+	}
+	value, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// A reply that cannot be written is not retried, the requester stopped
+	// waiting for it by the time it could be
+	if err := h.publisher.Publish(ctx, messaging.Message{
+		Topic:   route.Topic,
+		Key:     msg.Key,
+		Value:   value,
+		Headers: env.MessageHeaders(),
+	}); err != nil {
+		h.l.ErrorContext(ctx, "failed to write stock check reply", "error", err, "topic", route.Topic, "correlation_id", route.CorrelationID)
+		return nil
+	}
+
+	h.l.InfoContext(ctx, "Sent stock check reply", "topic", route.Topic, "correlation_id", route.CorrelationID, "available", response.Available)
+	return nil
+}
+
+// check compares the requested quantities with the available stock
+func (h *CheckStockHandler) check(ctx context.Context, request model.CheckStockRequest) (model.StockCheckResponse, error) {
+	ids := make([]int, 0, len(request.Items))
+	for _, item := range request.Items {
+		ids = append(ids, item.ProductID)
+	}
+
+	products, err := h.r.WithContext(ctx).GetQuantityOfProducts(ids)
+	if err != nil {
+		return model.StockCheckResponse{}, err
+	}
+	available := make(map[int]int, len(products))
+	for _, product := range products {
+		available[product.ProductID] = product.Available
+	}
+
+	// Unknown products have no stock
+	response := model.StockCheckResponse{
+		Available: true,
+		Items:     make([]model.StockCheckItem, 0, len(request.Items)),
+	}
+	for _, item := range request.Items {
+		response.Items = append(response.Items, model.StockCheckItem{
+			ProductID: item.ProductID,
+			Requested: item.Quantity,
+			Available: available[item.ProductID],
+		})
+		if available[item.ProductID] < item.Quantity {
+			response.Available = false
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
+)
+
+// ConfirmInventoryHandler handles confirm inventory requests
+type ConfirmInventoryHandler struct {
+	BaseHandler
+	consumer *consumer
+}
+
+// NewConfirmInventoryHandler creates a new confirm inventory handler
+func NewConfirmInventoryHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, retries *retrytopic.Publisher, cfg ConsumerConfig) (*ConfirmInventoryHandler, error) {
+	// Create a consumer for confirm inventory requests
+	consumer := newConsumer(l, cfg, ConfirmInventoryTopic)
+
+	return &ConfirmInventoryHandler{
+		BaseHandler: BaseHandler{
+			l:       l,
+			r:       r,
+			dlq:     dlq,
+			retries: retries,
+		},
+		consumer: consumer,
+	}, nil
+}
+
+// Start starts the confirm inventory handler
+func (h *ConfirmInventoryHandler) Start(ctx context.Context) error {
+	h.l.InfoContext(ctx, "Starting confirm inventory handler")
+
+	go h.consumer.run(ctx, h.handle)
+
+	return nil
+}
+
+// Stop stops the confirm inventory handler
+func (h *ConfirmInventoryHandler) Stop() error {
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close confirm consumer: %w", err)
+	}
+	return nil
+}
+
+// handle processes a single confirm inventory request
+func (h *ConfirmInventoryHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received confirm inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Reply where the request asks for it, or on the response topic
+	route := reqreply.RouteOf(msg, InventoryResponseTopic)
+
+	// Parse request
+	var request model.ConfirmInventoryRequest
+	env, ok, err := h.open(ctx, msg, ConfirmInventoryMessageType, &request, func() error {
+		return validateQuantity(request.Quantity)
+	})
+	if !ok {
+		return err
+	}
+
+	// Get product ID and order ID from the request
+	productID := request.ProductID
+	orderID := request.OrderID
+
+	h.l.InfoContext(ctx, "Processing confirm inventory request", "order_id", orderID, "message_id", env.ID, "product_id", productID, "quantity", request.Quantity)
+
+	return h.processInTx(ctx, msg, func(r repository.RepositoryI) error {
+		claimed, err := r.ClaimOperation(orderID, productID, model.InventoryOperationConfirm)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return h.replyDuplicate(ctx, r, route, orderID, productID, model.InventoryOperationConfirm)
+		}
+
+		// Only a reservation still held can be confirmed, an expired
+		// one has already been given back to the stock
+		confirmed, err := r.ConfirmReservation(orderID, productID)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			h.l.InfoContext(ctx, "No active reservation to confirm", "order_id", orderID, "product_id", productID)
+			return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationConfirm, false, "no active reservation to confirm")
+		}
+
+		// Send success response
+		h.l.InfoContext(ctx, "Sending success response for confirm inventory", "product_id", productID)
+		return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationConfirm, true, "")
+	})
+}
@@ -3,6 +3,30 @@ package kafka
 const (
 	// Topic names
 	ReserveInventoryTopic  = "oms.reserve-inventory.0"
+	ReserveOrderTopic      = "oms.reserve-order.0"
+	ConfirmInventoryTopic  = "oms.confirm-inventory.0"
+	CancelInventoryTopic   = "oms.cancel-inventory.0"
 	ReleaseInventoryTopic  = "oms.release-inventory.0"
 	InventoryResponseTopic = "oms.order-item-stock-reserved.0"
+	CheckStockTopic        = "oms.check-stock.0"
+	InventoryReplyTopic    = "oms.inventory-replies.0"
+)
+
+const (
+	// Producer is the producer name inventory puts on its messages
+	Producer = "inventory"
+
+	// SchemaVersion is the envelope schema version produced, and the highest
+	// one understood, for every message type
+	SchemaVersion = 1
+
+	// Message types
+	ReserveInventoryMessageType  = "oms.reserve-inventory"
+	ReserveOrderMessageType      = "oms.reserve-order"
+	ConfirmInventoryMessageType  = "oms.confirm-inventory"
+	CancelInventoryMessageType   = "oms.cancel-inventory"
+	ReleaseInventoryMessageType  = "oms.release-inventory"
+	InventoryResponseMessageType = "inventory.inventory-response"
+	CheckStockMessageType        = "oms.check-stock"
+	StockCheckMessageType        = "inventory.stock-check"
 )
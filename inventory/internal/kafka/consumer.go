@@ -0,0 +1,233 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"inventory/internal/messaging"
+	"inventory/internal/workerpool"
+)
+
+// ConsumerConfig configures how the request handlers consume their topics
+type ConsumerConfig struct {
+	Broker messaging.Broker
+	// CommitInterval batches offset commits, zero commits every message on
+	// its own
+	CommitInterval time.Duration
+	// Concurrency is the number of messages of a topic processed at the same
+	// time, messages with the same key are always processed in order
+	Concurrency int
+}
+
+// requestGroupID is the consumer group reading the requests
+const requestGroupID = "inventory-group"
+
+// consumer hands the messages of a topic to a keyed worker pool and commits
+// their offsets once they and every earlier message of their partition are
+// processed. Ordering holds per partition: publishers partition by key, so
+// the messages of a key arrive from one partition in the order they were
+// published and the pool runs them one after another. Partitions read by
+// other members of the group are processed concurrently.
+type consumer struct {
+	l          *slog.Logger
+	topic      string
+	subscriber messaging.Subscriber
+	pool       *workerpool.Pool
+	offsets    *offsetTracker
+}
+
+// newConsumer creates a consumer of topic in the inventory consumer group
+func newConsumer(l *slog.Logger, cfg ConsumerConfig, topic string) *consumer {
+	// Offsets are committed after processing, batched every CommitInterval
+	// or one by one when it is zero
+	subscriber := cfg.Broker.NewSubscriber(messaging.SubscriberConfig{
+		Topics:         []string{topic},
+		GroupID:        requestGroupID,
+		CommitInterval: cfg.CommitInterval,
+	})
+
+	return &consumer{
+		l:          l,
+		topic:      topic,
+		subscriber: subscriber,
+		pool:       workerpool.New(cfg.Concurrency, 16),
+		offsets:    newOffsetTracker(),
+	}
+}
+
+// run fetches the messages of the topic and dispatches them to handle until
+// the context is canceled
+func (c *consumer) run(ctx context.Context, handle func(context.Context, messaging.Message) error) {
+	c.l.InfoContext(ctx, "Starting to handle requests", "topic", c.topic)
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.l.InfoContext(ctx, "Context canceled, stopping consumer", "topic", c.topic)
+			return
+		default:
+			// Fetch message
+			c.l.InfoContext(ctx, "Waiting for request...", "topic", c.topic)
+			msg, err := c.fetch(ctx)
+			if err != nil {
+				if err == context.Canceled || errors.Is(err, messaging.ErrClosed) {
+					c.l.InfoContext(ctx, "Consumer stopped while fetching message", "topic", c.topic)
+					return
+				}
+				c.l.ErrorContext(ctx, "failed to fetch message", "error", err, "topic", c.topic)
+				continue
+			}
+
+			// Requests with the same key are handled in order, others
+			// concurrently. The offset is committed only once the outcome
+			// of the request and of every earlier one is durable, so a
+			// request interrupted by a crash is delivered again.
+			c.dispatch(ctx, msg, handle)
+		}
+	}
+}
+
+// fetch returns the next message of the topic
+func (c *consumer) fetch(ctx context.Context) (messaging.Message, error) {
+	msg, err := c.subscriber.Fetch(ctx)
+	if err != nil {
+		return msg, err
+	}
+	c.offsets.fetched(msg)
+	return msg, nil
+}
+
+// dispatch runs handle for msg on the worker of its key, in the trace of the
+// message, and commits the offsets that became safe to commit afterwards. A
+// message handle returns an error for was neither processed nor moved to a
+// retry or dead-letter topic, it is left uncommitted together with every
+// later message of its partition and delivered again after a restart. The
+// same goes for a message fetched while the consumer is closing.
+func (c *consumer) dispatch(ctx context.Context, msg messaging.Message, handle func(context.Context, messaging.Message) error) {
+	accepted := c.pool.Submit(msg.Key, func() {
+		spanCtx, span := messaging.StartProcessing(ctx, requestGroupID, msg)
+		err := handle(spanCtx, msg)
+		span.End()
+		if err != nil {
+			c.l.ErrorContext(spanCtx, "message left uncommitted", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+			c.offsets.failed(msg)
+			return
+		}
+
+		commit, ok := c.offsets.processed(msg)
+		if !ok {
+			return
+		}
+		// Messages still being processed on shutdown are drained, their
+		// offsets have to be committed even though ctx is canceled
+		if err := c.subscriber.Commit(context.WithoutCancel(ctx), commit); err != nil {
+			c.l.ErrorContext(spanCtx, "failed to commit message", "error", err, "topic", commit.Topic, "partition", commit.Partition, "offset", commit.Offset)
+		}
+	})
+	if !accepted {
+		c.l.InfoContext(ctx, "Consumer closing, message left uncommitted", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+		c.offsets.failed(msg)
+	}
+}
+
+// close waits for the messages being processed and closes the subscriber. A
+// fetch loop blocked handing a message to the pool gets it back refused.
+func (c *consumer) close() error {
+	c.pool.Close()
+	if err := c.subscriber.Close(); err != nil {
+		return fmt.Errorf("failed to close subscriber: %w", err)
+	}
+	return nil
+}
+
+// offsetTracker tracks which fetched messages are processed. Committing an
+// offset marks every earlier offset of its partition as processed, so a
+// message finished by one worker can only be committed once the earlier
+// messages handled by other workers are finished as well. Partitions are
+// tracked per topic since a subscriber reads both versions of a migrating
+// topic. A partition with a failed message is never committed past it, its
+// later offsets are not tracked any more so they do not pile up.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+}
+
+// topicPartition identifies a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// partitionOffsets holds the fetched offsets of a partition that are not
+// committed yet, in the order they were fetched
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]messaging.Message
+	// failed is set once a message of the partition failed
+	failed bool
+}
+
+// newOffsetTracker creates a new offset tracker
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[topicPartition]*partitionOffsets),
+	}
+}
+
+// fetched records a message before it is processed
+func (t *offsetTracker) fetched(msg messaging.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]messaging.Message)}
+		t.partitions[key] = p
+	}
+	if !p.failed {
+		p.pending = append(p.pending, msg.Offset)
+	}
+}
+
+// processed records a processed message and returns the latest message of its
+// partition whose offset can be committed, if any
+func (t *offsetTracker) processed(msg messaging.Message) (messaging.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.partitions[topicPartition{topic: msg.Topic, partition: msg.Partition}]
+	if p.failed {
+		return messaging.Message{}, false
+	}
+	p.done[msg.Offset] = msg
+
+	var commit messaging.Message
+	ok := false
+	for len(p.pending) > 0 {
+		done, isDone := p.done[p.pending[0]]
+		if !isDone {
+			break
+		}
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+		commit, ok = done, true
+	}
+	return commit, ok
+}
+
+// failed records a message that was not processed, its partition is committed
+// no further and its message is delivered again after a restart
+func (t *offsetTracker) failed(msg messaging.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.partitions[topicPartition{topic: msg.Topic, partition: msg.Partition}]
+	p.failed = true
+	p.pending = nil
+	p.done = nil
+}
@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"testing"
+
+	"inventory/internal/messaging"
+)
+
+// message returns a message of partition 0 of the test topic
+func message(offset int64) messaging.Message {
+	return messaging.Message{Topic: "requests", Offset: offset}
+}
+
+func TestOffsetTrackerHoldsCommitsForEarlierOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+	for offset := int64(0); offset < 4; offset++ {
+		tracker.fetched(message(offset))
+	}
+
+	// Later offsets finished by other workers wait for offset 0
+	for _, offset := range []int64{2, 1} {
+		if commit, ok := tracker.processed(message(offset)); ok {
+			t.Fatalf("got commit of offset %d before offset 0 was processed", commit.Offset)
+		}
+	}
+
+	commit, ok := tracker.processed(message(0))
+	if !ok || commit.Offset != 2 {
+		t.Fatalf("got commit %d, %v after offset 0, want offset 2", commit.Offset, ok)
+	}
+	commit, ok = tracker.processed(message(3))
+	if !ok || commit.Offset != 3 {
+		t.Fatalf("got commit %d, %v after offset 3, want offset 3", commit.Offset, ok)
+	}
+}
+
+func TestOffsetTrackerKeepsPartitionsApart(t *testing.T) {
+	tracker := newOffsetTracker()
+	other := messaging.Message{Topic: "requests", Partition: 1, Offset: 7}
+	migrated := messaging.Message{Topic: "requests.v2", Offset: 3}
+	tracker.fetched(message(0))
+	tracker.fetched(other)
+	tracker.fetched(migrated)
+
+	if commit, ok := tracker.processed(other); !ok || commit.Offset != 7 {
+		t.Fatalf("got commit %d, %v on partition 1, want offset 7", commit.Offset, ok)
+	}
+	if commit, ok := tracker.processed(migrated); !ok || commit.Topic != "requests.v2" {
+		t.Fatalf("got commit %+v, %v on the other topic, want its message", commit, ok)
+	}
+}
+
+func TestOffsetTrackerStopsAtAFailedMessage(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.fetched(message(0))
+	tracker.fetched(message(1))
+
+	tracker.failed(message(0))
+	if _, ok := tracker.processed(message(1)); ok {
+		t.Fatal("got commit past a failed message")
+	}
+
+	// Later messages of the partition are not tracked any more
+	for offset := int64(2); offset < 100; offset++ {
+		tracker.fetched(message(offset))
+		if _, ok := tracker.processed(message(offset)); ok {
+			t.Fatalf("got commit of offset %d past a failed message", offset)
+		}
+	}
+	p := tracker.partitions[topicPartition{topic: "requests"}]
+	if len(p.pending) != 0 || len(p.done) != 0 {
+		t.Fatalf("got %d pending and %d done offsets of a failed partition", len(p.pending), len(p.done))
+	}
+}
@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+)
+
+// DeadLetterCollector copies the messages of the dead-letter topics into the
+// dead_letters table, where the admin API lists, republishes and discards them
+type DeadLetterCollector struct {
+	l          *slog.Logger
+	r          repository.RepositoryI
+	subscriber messaging.Subscriber
+}
+
+// NewDeadLetterCollector creates a collector reading the dead-letter topics of topics
+func NewDeadLetterCollector(l *slog.Logger, r repository.RepositoryI, broker messaging.Broker, commitInterval time.Duration, topics []string) *DeadLetterCollector {
+	dlqTopics := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		dlqTopics = append(dlqTopics, deadletter.Topic(topic))
+	}
+
+	// Offsets are committed once a dead letter is stored, batched every
+	// commitInterval or one by one when it is zero
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{
+		Topics:         dlqTopics,
+		GroupID:        "inventory-dlq-collector",
+		CommitInterval: commitInterval,
+	})
+
+	return &DeadLetterCollector{
+		l:          l,
+		r:          r,
+		subscriber: subscriber,
+	}
+}
+
+// Start starts the dead letter collector
+func (c *DeadLetterCollector) Start(ctx context.Context) error {
+	c.l.InfoContext(ctx, "Starting dead letter collector")
+
+	go c.run(ctx)
+
+	return nil
+}
+
+// Stop stops the dead letter collector
+func (c *DeadLetterCollector) Stop() error {
+	if err := c.subscriber.Close(); err != nil {
+		return fmt.Errorf("failed to close dead letter subscriber: %w", err)
+	}
+	return nil
+}
+
+// run stores dead letters until the context is canceled
+func (c *DeadLetterCollector) run(ctx context.Context) {
+	for {
+		msg, err := c.subscriber.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.l.InfoContext(ctx, "Context canceled, stopping dead letter collector")
+				return
+			}
+			c.l.ErrorContext(ctx, "failed to fetch dead letter", "error", err)
+			continue
+		}
+
+		rec := deadletter.Parse(msg)
+		headers := make(map[string]string, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+
+		now := time.Now()
+		dl := model.DeadLetter{
+			Topic:           msg.Topic,
+			Partition:       msg.Partition,
+			Offset:          msg.Offset,
+			SourceTopic:     rec.SourceTopic,
+			SourcePartition: rec.SourcePartition,
+			SourceOffset:    rec.SourceOffset,
+			Key:             string(msg.Key),
+			Headers:         headers,
+			Payload:         string(msg.Value),
+			Error:           rec.Error,
+			Attempts:        rec.Attempts,
+			Status:          model.DeadLetterStatusPending,
+			FailedAt:        rec.FailedAt,
+			CreatedAt:       now,
+		}
+
+		_, err = deadletter.Retry(ctx, processingAttempts, processingBackoff, func() error {
+			return c.r.WithContext(ctx).CreateDeadLetter(dl)
+		})
+		if err != nil {
+			c.l.ErrorContext(ctx, "failed to store dead letter", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+			continue
+		}
+
+		if err := c.subscriber.Commit(ctx, msg); err != nil {
+			c.l.ErrorContext(ctx, "failed to commit dead letter", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+		}
+
+		c.l.InfoContext(ctx, "Stored dead letter", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "source_topic", rec.SourceTopic, "error", rec.Error)
+	}
+}
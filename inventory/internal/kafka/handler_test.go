@@ -0,0 +1,94 @@
+package kafka
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/envelope"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/retrytopic"
+)
+
+// outboxRepository records the messages written to the outbox, any other call
+// panics
+type outboxRepository struct {
+	repository.RepositoryI
+	outbox []model.OutboxMessage
+}
+
+func (r *outboxRepository) WithContext(ctx context.Context) repository.RepositoryI { return r }
+
+func (r *outboxRepository) WithTx(fn func(r repository.RepositoryI) error) error { return fn(r) }
+
+func (r *outboxRepository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	r.outbox = append(r.outbox, msg)
+	return nil
+}
+
+// request returns a reserve inventory request carrying data
+func request(t *testing.T, data any) messaging.Message {
+	t.Helper()
+
+	env, err := envelope.New(ReserveInventoryMessageType, SchemaVersion, "oms", "1", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := env.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messaging.Message{Topic: ReserveInventoryTopic, Key: []byte("1-1"), Value: value, Headers: env.MessageHeaders()}
+}
+
+func TestPoisonRequestIsDeadLetteredWithoutResponse(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	broker := messaging.NewMemory()
+	dlq := deadletter.NewPublisher(l, broker)
+	retries := retrytopic.NewPublisher(l, broker, retrytopic.DefaultTiers)
+	r := &outboxRepository{}
+	h, err := NewReserveInventoryHandler(l, r, dlq, retries, ConsumerConfig{Broker: broker, Concurrency: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+
+	poison := map[string]messaging.Message{
+		"undecodable":      {Topic: ReserveInventoryTopic, Key: []byte("1-1"), Value: []byte("not json")},
+		"invalid quantity": request(t, model.ReserveInventoryRequest{OrderID: 1, ProductID: 1, Quantity: 0}),
+		"missing product":  request(t, model.ReserveInventoryRequest{OrderID: 1, Quantity: 1}),
+	}
+
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{Topics: []string{deadletter.Topic(ReserveInventoryTopic)}, GroupID: "test"})
+	defer subscriber.Close()
+
+	for name, msg := range poison {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := h.handle(ctx, msg); err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+
+			deadLetter, err := subscriber.Fetch(ctx)
+			if err != nil {
+				t.Fatalf("no dead letter: %v", err)
+			}
+			if string(deadLetter.Value) != string(msg.Value) {
+				t.Fatalf("got dead letter %q, want %q", deadLetter.Value, msg.Value)
+			}
+			if deadLetter.Header(deadletter.HeaderSourceTopic) != ReserveInventoryTopic {
+				t.Fatalf("got source topic %q, want %s", deadLetter.Header(deadletter.HeaderSourceTopic), ReserveInventoryTopic)
+			}
+			if len(r.outbox) != 0 {
+				t.Fatalf("got %d responses to a dead-lettered request", len(r.outbox))
+			}
+		})
+	}
+}
@@ -4,42 +4,164 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os"
+	"time"
 
+	"inventory/internal/deadletter"
+	"inventory/internal/env"
+	"inventory/internal/messaging"
 	"inventory/internal/repository"
+	"inventory/internal/retrytopic"
 )
 
+// consumedTopics are the topics inventory consumes requests from. Stock checks
+// on CheckStockTopic are consumed too, they are answered at once or not at all
+// and have no retry topics.
+var consumedTopics = []string{
+	ReserveInventoryTopic,
+	ReserveOrderTopic,
+	ConfirmInventoryTopic,
+	CancelInventoryTopic,
+	ReleaseInventoryTopic,
+}
+
+// provisionTimeout bounds the creation of missing topics at startup
+const provisionTimeout = 30 * time.Second
+
+// provisionedTopics returns the topics inventory publishes to and consumes
+// from: the consumed topics with their retry and dead-letter topics, the stock
+// check topic with its dead-letter topic, and the response and reply topics
+func provisionedTopics() []string {
+	topics := []string{InventoryResponseTopic, InventoryReplyTopic, CheckStockTopic, deadletter.Topic(CheckStockTopic)}
+	for _, topic := range consumedTopics {
+		topics = append(topics, topic, deadletter.Topic(topic))
+		for _, tier := range retrytopic.DefaultTiers {
+			topics = append(topics, retrytopic.Topic(topic, tier))
+		}
+	}
+	return topics
+}
+
 // KafkaServer handles Kafka operations
 type KafkaServer struct {
 	l                       *slog.Logger
 	r                       repository.RepositoryI
 	reserveInventoryHandler *ReserveInventoryHandler
+	reserveOrderHandler     *ReserveOrderHandler
+	confirmInventoryHandler *ConfirmInventoryHandler
+	cancelInventoryHandler  *CancelInventoryHandler
 	releaseInventoryHandler *ReleaseInventoryHandler
+	checkStockHandler       *CheckStockHandler
+	outboxRelay             *OutboxRelay
+	dlq                     *deadletter.Publisher
+	retries                 *retrytopic.Publisher
+	retryForwarders         []*retrytopic.Forwarder
+	deadLetterCollector     *DeadLetterCollector
 }
 
-// New creates a new Kafka server
-func New(l *slog.Logger, r repository.RepositoryI) (*KafkaServer, error) {
-	brokers := os.Getenv("KAFKA_BROKERS")
-	if brokers == "" {
-		brokers = "localhost:9092"
+// New creates a new Kafka server consuming and publishing through broker
+func New(l *slog.Logger, r repository.RepositoryI, broker messaging.Broker) (*KafkaServer, error) {
+	// Create the topics that do not exist yet
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	if err := messaging.EnsureTopics(ctx, broker, provisionedTopics()...); err != nil {
+		return nil, fmt.Errorf("failed to provision topics: %w", err)
+	}
+
+	// Reservations that are neither confirmed nor cancelled in time expire,
+	// a TTL of 0 keeps them until then
+	reservationTTL, err := env.Duration("RESERVATION_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	// Offsets are committed once a request is processed, a commit interval
+	// batches the commits and 0 commits every message on its own
+	commitInterval, err := env.Duration("KAFKA_COMMIT_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests are processed concurrently across keys, requests sharing a
+	// key one after another
+	concurrency, err := env.PositiveInt("CONSUMER_CONCURRENCY", 8)
+	if err != nil {
+		return nil, err
+	}
+	cfg := ConsumerConfig{
+		Broker:         broker,
+		CommitInterval: commitInterval,
+		Concurrency:    concurrency,
+	}
+
+	// Messages that cannot be processed go to the dead-letter topic of
+	// their topic
+	dlq := deadletter.NewPublisher(l, broker)
+
+	// Requests failing with a transient error are retried through retry
+	// topics after 5s, 1m and 10m before they are dead-lettered
+	retries := retrytopic.NewPublisher(l, broker, retrytopic.DefaultTiers)
+	retryForwarders := make([]*retrytopic.Forwarder, 0, len(retrytopic.DefaultTiers))
+	for _, tier := range retrytopic.DefaultTiers {
+		groupID := "inventory-retry" + tier.Suffix
+		retryForwarders = append(retryForwarders, retrytopic.NewForwarder(l, broker, groupID, consumedTopics, tier))
 	}
 
 	// Create handlers
-	reserveHandler, err := NewReserveInventoryHandler(l, r, brokers)
+	reserveHandler, err := NewReserveInventoryHandler(l, r, dlq, retries, cfg, reservationTTL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create reserve inventory handler: %w", err)
 	}
 
-	releaseHandler, err := NewReleaseInventoryHandler(l, r, brokers)
+	reserveOrderHandler, err := NewReserveOrderHandler(l, r, dlq, retries, cfg, reservationTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reserve order handler: %w", err)
+	}
+
+	confirmHandler, err := NewConfirmInventoryHandler(l, r, dlq, retries, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create confirm inventory handler: %w", err)
+	}
+
+	cancelHandler, err := NewCancelInventoryHandler(l, r, dlq, retries, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cancel inventory handler: %w", err)
+	}
+
+	releaseHandler, err := NewReleaseInventoryHandler(l, r, dlq, retries, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create release inventory handler: %w", err)
 	}
 
+	checkStockHandler, err := NewCheckStockHandler(l, r, dlq, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create check stock handler: %w", err)
+	}
+
+	// Create the relay publishing responses from the outbox
+	relayInterval, err := env.Interval("OUTBOX_RELAY_INTERVAL", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	outboxRelay := NewOutboxRelay(l, r, broker, relayInterval)
+
+	// Copy dead letters of the consumed topics into the database for the
+	// admin API
+	deadLetterCollector := NewDeadLetterCollector(l, r, broker, commitInterval, append([]string{CheckStockTopic}, consumedTopics...))
+
 	return &KafkaServer{
 		l:                       l,
 		r:                       r,
 		reserveInventoryHandler: reserveHandler,
+		reserveOrderHandler:     reserveOrderHandler,
+		confirmInventoryHandler: confirmHandler,
+		cancelInventoryHandler:  cancelHandler,
 		releaseInventoryHandler: releaseHandler,
+		checkStockHandler:       checkStockHandler,
+		outboxRelay:             outboxRelay,
+		dlq:                     dlq,
+		retries:                 retries,
+		retryForwarders:         retryForwarders,
+		deadLetterCollector:     deadLetterCollector,
 	}, nil
 }
 
@@ -48,24 +170,83 @@ func (k *KafkaServer) Close() error {
 	if err := k.reserveInventoryHandler.Stop(); err != nil {
 		return fmt.Errorf("failed to stop reserve inventory handler: %w", err)
 	}
+	if err := k.reserveOrderHandler.Stop(); err != nil {
+		return fmt.Errorf("failed to stop reserve order handler: %w", err)
+	}
+	if err := k.confirmInventoryHandler.Stop(); err != nil {
+		return fmt.Errorf("failed to stop confirm inventory handler: %w", err)
+	}
+	if err := k.cancelInventoryHandler.Stop(); err != nil {
+		return fmt.Errorf("failed to stop cancel inventory handler: %w", err)
+	}
 	if err := k.releaseInventoryHandler.Stop(); err != nil {
 		return fmt.Errorf("failed to stop release inventory handler: %w", err)
 	}
+	if err := k.checkStockHandler.Stop(); err != nil {
+		return fmt.Errorf("failed to stop check stock handler: %w", err)
+	}
+	if err := k.outboxRelay.Stop(); err != nil {
+		return fmt.Errorf("failed to stop outbox relay: %w", err)
+	}
+	if err := k.dlq.Close(); err != nil {
+		return fmt.Errorf("failed to close dead-letter publisher: %w", err)
+	}
+	for _, f := range k.retryForwarders {
+		if err := f.Stop(); err != nil {
+			return fmt.Errorf("failed to stop retry forwarder: %w", err)
+		}
+	}
+	if err := k.retries.Close(); err != nil {
+		return fmt.Errorf("failed to close retry publisher: %w", err)
+	}
+	if err := k.deadLetterCollector.Stop(); err != nil {
+		return fmt.Errorf("failed to stop dead letter collector: %w", err)
+	}
 	return nil
 }
 
 // Start starts the Kafka server
 func (k *KafkaServer) Start(ctx context.Context) error {
-	k.l.Info("Starting Kafka server")
+	k.l.InfoContext(ctx, "Starting Kafka server")
 
 	// Start handlers
 	if err := k.reserveInventoryHandler.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start reserve inventory handler: %w", err)
 	}
 
+	if err := k.reserveOrderHandler.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start reserve order handler: %w", err)
+	}
+
+	if err := k.confirmInventoryHandler.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start confirm inventory handler: %w", err)
+	}
+
+	if err := k.cancelInventoryHandler.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start cancel inventory handler: %w", err)
+	}
+
 	if err := k.releaseInventoryHandler.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start release inventory handler: %w", err)
 	}
 
+	if err := k.checkStockHandler.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start check stock handler: %w", err)
+	}
+
+	if err := k.outboxRelay.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start outbox relay: %w", err)
+	}
+
+	for _, f := range k.retryForwarders {
+		if err := f.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start retry forwarder: %w", err)
+		}
+	}
+
+	if err := k.deadLetterCollector.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start dead letter collector: %w", err)
+	}
+
 	return nil
 }
@@ -2,64 +2,186 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
+	"inventory/internal/deadletter"
+	"inventory/internal/envelope"
+	"inventory/internal/messaging"
 	"inventory/internal/model"
 	"inventory/internal/repository"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
+)
 
-	"github.com/segmentio/kafka-go"
+// Processing of a request is attempted processingAttempts times, waiting
+// processingBackoff after the first failure and doubling the wait after each
+// further one
+const (
+	processingAttempts = 3
+	processingBackoff  = 200 * time.Millisecond
 )
 
+// publishBackoff is the wait between attempts to write a message to a retry
+// or dead-letter topic
+const publishBackoff = time.Second
+
 // BaseHandler provides common functionality for all handlers
 type BaseHandler struct {
-	l      *slog.Logger
-	r      repository.RepositoryI
-	writer *kafka.Writer
+	l       *slog.Logger
+	r       repository.RepositoryI
+	dlq     *deadletter.Publisher
+	retries *retrytopic.Publisher
+}
+
+// process runs fn with retries. A message that keeps failing with a transient
+// database error is moved to the next retry topic to be processed again
+// later, any other failure and a message out of retry tiers is dead-lettered.
+// Business failures such as missing stock are answered by fn and never reach
+// this point. An error is returned only when the message could neither be
+// processed nor moved, it must not be committed then.
+func (h *BaseHandler) process(ctx context.Context, msg messaging.Message, fn func() error) error {
+	attempts, err := deadletter.Retry(ctx, processingAttempts, processingBackoff, fn)
+	if err == nil {
+		return nil
+	}
+	h.l.ErrorContext(ctx, "failed to process request", "error", err, "topic", msg.Topic, "key", string(msg.Key), "attempts", attempts)
+
+	if repository.IsTransient(err) && !h.retries.Exhausted(msg) {
+		return deadletter.RetryUntil(ctx, publishBackoff, func() error {
+			retryErr := h.retries.Publish(ctx, msg, err)
+			if retryErr != nil {
+				h.l.ErrorContext(ctx, "failed to schedule retry", "error", retryErr, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+			}
+			return retryErr
+		})
+	}
+
+	return h.deadLetter(ctx, msg, err, attempts+retrytopic.Attempt(msg)*processingAttempts)
+}
+
+// open decodes the request of msg into request and validates it. A request
+// that cannot be decoded or is invalid is dead-lettered and not answered, the
+// saga timeouts of OMS handle it. ok is false then, with an error when the
+// dead letter could not be written and msg must not be committed.
+func (h *BaseHandler) open(ctx context.Context, msg messaging.Message, msgType string, request any, validate func() error) (envelope.Envelope, bool, error) {
+	env, err := envelope.Open(msg, msgType, SchemaVersion, request)
+	if err == nil {
+		err = validate()
+	}
+	if err != nil {
+		h.l.ErrorContext(ctx, "invalid request, dead-lettering it", "error", err, "topic", msg.Topic, "key", string(msg.Key))
+		return env, false, h.deadLetter(ctx, msg, err, 1)
+	}
+	return env, true, nil
+}
+
+// processInTx processes a request in a transaction of its own. Recording the
+// request, changing the stock and enqueueing the response in one transaction
+// applies a redelivered request only once. Failures are retried by process,
+// transient ones later again through the retry topics, and a request that
+// keeps failing is dead-lettered and left to the saga timeouts of OMS.
+func (h *BaseHandler) processInTx(ctx context.Context, msg messaging.Message, fn func(r repository.RepositoryI) error) error {
+	return h.process(ctx, msg, func() error {
+		return h.r.WithContext(ctx).WithTx(fn)
+	})
+}
+
+// deadLetter moves an unprocessable message to the dead-letter topic of its
+// topic, trying again until it succeeds or the context is canceled
+func (h *BaseHandler) deadLetter(ctx context.Context, msg messaging.Message, reason error, attempts int) error {
+	return deadletter.RetryUntil(ctx, publishBackoff, func() error {
+		return h.dlq.Publish(ctx, msg, reason, attempts)
+	})
 }
 
-// sendResponse sends a response to Kafka with retry logic
-func (h *BaseHandler) sendResponse(orderID int, productID int, success bool, errorMsg string) {
-	h.l.Info("Preparing to send inventory response", "order_id", orderID, "product_id", productID, "success", success)
+// enqueueResponse writes a response to the outbox using r, so it can be part
+// of the transaction changing the stock
+func (h *BaseHandler) enqueueResponse(ctx context.Context, r repository.RepositoryI, route reqreply.Route, orderID int, productID int, operation string, success bool, errorMsg string) error {
+	h.l.InfoContext(ctx, "Preparing to send inventory response", "order_id", orderID, "product_id", productID, "operation", operation, "success", success)
 
 	response := model.InventoryResponse{
 		OrderID:   orderID,
 		ProductID: productID,
+		Operation: operation,
 		Success:   success,
 		Error:     errorMsg,
 	}
+	return writeResponse(r, route, fmt.Sprintf("%d-%d", orderID, productID), response)
+}
 
-	jsonData, err := json.Marshal(response)
+// writeResponse writes an inventory response with the given key to the outbox,
+// addressed to the reply route of its request and carrying its correlation ID
+func writeResponse(r repository.RepositoryI, route reqreply.Route, key string, response model.InventoryResponse) error {
+	env, err := envelope.New(InventoryResponseMessageType, SchemaVersion, Producer, route.CorrelationID, response)
 	if err != nil {
-		h.l.Error("failed to marshal response", "error", err)
-		return
+		return err
+	}
+	value, err := env.Marshal()
+	if err != nil {
+		return err
 	}
 
-	// Try to send the response with retries
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		// Create a context with timeout for writing the message
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		h.l.Info("Writing response to Kafka", "topic", InventoryResponseTopic, "key", fmt.Sprintf("%d", productID), "attempt", i+1)
-		err = h.writer.WriteMessages(ctx, kafka.Message{
-			Key:   []byte(fmt.Sprintf("%d", productID)),
-			Value: jsonData,
-		})
-		if err == nil {
-			h.l.Info("Successfully sent inventory response", "product_id", productID, "success", success, "attempt", i+1)
-			return
-		}
-
-		h.l.Error("failed to write response", "error", err, "attempt", i+1)
-		if i < maxRetries-1 {
-			// Wait before retrying, using exponential backoff
-			time.Sleep(time.Duration(i+1) * 500 * time.Millisecond)
-		}
+	return r.CreateOutboxMessage(model.OutboxMessage{
+		Topic:     route.Topic,
+		Key:       key,
+		Headers:   env.Headers(),
+		Payload:   value,
+		CreatedAt: time.Now(),
+	})
+}
+
+// replyDuplicate answers a redelivered request with the outcome recorded when
+// it was first processed
+func (h *BaseHandler) replyDuplicate(ctx context.Context, r repository.RepositoryI, route reqreply.Route, orderID int, productID int, operation string) error {
+	op, err := r.GetOperation(orderID, productID, operation)
+	if err != nil {
+		return fmt.Errorf("failed to get processed operation: %w", err)
 	}
 
-	h.l.Error("failed to send response after all retries", "product_id", productID, "retries", maxRetries)
+	h.l.InfoContext(ctx, "Duplicate request, replying with recorded outcome", "order_id", orderID, "product_id", productID, "operation", operation, "success", op.Success)
+	return h.enqueueResponse(ctx, r, route, orderID, productID, operation, op.Success, op.Error)
+}
+
+// completeOperation records the outcome of a claimed operation and enqueues
+// its response
+func (h *BaseHandler) completeOperation(ctx context.Context, r repository.RepositoryI, route reqreply.Route, orderID int, productID int, operation string, success bool, errorMsg string) error {
+	if err := r.CompleteOperation(orderID, productID, operation, success, errorMsg); err != nil {
+		return err
+	}
+	return h.enqueueResponse(ctx, r, route, orderID, productID, operation, success, errorMsg)
+}
+
+// refuseUnprocessedReservation claims the reservation of an order as failed
+// when it has not been processed yet, so a reservation overtaken by its
+// cancel or release is refused when it arrives. It reports whether it did.
+func (h *BaseHandler) refuseUnprocessedReservation(ctx context.Context, r repository.RepositoryI, orderID int, productID int, reason string) (bool, error) {
+	claimed, err := r.ClaimOperation(orderID, productID, model.InventoryOperationReserve)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	h.l.InfoContext(ctx, "Reservation not processed yet, refusing it", "order_id", orderID, "product_id", productID, "reason", reason)
+	if err := r.CompleteOperation(orderID, productID, model.InventoryOperationReserve, false, reason); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// validateItem checks that a request names a product and a positive quantity
+func validateItem(productID int, quantity int) error {
+	if productID == 0 {
+		return errors.New("invalid product ID: product ID cannot be 0")
+	}
+	return validateQuantity(quantity)
+}
+
+// validateQuantity checks that a request is for a positive quantity
+func validateQuantity(quantity int) error {
+	if quantity <= 0 {
+		return errors.New("invalid quantity: quantity must be positive")
+	}
+	return nil
 }
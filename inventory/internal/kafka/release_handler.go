@@ -2,130 +2,116 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"time"
 
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
 	"inventory/internal/model"
 	"inventory/internal/repository"
-
-	"github.com/segmentio/kafka-go"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
 )
 
 // ReleaseInventoryHandler handles release inventory requests
 type ReleaseInventoryHandler struct {
 	BaseHandler
-	reader *kafka.Reader
+	consumer *consumer
 }
 
 // NewReleaseInventoryHandler creates a new release inventory handler
-func NewReleaseInventoryHandler(l *slog.Logger, r repository.RepositoryI, brokers string) (*ReleaseInventoryHandler, error) {
-	// Create a reader for release inventory requests
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  []string{brokers},
-		Topic:    ReleaseInventoryTopic,
-		GroupID:  "inventory-group",
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-		MaxWait:  time.Second,
-	})
-
-	// Create a writer for responses
-	writer := &kafka.Writer{
-		Addr:         kafka.TCP(brokers),
-		Topic:        InventoryResponseTopic,
-		Balancer:     &kafka.LeastBytes{},
-		RequiredAcks: kafka.RequireOne,
-	}
+func NewReleaseInventoryHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, retries *retrytopic.Publisher, cfg ConsumerConfig) (*ReleaseInventoryHandler, error) {
+	// Create a consumer for release inventory requests
+	consumer := newConsumer(l, cfg, ReleaseInventoryTopic)
 
 	return &ReleaseInventoryHandler{
 		BaseHandler: BaseHandler{
-			l:      l,
-			r:      r,
-			writer: writer,
+			l:       l,
+			r:       r,
+			dlq:     dlq,
+			retries: retries,
 		},
-		reader: reader,
+		consumer: consumer,
 	}, nil
 }
 
 // Start starts the release inventory handler
 func (h *ReleaseInventoryHandler) Start(ctx context.Context) error {
-	h.l.Info("Starting release inventory handler")
+	h.l.InfoContext(ctx, "Starting release inventory handler")
 
-	go h.handleMessages(ctx)
+	go h.consumer.run(ctx, h.handle)
 
 	return nil
 }
 
 // Stop stops the release inventory handler
 func (h *ReleaseInventoryHandler) Stop() error {
-	if err := h.reader.Close(); err != nil {
-		return fmt.Errorf("failed to close release reader: %w", err)
-	}
-	if err := h.writer.Close(); err != nil {
-		return fmt.Errorf("failed to close writer: %w", err)
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close release consumer: %w", err)
 	}
 	return nil
 }
 
-// handleMessages handles incoming release inventory messages
-func (h *ReleaseInventoryHandler) handleMessages(ctx context.Context) {
-	h.l.Info("Starting to handle release inventory requests")
-
-	for {
-		select {
-		case <-ctx.Done():
-			h.l.Info("Context canceled, stopping release inventory handler")
-			return
-		default:
-			// Read message
-			h.l.Info("Waiting for release inventory request...")
-			msg, err := h.reader.ReadMessage(ctx)
-			if err != nil {
-				if err == context.Canceled {
-					h.l.Info("Context canceled while reading message")
-					return
-				}
-				h.l.Error("failed to read message", "error", err)
-				continue
-			}
+// handle processes a single release inventory request
+func (h *ReleaseInventoryHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received release inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
 
-			h.l.Info("Received release inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
+	// Reply where the request asks for it, or on the response topic
+	route := reqreply.RouteOf(msg, InventoryResponseTopic)
 
-			// Parse request
-			var request model.ReleaseInventoryRequest
-			productID := request.ProductID
-			orderID := request.OrderID
-			if err := json.Unmarshal(msg.Value, &request); err != nil {
-				h.l.Error("failed to unmarshal request", "error", err)
-				h.sendResponse(orderID, productID, false, "failed to unmarshal request")
-				continue
-			}
+	// Parse request
+	var request model.ReleaseInventoryRequest
+	env, ok, err := h.open(ctx, msg, ReleaseInventoryMessageType, &request, func() error {
+		return validateQuantity(request.Quantity)
+	})
+	if !ok {
+		return err
+	}
 
-			h.l.Info("Processing release inventory request", "product_id", productID, "quantity", request.Quantity)
+	// Get product ID and order ID from the request
+	productID := request.ProductID
+	orderID := request.OrderID
 
-			// Process request using repository directly
-			quantity, err := h.r.GetQuantityOfAProduct(productID)
-			if err != nil {
-				h.l.Error("failed to get quantity of product", "error", err, "product_id", productID)
-				h.sendResponse(orderID, productID, false, fmt.Sprintf("failed to get quantity of product: %v", err))
-				continue
-			}
+	h.l.InfoContext(ctx, "Processing release inventory request", "order_id", orderID, "message_id", env.ID, "product_id", productID, "quantity", request.Quantity)
 
-			// Release the quantity by adding it back
-			quantity.Quantity = quantity.Quantity + request.Quantity
+	return h.processInTx(ctx, msg, func(r repository.RepositoryI) error {
+		claimed, err := r.ClaimOperation(orderID, productID, model.InventoryOperationRelease)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return h.replyDuplicate(ctx, r, route, orderID, productID, model.InventoryOperationRelease)
+		}
+
+		refused, err := h.refuseUnprocessedReservation(ctx, r, orderID, productID, "reservation released before it was processed")
+		if err != nil {
+			return err
+		}
+		if refused {
+			return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationRelease, true, "")
+		}
+
+		// Give the held quantity back, a reservation that failed or
+		// already expired holds nothing
+		released, err := r.ReleaseReservation(orderID, productID, model.ReservationStatusReleased)
+		if err != nil {
+			return err
+		}
 
-			err = h.r.UpdateQuantityOfAProduct(productID, quantity.Quantity)
+		// A confirmed reservation already left the stock and is put
+		// back on hand
+		if !released {
+			released, err = r.ReturnCommittedReservation(orderID, productID)
 			if err != nil {
-				h.l.Error("failed to release inventory", "error", err, "product_id", productID)
-				h.sendResponse(orderID, productID, false, fmt.Sprintf("failed to release inventory: %v", err))
-				continue
+				return err
 			}
-
-			// Send success response
-			h.l.Info("Sending success response for release inventory", "product_id", productID)
-			h.sendResponse(orderID, productID, true, "")
 		}
-	}
+		if !released {
+			h.l.InfoContext(ctx, "Nothing reserved for the order, nothing to release", "order_id", orderID, "product_id", productID)
+		}
+
+		// Send success response
+		h.l.InfoContext(ctx, "Sending success response for release inventory", "product_id", productID)
+		return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationRelease, true, "")
+	})
 }
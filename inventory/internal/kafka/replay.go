@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/envelope"
+	"inventory/internal/messaging"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/retrytopic"
+)
+
+// requestTopics maps the request topics to the message types they carry, for
+// requests sent without a message type header
+var requestTopics = map[string]string{
+	ReserveInventoryTopic: ReserveInventoryMessageType,
+	ReserveOrderTopic:     ReserveOrderMessageType,
+	ConfirmInventoryTopic: ConfirmInventoryMessageType,
+	CancelInventoryTopic:  CancelInventoryMessageType,
+	ReleaseInventoryTopic: ReleaseInventoryMessageType,
+}
+
+// Replayer runs request messages through the inventory handlers again, for
+// the replay tool. The handlers work on the repository they are given;
+// dead letters and retries they publish are recorded instead of sent.
+type Replayer struct {
+	l *slog.Logger
+	// reservationTTL is the reservation TTL of the reserve handlers
+	reservationTTL time.Duration
+}
+
+// NewReplayer creates a replayer whose reserve handlers hold stock for
+// reservationTTL
+func NewReplayer(l *slog.Logger, reservationTTL time.Duration) *Replayer {
+	return &Replayer{
+		l:              l,
+		reservationTTL: reservationTTL,
+	}
+}
+
+// ReplayOutcome is what handling a request produced besides its changes to
+// the stock
+type ReplayOutcome struct {
+	// Responses are the responses written to the outbox
+	Responses []model.InventoryResponse
+	// Published are the messages sent to dead-letter and retry topics
+	Published []messaging.Message
+}
+
+// ReplayTarget is the order and products a request is about
+type ReplayTarget struct {
+	OrderID    int
+	ProductIDs []int
+}
+
+// Target returns the order and products of a request
+func (p *Replayer) Target(msg messaging.Message) (ReplayTarget, error) {
+	messageType, err := requestType(msg)
+	if err != nil {
+		return ReplayTarget{}, err
+	}
+
+	var request struct {
+		OrderID   int                      `json:"order_id"`
+		ProductID int                      `json:"product_id"`
+		Items     []model.ReserveOrderItem `json:"items"`
+	}
+	if _, err := envelope.Open(msg, messageType, SchemaVersion, &request); err != nil {
+		return ReplayTarget{}, err
+	}
+
+	target := ReplayTarget{OrderID: request.OrderID}
+	if request.ProductID != 0 {
+		target.ProductIDs = append(target.ProductIDs, request.ProductID)
+	}
+	for _, item := range request.Items {
+		target.ProductIDs = append(target.ProductIDs, item.ProductID)
+	}
+	return target, nil
+}
+
+// Replay handles msg with the handler of its message type, which reads and
+// changes state through r
+func (p *Replayer) Replay(ctx context.Context, r repository.RepositoryI, msg messaging.Message) (ReplayOutcome, error) {
+	messageType, err := requestType(msg)
+	if err != nil {
+		return ReplayOutcome{}, err
+	}
+
+	rec := &replayRecorder{}
+	base := BaseHandler{
+		l:       p.l,
+		r:       &recordingRepository{RepositoryI: r, rec: rec},
+		dlq:     deadletter.NewPublisher(p.l, &recordingBroker{rec: rec}),
+		retries: retrytopic.NewPublisher(p.l, &recordingBroker{rec: rec}, retrytopic.DefaultTiers),
+	}
+
+	var handle func(context.Context, messaging.Message) error
+	switch messageType {
+	case ReserveInventoryMessageType:
+		h := &ReserveInventoryHandler{BaseHandler: base, reservationTTL: p.reservationTTL}
+		handle = h.handle
+	case ReserveOrderMessageType:
+		h := &ReserveOrderHandler{BaseHandler: base, reservationTTL: p.reservationTTL}
+		handle = h.handle
+	case ConfirmInventoryMessageType:
+		h := &ConfirmInventoryHandler{BaseHandler: base}
+		handle = h.handle
+	case CancelInventoryMessageType:
+		h := &CancelInventoryHandler{BaseHandler: base}
+		handle = h.handle
+	case ReleaseInventoryMessageType:
+		h := &ReleaseInventoryHandler{BaseHandler: base}
+		handle = h.handle
+	}
+	if err := handle(ctx, msg); err != nil {
+		return ReplayOutcome{}, fmt.Errorf("failed to handle request: %w", err)
+	}
+
+	outcome := ReplayOutcome{Published: rec.published}
+	for _, out := range rec.outbox {
+		var response model.InventoryResponse
+		if _, err := envelope.Open(messaging.Message{Value: out.Payload, Headers: envelope.ToHeaders(out.Headers)}, InventoryResponseMessageType, SchemaVersion, &response); err != nil {
+			return outcome, fmt.Errorf("failed to open response: %w", err)
+		}
+		outcome.Responses = append(outcome.Responses, response)
+	}
+	return outcome, nil
+}
+
+// requestType returns the message type of a request from its header, or
+// from its topic for requests without one
+func requestType(msg messaging.Message) (string, error) {
+	if messageType := msg.Header(envelope.HeaderMessageType); messageType != "" {
+		for _, t := range requestTopics {
+			if t == messageType {
+				return messageType, nil
+			}
+		}
+		return "", fmt.Errorf("no handler for message type %q", messageType)
+	}
+
+	if messageType, ok := requestTopics[msg.Topic]; ok {
+		return messageType, nil
+	}
+	return "", fmt.Errorf("no handler for messages of topic %s", msg.Topic)
+}
+
+// replayRecorder collects what the handlers write while replaying
+type replayRecorder struct {
+	mu        sync.Mutex
+	outbox    []model.OutboxMessage
+	published []messaging.Message
+}
+
+// recordingRepository records the outbox messages written through it
+type recordingRepository struct {
+	repository.RepositoryI
+	rec *replayRecorder
+}
+
+func (r *recordingRepository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	if err := r.RepositoryI.CreateOutboxMessage(msg); err != nil {
+		return err
+	}
+	r.rec.mu.Lock()
+	r.rec.outbox = append(r.rec.outbox, msg)
+	r.rec.mu.Unlock()
+	return nil
+}
+
+func (r *recordingRepository) WithTx(fn func(r repository.RepositoryI) error) error {
+	return r.RepositoryI.WithTx(func(tx repository.RepositoryI) error {
+		return fn(&recordingRepository{RepositoryI: tx, rec: r.rec})
+	})
+}
+
+func (r *recordingRepository) WithContext(ctx context.Context) repository.RepositoryI {
+	return &recordingRepository{RepositoryI: r.RepositoryI.WithContext(ctx), rec: r.rec}
+}
+
+// recordingBroker records published messages instead of sending them
+type recordingBroker struct {
+	rec *replayRecorder
+}
+
+func (b *recordingBroker) NewPublisher() messaging.Publisher {
+	return b
+}
+
+func (b *recordingBroker) NewSubscriber(cfg messaging.SubscriberConfig) messaging.Subscriber {
+	return messaging.NewMemory().NewSubscriber(cfg)
+}
+
+func (b *recordingBroker) Publish(ctx context.Context, msgs ...messaging.Message) error {
+	b.rec.mu.Lock()
+	b.rec.published = append(b.rec.published, msgs...)
+	b.rec.mu.Unlock()
+	return nil
+}
+
+func (b *recordingBroker) Close() error {
+	return nil
+}
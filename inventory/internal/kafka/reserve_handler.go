@@ -2,152 +2,130 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
+	"inventory/internal/metrics"
 	"inventory/internal/model"
 	"inventory/internal/repository"
-
-	"github.com/segmentio/kafka-go"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
 )
 
 // ReserveInventoryHandler handles reserve inventory requests
 type ReserveInventoryHandler struct {
 	BaseHandler
-	reader *kafka.Reader
+	consumer *consumer
+	// reservationTTL is how long a reservation holds stock, zero keeps it
+	// until it is released
+	reservationTTL time.Duration
 }
 
 // NewReserveInventoryHandler creates a new reserve inventory handler
-func NewReserveInventoryHandler(l *slog.Logger, r repository.RepositoryI, brokers string) (*ReserveInventoryHandler, error) {
-	// Create a reader for reserve inventory requests
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  []string{brokers},
-		Topic:    ReserveInventoryTopic,
-		GroupID:  "inventory-group",
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-		MaxWait:  time.Second,
-	})
-
-	// Create a writer for responses
-	writer := &kafka.Writer{
-		Addr:         kafka.TCP(brokers),
-		Topic:        InventoryResponseTopic,
-		Balancer:     &kafka.LeastBytes{},
-		RequiredAcks: kafka.RequireOne,
-	}
+func NewReserveInventoryHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, retries *retrytopic.Publisher, cfg ConsumerConfig, reservationTTL time.Duration) (*ReserveInventoryHandler, error) {
+	// Create a consumer for reserve inventory requests
+	consumer := newConsumer(l, cfg, ReserveInventoryTopic)
 
 	return &ReserveInventoryHandler{
 		BaseHandler: BaseHandler{
-			l:      l,
-			r:      r,
-			writer: writer,
+			l:       l,
+			r:       r,
+			dlq:     dlq,
+			retries: retries,
 		},
-		reader: reader,
+		consumer:       consumer,
+		reservationTTL: reservationTTL,
 	}, nil
 }
 
+// expiresAt returns the expiry of a reservation made at now that holds stock
+// for ttl, a zero ttl never expires
+func expiresAt(now time.Time, ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := now.Add(ttl)
+	return &expiresAt
+}
+
 // Start starts the reserve inventory handler
 func (h *ReserveInventoryHandler) Start(ctx context.Context) error {
-	h.l.Info("Starting reserve inventory handler")
+	h.l.InfoContext(ctx, "Starting reserve inventory handler")
 
-	go h.handleMessages(ctx)
+	go h.consumer.run(ctx, h.handle)
 
 	return nil
 }
 
 // Stop stops the reserve inventory handler
 func (h *ReserveInventoryHandler) Stop() error {
-	if err := h.reader.Close(); err != nil {
-		return fmt.Errorf("failed to close reserve reader: %w", err)
-	}
-	if err := h.writer.Close(); err != nil {
-		return fmt.Errorf("failed to close writer: %w", err)
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close reserve consumer: %w", err)
 	}
 	return nil
 }
 
-// handleMessages handles incoming reserve inventory messages
-func (h *ReserveInventoryHandler) handleMessages(ctx context.Context) {
-	h.l.Info("Starting to handle reserve inventory requests")
-
-	for {
-		select {
-		case <-ctx.Done():
-			h.l.Info("Context canceled, stopping reserve inventory handler")
-			return
-		default:
-			// Read message
-			h.l.Info("Waiting for reserve inventory request...")
-			msg, err := h.reader.ReadMessage(ctx)
-			if err != nil {
-				if err == context.Canceled {
-					h.l.Info("Context canceled while reading message")
-					return
-				}
-				h.l.Error("failed to read message", "error", err)
-				continue
-			}
-
-			h.l.Info("Received reserve inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
-
-			// Parse request
-			var request model.ReserveInventoryRequest
-			if err := json.Unmarshal(msg.Value, &request); err != nil {
-				h.l.Error("failed to unmarshal request", "error", err)
-				// Extract order ID and product ID from the message key as fallback
-				var orderID, productID int
-				_, err := fmt.Sscanf(string(msg.Key), "%d-%d", &orderID, &productID)
-				if err != nil {
-					h.l.Error("failed to extract order ID and product ID from message key", "key", string(msg.Key), "error", err)
-				} else {
-					h.sendResponse(orderID, productID, false, "failed to unmarshal request")
-				}
-				continue
-			}
-
-			// Get product ID and order ID from the request
-			productID := request.ProductID
-			orderID := request.OrderID
-
-			// Validate product ID
-			if productID == 0 {
-				h.l.Error("invalid product ID", "product_id", productID)
-				h.sendResponse(orderID, productID, false, "invalid product ID: product ID cannot be 0")
-				continue
-			}
-
-			h.l.Info("Processing reserve inventory request", "order_id", orderID, "product_id", productID, "quantity", request.Quantity)
-
-			// Process request using repository directly
-			quantity, err := h.r.GetQuantityOfAProduct(productID)
-			if err != nil {
-				h.l.Error("failed to get quantity of product", "error", err, "product_id", productID)
-				h.sendResponse(orderID, productID, false, fmt.Sprintf("failed to get quantity of product: %v", err))
-				continue
-			}
-
-			if quantity.Quantity < request.Quantity {
-				h.l.Error("not enough quantity available", "product_id", productID, "available", quantity.Quantity, "requested", request.Quantity)
-				h.sendResponse(orderID, productID, false, "not enough quantity available")
-				continue
-			}
-
-			// Reserve the quantity by reducing it
-			quantity.Quantity = quantity.Quantity - request.Quantity
-
-			err = h.r.UpdateQuantityOfAProduct(productID, quantity.Quantity)
-			if err != nil {
-				h.l.Error("failed to reserve inventory", "error", err, "product_id", productID)
-				h.sendResponse(orderID, productID, false, fmt.Sprintf("failed to reserve inventory: %v", err))
-				continue
-			}
-
-			// Send success response
-			h.l.Info("Sending success response for reserve inventory", "product_id", productID)
-			h.sendResponse(orderID, productID, true, "")
-		}
+// handle processes a single reserve inventory request
+func (h *ReserveInventoryHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received reserve inventory request", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Reply where the request asks for it, or on the response topic
+	route := reqreply.RouteOf(msg, InventoryResponseTopic)
+
+	// Parse request
+	var request model.ReserveInventoryRequest
+	env, ok, err := h.open(ctx, msg, ReserveInventoryMessageType, &request, func() error {
+		return validateItem(request.ProductID, request.Quantity)
+	})
+	if !ok {
+		return err
 	}
+
+	// Get product ID and order ID from the request
+	productID := request.ProductID
+	orderID := request.OrderID
+
+	h.l.InfoContext(ctx, "Processing reserve inventory request", "order_id", orderID, "message_id", env.ID, "product_id", productID, "quantity", request.Quantity)
+
+	return h.processInTx(ctx, msg, func(r repository.RepositoryI) error {
+		claimed, err := r.ClaimOperation(orderID, productID, model.InventoryOperationReserve)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return h.replyDuplicate(ctx, r, route, orderID, productID, model.InventoryOperationReserve)
+		}
+
+		// Hold the quantity for the order only if enough is available
+		now := time.Now()
+		ok, err := r.CreateReservation(model.Reservation{
+			OrderID:   orderID,
+			ProductID: productID,
+			Quantity:  request.Quantity,
+			Status:    model.ReservationStatusReserved,
+			ExpiresAt: expiresAt(now, h.reservationTTL),
+			CreatedAt: now,
+		})
+		if errors.Is(err, repository.ErrProductNotFound) {
+			h.l.ErrorContext(ctx, "failed to get quantity of product", "error", err, "product_id", productID)
+			return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationReserve, false, fmt.Sprintf("failed to get quantity of product: %v", err))
+		}
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			h.l.ErrorContext(ctx, "not enough quantity available", "product_id", productID, "requested", request.Quantity)
+			metrics.StockOuts.WithLabelValues(model.InventoryOperationReserve).Inc()
+			return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationReserve, false, "not enough quantity available")
+		}
+
+		// Send success response
+		h.l.InfoContext(ctx, "Sending success response for reserve inventory", "product_id", productID)
+		return h.completeOperation(ctx, r, route, orderID, productID, model.InventoryOperationReserve, true, "")
+	})
 }
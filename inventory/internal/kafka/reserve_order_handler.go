@@ -0,0 +1,256 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"inventory/internal/deadletter"
+	"inventory/internal/messaging"
+	"inventory/internal/metrics"
+	"inventory/internal/model"
+	"inventory/internal/repository"
+	"inventory/internal/reqreply"
+	"inventory/internal/retrytopic"
+)
+
+// ReserveOrderHandler handles order-level reserve requests. All items of an
+// order are reserved in one transaction or none of them is.
+type ReserveOrderHandler struct {
+	BaseHandler
+	consumer *consumer
+	// reservationTTL is how long a reservation holds stock, zero keeps it
+	// until it is released
+	reservationTTL time.Duration
+}
+
+// NewReserveOrderHandler creates a new reserve order handler
+func NewReserveOrderHandler(l *slog.Logger, r repository.RepositoryI, dlq *deadletter.Publisher, retries *retrytopic.Publisher, cfg ConsumerConfig, reservationTTL time.Duration) (*ReserveOrderHandler, error) {
+	// Create a consumer for reserve order requests
+	consumer := newConsumer(l, cfg, ReserveOrderTopic)
+
+	return &ReserveOrderHandler{
+		BaseHandler: BaseHandler{
+			l:       l,
+			r:       r,
+			dlq:     dlq,
+			retries: retries,
+		},
+		consumer:       consumer,
+		reservationTTL: reservationTTL,
+	}, nil
+}
+
+// Start starts the reserve order handler
+func (h *ReserveOrderHandler) Start(ctx context.Context) error {
+	h.l.InfoContext(ctx, "Starting reserve order handler")
+
+	go h.consumer.run(ctx, h.handle)
+
+	return nil
+}
+
+// Stop stops the reserve order handler
+func (h *ReserveOrderHandler) Stop() error {
+	if err := h.consumer.close(); err != nil {
+		return fmt.Errorf("failed to close reserve order consumer: %w", err)
+	}
+	return nil
+}
+
+// handle processes a single reserve order request
+func (h *ReserveOrderHandler) handle(ctx context.Context, msg messaging.Message) error {
+	h.l.InfoContext(ctx, "Received reserve order request", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Reply where the request asks for it, or on the response topic
+	route := reqreply.RouteOf(msg, InventoryResponseTopic)
+
+	// Parse request
+	var request model.ReserveOrderRequest
+	env, ok, err := h.open(ctx, msg, ReserveOrderMessageType, &request, func() error {
+		return validateReserveOrderRequest(request)
+	})
+	if !ok {
+		return err
+	}
+	orderID := request.OrderID
+
+	h.l.InfoContext(ctx, "Processing reserve order request", "order_id", orderID, "message_id", env.ID, "items", len(request.Items))
+
+	return h.processInTx(ctx, msg, func(r repository.RepositoryI) error {
+		claimed, err := r.ClaimOperation(orderID, 0, model.InventoryOperationReserveOrder)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return h.replyOrderDuplicate(ctx, r, route, request)
+		}
+
+		items, err := h.reserveItems(r, request)
+		if err != nil {
+			return err
+		}
+
+		response := model.InventoryResponse{
+			OrderID:   orderID,
+			Operation: model.InventoryOperationReserveOrder,
+			Success:   true,
+			Items:     items,
+		}
+		for _, item := range items {
+			if !item.Success {
+				response.Success = false
+				response.Error = "not all items of the order could be reserved"
+				break
+			}
+		}
+
+		if err := r.CompleteOperation(orderID, 0, model.InventoryOperationReserveOrder, response.Success, response.Error); err != nil {
+			return err
+		}
+
+		h.l.InfoContext(ctx, "Sending reserve order response", "order_id", orderID, "success", response.Success)
+		return writeResponse(r, route, fmt.Sprintf("%d", orderID), response)
+	})
+}
+
+// reserveItems reserves every item of the order or none of them. The stock
+// rows are locked first so the availability checked is the one reserved
+// from. Every item is recorded as its own reserve operation, which lets
+// cancel and release requests treat it like a single item reservation.
+func (h *ReserveOrderHandler) reserveItems(r repository.RepositoryI, request model.ReserveOrderRequest) ([]model.InventoryItemResult, error) {
+	ids := make([]int, 0, len(request.Items))
+	for _, item := range request.Items {
+		ids = append(ids, item.ProductID)
+	}
+
+	stock, err := r.LockQuantityOfProducts(ids)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[int]int, len(stock))
+	for _, s := range stock {
+		available[s.ProductID] = s.Available
+	}
+
+	results := make([]model.InventoryItemResult, len(request.Items))
+	claimed := make([]bool, len(request.Items))
+	reserved := true
+	for i, item := range request.Items {
+		results[i].ProductID = item.ProductID
+
+		// An item cancelled before the order arrived is already claimed
+		claimed[i], err = r.ClaimOperation(request.OrderID, item.ProductID, model.InventoryOperationReserve)
+		if err != nil {
+			return nil, err
+		}
+
+		switch qty, ok := available[item.ProductID]; {
+		case !claimed[i]:
+			results[i].Error = "reservation already processed"
+		case !ok:
+			results[i].Error = "product not found"
+		case qty < item.Quantity:
+			results[i].Error = "not enough quantity available"
+			metrics.StockOuts.WithLabelValues(model.InventoryOperationReserveOrder).Inc()
+		default:
+			results[i].Success = true
+			continue
+		}
+		reserved = false
+	}
+
+	now := time.Now()
+	for i, item := range request.Items {
+		if !claimed[i] {
+			continue
+		}
+
+		if !reserved {
+			results[i].Success = false
+			if results[i].Error == "" {
+				results[i].Error = "not reserved, another item of the order is unavailable"
+			}
+			if err := r.CompleteOperation(request.OrderID, item.ProductID, model.InventoryOperationReserve, false, results[i].Error); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		ok, err := r.CreateReservation(model.Reservation{
+			OrderID:   request.OrderID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			Status:    model.ReservationStatusReserved,
+			ExpiresAt: expiresAt(now, h.reservationTTL),
+			CreatedAt: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// The rows are locked, so this only happens if the checks above
+			// went wrong; fail the whole transaction
+			return nil, fmt.Errorf("not enough quantity available for product %d", item.ProductID)
+		}
+		if err := r.CompleteOperation(request.OrderID, item.ProductID, model.InventoryOperationReserve, true, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// replyOrderDuplicate answers a redelivered order request with the outcome
+// recorded for the order and each of its items
+func (h *ReserveOrderHandler) replyOrderDuplicate(ctx context.Context, r repository.RepositoryI, route reqreply.Route, request model.ReserveOrderRequest) error {
+	op, err := r.GetOperation(request.OrderID, 0, model.InventoryOperationReserveOrder)
+	if err != nil {
+		return fmt.Errorf("failed to get processed operation: %w", err)
+	}
+
+	response := model.InventoryResponse{
+		OrderID:   request.OrderID,
+		Operation: model.InventoryOperationReserveOrder,
+		Success:   op.Success,
+		Error:     op.Error,
+	}
+	for _, item := range request.Items {
+		itemOp, err := r.GetOperation(request.OrderID, item.ProductID, model.InventoryOperationReserve)
+		if err != nil {
+			return fmt.Errorf("failed to get processed operation: %w", err)
+		}
+		response.Items = append(response.Items, model.InventoryItemResult{
+			ProductID: item.ProductID,
+			Success:   itemOp.Success,
+			Error:     itemOp.Error,
+		})
+	}
+
+	h.l.InfoContext(ctx, "Duplicate request, replying with recorded outcome", "order_id", request.OrderID, "operation", model.InventoryOperationReserveOrder, "success", op.Success)
+	return writeResponse(r, route, fmt.Sprintf("%d", request.OrderID), response)
+}
+
+// validateReserveOrderRequest checks that an order request names every
+// product once with a positive quantity
+func validateReserveOrderRequest(request model.ReserveOrderRequest) error {
+	if len(request.Items) == 0 {
+		return fmt.Errorf("invalid order: order has no items")
+	}
+
+	seen := make(map[int]bool, len(request.Items))
+	for _, item := range request.Items {
+		if item.ProductID == 0 {
+			return fmt.Errorf("invalid product ID: product ID cannot be 0")
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("invalid quantity: quantity must be positive for product %d", item.ProductID)
+		}
+		if seen[item.ProductID] {
+			return fmt.Errorf("invalid order: product %d appears more than once", item.ProductID)
+		}
+		seen[item.ProductID] = true
+	}
+	return nil
+}
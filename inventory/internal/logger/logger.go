@@ -3,12 +3,14 @@ package logger
 import (
 	"log/slog"
 	"os"
+
+	"inventory/internal/tracing"
 )
 
 func Init() *slog.Logger {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	logger := slog.New(tracing.NewLogHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: true,
-	}))
+	})))
 	// logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	return logger
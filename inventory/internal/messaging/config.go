@@ -0,0 +1,106 @@
+package messaging
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version matches a topic version
+var version = regexp.MustCompile(`^\d+$`)
+
+// ConfigFromEnv reads the broker configuration from the environment.
+// MESSAGING_BACKEND selects the backend, KAFKA_BROKERS, a comma separated
+// list, and MESSAGING_POSTGRES_URL locate it. KAFKA_TLS, KAFKA_TLS_CA_FILE,
+// KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE configure TLS,
+// KAFKA_SASL_MECHANISM, KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD SASL
+// authentication. Missing Kafka topics are created with
+// TOPIC_PARTITIONS, TOPIC_REPLICATION_FACTOR and TOPIC_RETENTION unless
+// TOPIC_PROVISIONING is false. TOPIC_VERSION moves the versioned topics to
+// another version, with TOPIC_PREVIOUS_VERSION set while migrating to it.
+// CONSUMER_STALL_TIMEOUT is how long a consumer may make no progress.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Backend:      os.Getenv("MESSAGING_BACKEND"),
+		KafkaBrokers: []string{"localhost:9092"},
+		KafkaSecurity: KafkaSecurity{
+			TLS:           os.Getenv("KAFKA_TLS") == "true",
+			CAFile:        os.Getenv("KAFKA_TLS_CA_FILE"),
+			CertFile:      os.Getenv("KAFKA_TLS_CERT_FILE"),
+			KeyFile:       os.Getenv("KAFKA_TLS_KEY_FILE"),
+			SASLMechanism: strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM")),
+			SASLUsername:  os.Getenv("KAFKA_SASL_USERNAME"),
+			SASLPassword:  os.Getenv("KAFKA_SASL_PASSWORD"),
+		},
+		PostgresURL: os.Getenv("MESSAGING_POSTGRES_URL"),
+		Topics: TopicSettings{
+			Provision:         os.Getenv("TOPIC_PROVISIONING") != "false",
+			Partitions:        1,
+			ReplicationFactor: 1,
+		},
+		Versions: Versions{
+			Current:  os.Getenv("TOPIC_VERSION"),
+			Previous: os.Getenv("TOPIC_PREVIOUS_VERSION"),
+		},
+		StallTimeout: 2 * time.Minute,
+	}
+	if brokers := os.Getenv("KAFKA_BROKERS"); brokers != "" {
+		cfg.KafkaBrokers = nil
+		for _, broker := range strings.Split(brokers, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.KafkaBrokers = append(cfg.KafkaBrokers, broker)
+			}
+		}
+	}
+
+	var err error
+	if cfg.Topics.Partitions, err = positiveFromEnv("TOPIC_PARTITIONS", cfg.Topics.Partitions); err != nil {
+		return Config{}, err
+	}
+	if cfg.Topics.ReplicationFactor, err = positiveFromEnv("TOPIC_REPLICATION_FACTOR", cfg.Topics.ReplicationFactor); err != nil {
+		return Config{}, err
+	}
+	if value := os.Getenv("TOPIC_RETENTION"); value != "" {
+		if cfg.Topics.Retention, err = time.ParseDuration(value); err != nil {
+			return Config{}, fmt.Errorf("invalid TOPIC_RETENTION: %w", err)
+		}
+	}
+
+	if value := os.Getenv("CONSUMER_STALL_TIMEOUT"); value != "" {
+		if cfg.StallTimeout, err = time.ParseDuration(value); err != nil || cfg.StallTimeout <= 0 {
+			return Config{}, fmt.Errorf("invalid CONSUMER_STALL_TIMEOUT: %q is not a positive duration", value)
+		}
+	}
+
+	if cfg.Versions.Current != "" && !version.MatchString(cfg.Versions.Current) {
+		return Config{}, fmt.Errorf("invalid TOPIC_VERSION: %q is not a version", cfg.Versions.Current)
+	}
+	if cfg.Versions.Previous != "" {
+		if cfg.Versions.Current == "" {
+			return Config{}, fmt.Errorf("TOPIC_PREVIOUS_VERSION requires TOPIC_VERSION")
+		}
+		if !version.MatchString(cfg.Versions.Previous) {
+			return Config{}, fmt.Errorf("invalid TOPIC_PREVIOUS_VERSION: %q is not a version", cfg.Versions.Previous)
+		}
+	}
+
+	return cfg, nil
+}
+
+// positiveFromEnv reads a positive integer from the environment and returns
+// def when the variable is unset
+func positiveFromEnv(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive integer", key, value)
+	}
+	return n, nil
+}
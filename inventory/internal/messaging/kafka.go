@@ -0,0 +1,263 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaBroker connects to a Kafka cluster
+type kafkaBroker struct {
+	brokers []string
+	topics  TopicSettings
+	// transport is shared by the writers and the admin client, dialer by the
+	// readers, both carry the TLS and SASL settings
+	transport *kafka.Transport
+	dialer    *kafka.Dialer
+}
+
+// NewKafka creates a broker for the Kafka cluster at brokers connecting with
+// security and creating topics with the given settings
+func NewKafka(brokers []string, security KafkaSecurity, topics TopicSettings) (Broker, error) {
+	tlsConfig, err := security.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := security.mechanism()
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaBroker{
+		brokers: brokers,
+		topics:  topics,
+		transport: &kafka.Transport{
+			TLS:  tlsConfig,
+			SASL: mechanism,
+		},
+		dialer: &kafka.Dialer{
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+	}, nil
+}
+
+// NewPublisher creates a synchronous publisher taking the topic from each
+// message. Messages are partitioned by key, so the messages of a key stay in
+// one partition and are consumed in the order they were published.
+func (b *kafkaBroker) NewPublisher() Publisher {
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(b.brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Publish waits for its batch to be written, the default
+			// of 1s would hold every synchronous publish that long
+			BatchTimeout: 10 * time.Millisecond,
+			Transport:    b.transport,
+		},
+	}
+}
+
+// NewSubscriber creates a consumer group reader
+func (b *kafkaBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	maxWait := cfg.MaxWait
+	if maxWait == 0 {
+		maxWait = time.Second
+	}
+	startOffset := kafka.FirstOffset
+	if cfg.Latest {
+		startOffset = kafka.LastOffset
+	}
+
+	return &kafkaSubscriber{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        b.brokers,
+			Dialer:         b.dialer,
+			GroupTopics:    cfg.Topics,
+			GroupID:        cfg.GroupID,
+			StartOffset:    startOffset,
+			MinBytes:       1,
+			MaxBytes:       10e6, // 10MB
+			MaxWait:        maxWait,
+			CommitInterval: cfg.CommitInterval,
+		}),
+	}
+}
+
+func (b *kafkaBroker) Close() error {
+	b.transport.CloseIdleConnections()
+	return nil
+}
+
+// EnsureTopics creates the missing topics with the partitions, replication
+// factor and retention of the broker's topic settings
+func (b *kafkaBroker) EnsureTopics(ctx context.Context, topics ...string) error {
+	if !b.topics.Provision || len(topics) == 0 {
+		return nil
+	}
+
+	var entries []kafka.ConfigEntry
+	if b.topics.Retention > 0 {
+		entries = append(entries, kafka.ConfigEntry{
+			ConfigName:  "retention.ms",
+			ConfigValue: strconv.FormatInt(b.topics.Retention.Milliseconds(), 10),
+		})
+	}
+
+	configs := make([]kafka.TopicConfig, 0, len(topics))
+	for _, topic := range topics {
+		configs = append(configs, kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     b.topics.Partitions,
+			ReplicationFactor: b.topics.ReplicationFactor,
+			ConfigEntries:     entries,
+		})
+	}
+
+	client := &kafka.Client{Addr: kafka.TCP(b.brokers...), Transport: b.transport}
+	resp, err := client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: configs})
+	if err != nil {
+		return fmt.Errorf("failed to create topics: %w", err)
+	}
+	for topic, err := range resp.Errors {
+		if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			return fmt.Errorf("failed to create topic %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// NewReader creates a reader of a partition positioned at cfg.Since or
+// cfg.Offset
+func (b *kafkaBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   b.brokers,
+		Dialer:    b.dialer,
+		Topic:     cfg.Topic,
+		Partition: cfg.Partition,
+		MinBytes:  1,
+		MaxBytes:  10e6, // 10MB
+		MaxWait:   500 * time.Millisecond,
+	})
+
+	var err error
+	if !cfg.Since.IsZero() {
+		err = reader.SetOffsetAt(ctx, cfg.Since)
+	} else {
+		err = reader.SetOffset(cfg.Offset)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to position reader: %w", err)
+	}
+
+	return &kafkaReader{reader: reader}, nil
+}
+
+// kafkaReader reads a partition without a consumer group
+type kafkaReader struct {
+	reader *kafka.Reader
+}
+
+func (r *kafkaReader) Read(ctx context.Context) (Message, error) {
+	msg, err := r.reader.ReadMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return fromKafka(msg), nil
+}
+
+func (r *kafkaReader) Close() error {
+	return r.reader.Close()
+}
+
+// kafkaPublisher writes to Kafka
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	out := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		out = append(out, toKafka(msg))
+	}
+	return p.writer.WriteMessages(ctx, out...)
+}
+
+func (p *kafkaPublisher) Close() error {
+	if err := p.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close kafka writer: %w", err)
+	}
+	return nil
+}
+
+// kafkaSubscriber reads from Kafka
+type kafkaSubscriber struct {
+	reader *kafka.Reader
+}
+
+func (s *kafkaSubscriber) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return fromKafka(msg), nil
+}
+
+func (s *kafkaSubscriber) Commit(ctx context.Context, msgs ...Message) error {
+	out := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		out = append(out, toKafka(msg))
+	}
+	return s.reader.CommitMessages(ctx, out...)
+}
+
+func (s *kafkaSubscriber) Close() error {
+	if err := s.reader.Close(); err != nil {
+		return fmt.Errorf("failed to close kafka reader: %w", err)
+	}
+	return nil
+}
+
+// toKafka converts a message to a kafka-go message
+func toKafka(msg Message) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers = append(headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return kafka.Message{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		HighWaterMark: msg.HighWaterMark,
+		Key:           msg.Key,
+		Value:         msg.Value,
+		Headers:       headers,
+		Time:          msg.Time,
+	}
+}
+
+// fromKafka converts a kafka-go message to a message
+func fromKafka(msg kafka.Message) Message {
+	headers := make([]Header, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers = append(headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return Message{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		HighWaterMark: msg.HighWaterMark,
+		Key:           msg.Key,
+		Value:         msg.Value,
+		Headers:       headers,
+		Time:          msg.Time,
+	}
+}
@@ -0,0 +1,89 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms supported for Kafka
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// KafkaSecurity secures the connections to Kafka. The zero value connects in
+// plaintext without authentication.
+type KafkaSecurity struct {
+	// TLS enables TLS, it is implied by CAFile and CertFile
+	TLS bool
+	// CAFile is a PEM file with the CAs the broker certificates are verified
+	// against, unset uses the system CAs
+	CAFile string
+	// CertFile and KeyFile are the PEM certificate and key presented to the
+	// brokers for client authentication
+	CertFile string
+	KeyFile  string
+	// SASLMechanism is one of the SASL constants, unset disables SASL
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+// tlsConfig returns the TLS configuration of the connections, nil when TLS is
+// disabled
+func (s KafkaSecurity) tlsConfig() (*tls.Config, error) {
+	if !s.TLS && s.CAFile == "" && s.CertFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if s.CAFile != "" {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", s.CAFile)
+		}
+	}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// mechanism returns the SASL mechanism of the connections, nil when SASL is
+// disabled
+func (s KafkaSecurity) mechanism() (sasl.Mechanism, error) {
+	if s.SASLMechanism != "" && (s.SASLUsername == "" || s.SASLPassword == "") {
+		return nil, fmt.Errorf("SASL mechanism %s requires a username and password", s.SASLMechanism)
+	}
+
+	switch s.SASLMechanism {
+	case "":
+		return nil, nil
+	case SASLPlain:
+		return plain.Mechanism{Username: s.SASLUsername, Password: s.SASLPassword}, nil
+	case SASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, s.SASLUsername, s.SASLPassword)
+	case SASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, s.SASLUsername, s.SASLPassword)
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %q", s.SASLMechanism)
+	}
+}
@@ -0,0 +1,306 @@
+package messaging
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a self-signed CA issuing certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue signs a certificate for name and returns its PEM certificate and key
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to a file in dir and returns its path
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// handshake runs a TLS handshake between a broker serving brokerCert and a
+// client using cfg, the broker requires a client certificate signed by ca
+func handshake(t *testing.T, ca *testCA, brokerCert tls.Certificate, cfg *tls.Config) error {
+	t.Helper()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{brokerCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	clientErr := tls.Client(conn, cfg).Handshake()
+	if err := <-serverErr; err != nil {
+		return err
+	}
+	return clientErr
+}
+
+func TestTLSConfigWithSelfSignedCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	brokerCertPEM, brokerKeyPEM := ca.issue(t, "kafka", x509.ExtKeyUsageServerAuth)
+	clientCertPEM, clientKeyPEM := ca.issue(t, "oms", x509.ExtKeyUsageClientAuth)
+
+	brokerCert, err := tls.X509KeyPair(brokerCertPEM, brokerKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	security := KafkaSecurity{
+		CAFile:   writeFile(t, dir, "ca.pem", ca.pem),
+		CertFile: writeFile(t, dir, "client.pem", clientCertPEM),
+		KeyFile:  writeFile(t, dir, "client-key.pem", clientKeyPEM),
+	}
+	cfg, err := security.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	if cfg == nil {
+		t.Fatal("tlsConfig returned nil, TLS has to be implied by the CA file")
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Fatalf("got %d client certificates, want 1", len(cfg.Certificates))
+	}
+
+	cfg.ServerName = "kafka"
+	if err := handshake(t, ca, brokerCert, cfg); err != nil {
+		t.Fatalf("handshake with broker signed by the CA: %v", err)
+	}
+
+	// A broker signed by another CA is refused
+	otherCertPEM, otherKeyPEM := newTestCA(t).issue(t, "kafka", x509.ExtKeyUsageServerAuth)
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = security.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerName = "kafka"
+	if err := handshake(t, ca, otherCert, cfg); err == nil {
+		t.Fatal("handshake with broker signed by an unknown CA succeeded")
+	}
+}
+
+func TestTLSConfigRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, _ := ca.issue(t, "oms", x509.ExtKeyUsageClientAuth)
+	_, otherKeyPEM := ca.issue(t, "inventory", x509.ExtKeyUsageClientAuth)
+
+	tests := map[string]KafkaSecurity{
+		"missing CA file": {CAFile: filepath.Join(dir, "missing.pem")},
+		"CA file without certificates": {
+			CAFile: writeFile(t, dir, "empty.pem", []byte("not a certificate")),
+		},
+		"certificate without key": {
+			CertFile: writeFile(t, dir, "cert.pem", certPEM),
+		},
+		"key of another certificate": {
+			CertFile: writeFile(t, dir, "cert2.pem", certPEM),
+			KeyFile:  writeFile(t, dir, "other-key.pem", otherKeyPEM),
+		},
+	}
+	for name, security := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := security.tlsConfig(); err == nil {
+				t.Fatal("tlsConfig accepted an invalid configuration")
+			}
+		})
+	}
+}
+
+func TestTLSConfigDisabled(t *testing.T) {
+	cfg, err := KafkaSecurity{}.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != nil {
+		t.Fatal("got a TLS configuration without TLS settings")
+	}
+
+	cfg, err = KafkaSecurity{TLS: true}.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil || cfg.RootCAs != nil {
+		t.Fatal("KAFKA_TLS alone has to verify brokers against the system CAs")
+	}
+}
+
+func TestSASLMechanism(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		want      string
+	}{
+		{mechanism: SASLPlain, want: "PLAIN"},
+		{mechanism: SASLScramSHA256, want: "SCRAM-SHA-256"},
+		{mechanism: SASLScramSHA512, want: "SCRAM-SHA-512"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mechanism, func(t *testing.T) {
+			m, err := KafkaSecurity{SASLMechanism: tt.mechanism, SASLUsername: "oms", SASLPassword: "secret"}.mechanism()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Name() != tt.want {
+				t.Fatalf("got mechanism %s, want %s", m.Name(), tt.want)
+			}
+		})
+	}
+
+	m, err := KafkaSecurity{}.mechanism()
+	if err != nil || m != nil {
+		t.Fatalf("got mechanism %v, %v without SASL settings", m, err)
+	}
+}
+
+func TestSASLMechanismRejectsBadConfig(t *testing.T) {
+	tests := map[string]KafkaSecurity{
+		"unknown mechanism": {SASLMechanism: "GSSAPI", SASLUsername: "oms", SASLPassword: "secret"},
+		"missing username":  {SASLMechanism: SASLScramSHA512, SASLPassword: "secret"},
+		"missing password":  {SASLMechanism: SASLPlain, SASLUsername: "oms"},
+	}
+	for name, security := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := security.mechanism(); err == nil {
+				t.Fatal("mechanism accepted an invalid configuration")
+			}
+			if _, err := NewKafka([]string{"localhost:9092"}, security, TopicSettings{}); err == nil {
+				t.Fatal("NewKafka accepted an invalid configuration")
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvReadsSecurity(t *testing.T) {
+	t.Setenv("KAFKA_BROKERS", "kafka-1:9093, kafka-2:9093")
+	t.Setenv("KAFKA_TLS", "true")
+	t.Setenv("KAFKA_SASL_MECHANISM", "scram-sha-512")
+	t.Setenv("KAFKA_SASL_USERNAME", "oms")
+	t.Setenv("KAFKA_SASL_PASSWORD", "secret")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.KafkaBrokers) != 2 || cfg.KafkaBrokers[1] != "kafka-2:9093" {
+		t.Fatalf("got brokers %q", cfg.KafkaBrokers)
+	}
+	if !cfg.KafkaSecurity.TLS {
+		t.Fatal("KAFKA_TLS was not read")
+	}
+	if cfg.KafkaSecurity.SASLMechanism != SASLScramSHA512 {
+		t.Fatalf("got SASL mechanism %q, want %s", cfg.KafkaSecurity.SASLMechanism, SASLScramSHA512)
+	}
+	if _, err := NewKafka(cfg.KafkaBrokers, cfg.KafkaSecurity, cfg.Topics); err != nil {
+		t.Fatalf("NewKafka: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memoryBroker keeps topics in memory. Every topic has a single partition and
+// consumer groups share their offsets, like Kafka consumer groups with one
+// partition per topic. Messages are kept until the process exits.
+type memoryBroker struct {
+	mu     sync.Mutex
+	topics map[string][]Message
+	// groups holds the offsets of every group by topic
+	groups map[string]map[string]*memoryOffsets
+	// published is closed and replaced whenever messages are published
+	published chan struct{}
+}
+
+// memoryOffsets is the position of a consumer group in a topic
+type memoryOffsets struct {
+	next      int64
+	committed int64
+}
+
+// NewMemory creates an in-process broker
+func NewMemory() Broker {
+	return &memoryBroker{
+		topics:    make(map[string][]Message),
+		groups:    make(map[string]map[string]*memoryOffsets),
+		published: make(chan struct{}),
+	}
+}
+
+func (b *memoryBroker) NewPublisher() Publisher {
+	return &memoryPublisher{b: b}
+}
+
+func (b *memoryBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	group, ok := b.groups[cfg.GroupID]
+	if !ok {
+		group = make(map[string]*memoryOffsets)
+		b.groups[cfg.GroupID] = group
+	}
+	for _, topic := range cfg.Topics {
+		if _, ok := group[topic]; ok {
+			continue
+		}
+		start := int64(0)
+		if cfg.Latest {
+			start = int64(len(b.topics[topic]))
+		}
+		group[topic] = &memoryOffsets{next: start, committed: start}
+	}
+
+	return &memorySubscriber{
+		b:      b,
+		topics: cfg.Topics,
+		group:  group,
+		closed: make(chan struct{}),
+	}
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+// memoryPublisher appends messages to the topics of a memory broker
+type memoryPublisher struct {
+	b *memoryBroker
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.Topic == "" {
+			return fmt.Errorf("message without topic")
+		}
+		msg.Partition = 0
+		msg.Offset = int64(len(p.b.topics[msg.Topic]))
+		msg.Time = now
+		p.b.topics[msg.Topic] = append(p.b.topics[msg.Topic], msg)
+	}
+
+	close(p.b.published)
+	p.b.published = make(chan struct{})
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+// memorySubscriber reads the topics of a memory broker
+type memorySubscriber struct {
+	b      *memoryBroker
+	topics []string
+	group  map[string]*memoryOffsets
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *memorySubscriber) Fetch(ctx context.Context) (Message, error) {
+	for {
+		s.b.mu.Lock()
+		for _, topic := range s.topics {
+			offsets := s.group[topic]
+			if msgs := s.b.topics[topic]; offsets.next < int64(len(msgs)) {
+				msg := msgs[offsets.next]
+				msg.HighWaterMark = int64(len(msgs))
+				offsets.next++
+				s.b.mu.Unlock()
+				return msg, nil
+			}
+		}
+		published := s.b.published
+		s.b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-s.closed:
+			return Message{}, ErrClosed
+		case <-published:
+		}
+	}
+}
+
+func (s *memorySubscriber) Commit(ctx context.Context, msgs ...Message) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	for _, msg := range msgs {
+		offsets, ok := s.group[msg.Topic]
+		if !ok {
+			return fmt.Errorf("topic %s is not subscribed", msg.Topic)
+		}
+		if msg.Offset+1 > offsets.committed {
+			offsets.committed = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
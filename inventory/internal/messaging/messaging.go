@@ -0,0 +1,210 @@
+// Package messaging decouples the service from its message broker. Messages
+// are written through a Publisher and read through a Subscriber, both created
+// by a Broker. Kafka is the production broker, a Postgres queue replaces it in
+// small deployments and an in-process broker runs the service without one,
+// for local development and tests.
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrClosed is returned when fetching from a closed subscriber
+var ErrClosed = errors.New("messaging: subscriber closed")
+
+// Backends accepted by New
+const (
+	BackendKafka    = "kafka"
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// Header is a message header
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is a message read from or written to a topic. Partition, Offset and
+// HighWaterMark are set by the broker on messages read from a topic.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	// HighWaterMark is the offset the next message published to the
+	// partition gets, zero when the broker does not report it
+	HighWaterMark int64
+	Key           []byte
+	Value         []byte
+	Headers       []Header
+	Time          time.Time
+}
+
+// Header returns the value of a header, or "" if it is not set
+func (m Message) Header(key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Publisher writes messages to the topics they name
+type Publisher interface {
+	// Publish returns once the broker acknowledged every message
+	Publish(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// Subscriber reads the messages of its topics as a member of a consumer group
+type Subscriber interface {
+	// Fetch returns the next message, it blocks until one is available
+	Fetch(ctx context.Context) (Message, error)
+	// Commit marks the given messages, and every earlier message of their
+	// partitions, as processed by the group
+	Commit(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// SubscriberConfig configures a subscriber
+type SubscriberConfig struct {
+	Topics  []string
+	GroupID string
+	// CommitInterval batches commits in the background, zero commits
+	// synchronously
+	CommitInterval time.Duration
+	// MaxWait is the longest a fetch waits for the broker to fill a batch
+	MaxWait time.Duration
+	// ProcessingDelay is how long messages are held on purpose before they
+	// are processed, it is added to the stall timeout of the monitor
+	ProcessingDelay time.Duration
+	// Latest starts a new group at the end of its topics instead of the
+	// beginning
+	Latest bool
+}
+
+// ReaderConfig selects where a reader starts in a partition
+type ReaderConfig struct {
+	Topic     string
+	Partition int
+	// Offset is the first offset read unless Since is set
+	Offset int64
+	// Since starts at the first message published at or after it
+	Since time.Time
+}
+
+// Reader reads a partition from a position without a consumer group,
+// nothing is committed. Read blocks until a message is published when the
+// end of the partition is reached.
+type Reader interface {
+	Read(ctx context.Context) (Message, error)
+	Close() error
+}
+
+// Seeker is implemented by brokers that keep messages after they are
+// consumed and can read them again from a position
+type Seeker interface {
+	NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error)
+}
+
+// NewReader creates a reader on brokers that support it
+func NewReader(ctx context.Context, broker Broker, cfg ReaderConfig) (Reader, error) {
+	s, ok := broker.(Seeker)
+	if !ok {
+		return nil, fmt.Errorf("broker cannot read topics from a position")
+	}
+	return s.NewReader(ctx, cfg)
+}
+
+// Broker creates publishers and subscribers
+type Broker interface {
+	NewPublisher() Publisher
+	NewSubscriber(cfg SubscriberConfig) Subscriber
+	// Close releases the connections of the broker, its publishers and
+	// subscribers have to be closed before
+	Close() error
+}
+
+// Config selects and configures a broker
+type Config struct {
+	// Backend is one of the Backend constants, empty selects Kafka
+	Backend string
+	// KafkaBrokers are the addresses of the Kafka brokers
+	KafkaBrokers []string
+	// KafkaSecurity secures the connections to the Kafka brokers
+	KafkaSecurity KafkaSecurity
+	// PostgresURL is the connection string of the queue database
+	PostgresURL string
+	// Topics configures the topics created by brokers that need them
+	Topics TopicSettings
+	// Versions selects the version of the versioned topics
+	Versions Versions
+	// StallTimeout is how long a consumer may make no progress before its
+	// monitor reports it stalled
+	StallTimeout time.Duration
+}
+
+// New creates the broker selected by cfg
+func New(cfg Config) (Broker, error) {
+	var broker Broker
+	system := cfg.Backend
+	switch cfg.Backend {
+	case "", BackendKafka:
+		system = BackendKafka
+		var err error
+		if broker, err = NewKafka(cfg.KafkaBrokers, cfg.KafkaSecurity, cfg.Topics); err != nil {
+			return nil, fmt.Errorf("failed to configure kafka: %w", err)
+		}
+	case BackendPostgres:
+		db, err := sql.Open("postgres", cfg.PostgresURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open queue database: %w", err)
+		}
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to connect to queue database: %w", err)
+		}
+		broker = NewPostgres(db)
+	case BackendMemory:
+		broker = NewMemory()
+	default:
+		return nil, fmt.Errorf("unknown messaging backend %q", cfg.Backend)
+	}
+
+	// Versions are resolved below tracing so every copy of a message
+	// carries the trace context
+	return WithMetrics(WithTracing(WithVersions(broker, cfg.Versions), system)), nil
+}
+
+// TopicSettings are applied to the topics a broker creates
+type TopicSettings struct {
+	// Provision enables creating missing topics
+	Provision         bool
+	Partitions        int
+	ReplicationFactor int
+	// Retention is how long messages are kept, zero keeps the broker default
+	Retention time.Duration
+}
+
+// Provisioner is implemented by brokers whose topics have to be created
+// before they are used
+type Provisioner interface {
+	// EnsureTopics creates the topics that do not exist yet, existing
+	// topics are left unchanged
+	EnsureTopics(ctx context.Context, topics ...string) error
+}
+
+// EnsureTopics creates the missing topics on brokers that need them, other
+// brokers create topics when they are first used
+func EnsureTopics(ctx context.Context, broker Broker, topics ...string) error {
+	p, ok := broker.(Provisioner)
+	if !ok {
+		return nil
+	}
+	return p.EnsureTopics(ctx, topics...)
+}
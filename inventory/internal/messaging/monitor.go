@@ -0,0 +1,357 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of seconds the processing rate is averaged over
+const rateWindow = 60
+
+// ConsumerStats is the progress of a consumer group in this process
+type ConsumerStats struct {
+	GroupID    string           `json:"group_id"`
+	Partitions []PartitionStats `json:"partitions"`
+	// Lag is the number of messages of the group not processed yet, summed
+	// over its partitions
+	Lag       int64 `json:"lag"`
+	Processed int64 `json:"processed"`
+	// Rate is the number of messages processed per second over the last minute
+	Rate            float64    `json:"rate"`
+	LastProcessedAt *time.Time `json:"last_processed_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time `json:"last_error_at,omitempty"`
+	Stalled         bool       `json:"stalled"`
+	StalledReasons  []string   `json:"stalled_reasons,omitempty"`
+}
+
+// PartitionStats is the progress of a consumer group on a partition
+type PartitionStats struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	// LastFetchedOffset and LastProcessedOffset are -1 until a message
+	// was fetched and processed
+	LastFetchedOffset   int64 `json:"last_fetched_offset"`
+	LastProcessedOffset int64 `json:"last_processed_offset"`
+	// HighWaterMark and Lag are zero for brokers that do not report the
+	// high water mark
+	HighWaterMark int64 `json:"high_water_mark"`
+	Lag           int64 `json:"lag"`
+	// Pending is the number of fetched messages not processed yet
+	Pending int `json:"pending"`
+}
+
+// Monitor tracks the progress of the subscribers of a broker. Messages
+// count as processed once they are committed. A consumer group is stalled
+// when a fetched message stays unprocessed, messages are left to fetch or
+// fetching keeps failing for longer than the stall timeout.
+type Monitor struct {
+	stallTimeout time.Duration
+
+	mu     sync.Mutex
+	groups map[string]*groupProgress
+}
+
+// groupProgress is what the monitor knows about a consumer group
+type groupProgress struct {
+	partitions      map[partitionKey]*partitionProgress
+	processed       int64
+	rate            rateCounter
+	lastProcessedAt time.Time
+	lastError       error
+	lastErrorAt     time.Time
+	// failingSince is when fetching started failing, zero while it succeeds
+	failingSince time.Time
+	// stallTimeout is the stall timeout of the monitor plus the longest
+	// processing delay of the group's subscribers
+	stallTimeout time.Duration
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// partitionProgress is what the monitor knows about a partition of a group
+type partitionProgress struct {
+	lastFetched   int64
+	lastProcessed int64
+	lastFetchedAt time.Time
+	highWaterMark int64
+	// pending holds the fetch times of the fetched messages not processed
+	// yet by offset, in fetch order
+	pending []pendingMessage
+}
+
+type pendingMessage struct {
+	offset    int64
+	fetchedAt time.Time
+}
+
+// NewMonitor creates a monitor considering a consumer stalled after
+// stallTimeout without progress
+func NewMonitor(stallTimeout time.Duration) *Monitor {
+	return &Monitor{
+		stallTimeout: stallTimeout,
+		groups:       make(map[string]*groupProgress),
+	}
+}
+
+// WithMonitor wraps broker so the monitor tracks its subscribers
+func WithMonitor(broker Broker, m *Monitor) Broker {
+	return &monitoredBroker{Broker: broker, m: m}
+}
+
+// group returns the progress of a group, m.mu must be held
+func (m *Monitor) group(groupID string) *groupProgress {
+	g, ok := m.groups[groupID]
+	if !ok {
+		g = &groupProgress{
+			partitions:   make(map[partitionKey]*partitionProgress),
+			stallTimeout: m.stallTimeout,
+		}
+		m.groups[groupID] = g
+	}
+	return g
+}
+
+// subscribed registers a subscriber of a group
+func (m *Monitor) subscribed(cfg SubscriberConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g := m.group(cfg.GroupID)
+	if timeout := m.stallTimeout + cfg.ProcessingDelay; timeout > g.stallTimeout {
+		g.stallTimeout = timeout
+	}
+}
+
+// fetched records a fetched message, or the error fetching failed with
+func (m *Monitor) fetched(groupID string, msg Message, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	g := m.group(groupID)
+	if err != nil {
+		g.lastError = err
+		g.lastErrorAt = now
+		if g.failingSince.IsZero() {
+			g.failingSince = now
+		}
+		return
+	}
+	g.failingSince = time.Time{}
+
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := g.partitions[key]
+	if !ok {
+		p = &partitionProgress{lastFetched: -1, lastProcessed: -1}
+		g.partitions[key] = p
+	}
+	p.lastFetched = msg.Offset
+	p.lastFetchedAt = now
+	if msg.HighWaterMark > p.highWaterMark {
+		p.highWaterMark = msg.HighWaterMark
+	}
+	p.pending = append(p.pending, pendingMessage{offset: msg.Offset, fetchedAt: now})
+}
+
+// committed records committed messages, committing a message processes the
+// earlier messages of its partition too
+func (m *Monitor) committed(groupID string, msgs []Message, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	g := m.group(groupID)
+	if err != nil {
+		g.lastError = err
+		g.lastErrorAt = now
+		return
+	}
+
+	for _, msg := range msgs {
+		p, ok := g.partitions[partitionKey{topic: msg.Topic, partition: msg.Partition}]
+		if !ok {
+			continue
+		}
+		if msg.Offset > p.lastProcessed {
+			p.lastProcessed = msg.Offset
+		}
+
+		remaining := p.pending[:0]
+		for _, pending := range p.pending {
+			if pending.offset <= msg.Offset {
+				g.processed++
+				g.rate.add(now, 1)
+			} else {
+				remaining = append(remaining, pending)
+			}
+		}
+		p.pending = remaining
+		g.lastProcessedAt = now
+	}
+}
+
+// rateCounter counts events per second over the rate window
+type rateCounter struct {
+	seconds [rateWindow]int64
+	counts  [rateWindow]int64
+}
+
+// add counts n events at now
+func (c *rateCounter) add(now time.Time, n int64) {
+	second := now.Unix()
+	i := second % rateWindow
+	if c.seconds[i] != second {
+		c.seconds[i] = second
+		c.counts[i] = 0
+	}
+	c.counts[i] += n
+}
+
+// perSecond returns the events per second over the rate window before now
+func (c *rateCounter) perSecond(now time.Time) float64 {
+	second := now.Unix()
+	var total int64
+	for i := range c.counts {
+		if second-c.seconds[i] < rateWindow {
+			total += c.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// Stats returns the progress of every consumer group, sorted by group ID
+func (m *Monitor) Stats() []ConsumerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]ConsumerStats, 0, len(m.groups))
+	for groupID, g := range m.groups {
+		s := ConsumerStats{
+			GroupID:   groupID,
+			Processed: g.processed,
+			Rate:      g.rate.perSecond(now),
+		}
+		if !g.lastProcessedAt.IsZero() {
+			at := g.lastProcessedAt
+			s.LastProcessedAt = &at
+		}
+		if g.lastError != nil {
+			at := g.lastErrorAt
+			s.LastError = g.lastError.Error()
+			s.LastErrorAt = &at
+		}
+		if !g.failingSince.IsZero() && now.Sub(g.failingSince) > g.stallTimeout {
+			s.StalledReasons = append(s.StalledReasons, fmt.Sprintf("fetching fails since %s", g.failingSince.Format(time.RFC3339)))
+		}
+
+		for key, p := range g.partitions {
+			ps := PartitionStats{
+				Topic:               key.topic,
+				Partition:           key.partition,
+				LastFetchedOffset:   p.lastFetched,
+				LastProcessedOffset: p.lastProcessed,
+				HighWaterMark:       p.highWaterMark,
+				Pending:             len(p.pending),
+			}
+			if p.highWaterMark > 0 {
+				next := p.lastProcessed + 1
+				if len(p.pending) > 0 {
+					next = p.pending[0].offset
+				}
+				ps.Lag = max(p.highWaterMark-next, 0)
+			}
+			s.Partitions = append(s.Partitions, ps)
+			s.Lag += ps.Lag
+
+			switch {
+			case len(p.pending) > 0 && now.Sub(p.pending[0].fetchedAt) > g.stallTimeout:
+				s.StalledReasons = append(s.StalledReasons, fmt.Sprintf("%s/%d: offset %d unprocessed since %s", key.topic, key.partition, p.pending[0].offset, p.pending[0].fetchedAt.Format(time.RFC3339)))
+			case len(p.pending) == 0 && ps.Lag > 0 && now.Sub(p.lastFetchedAt) > g.stallTimeout:
+				s.StalledReasons = append(s.StalledReasons, fmt.Sprintf("%s/%d: %d messages left, nothing fetched since %s", key.topic, key.partition, ps.Lag, p.lastFetchedAt.Format(time.RFC3339)))
+			}
+		}
+		sort.Slice(s.Partitions, func(i, j int) bool {
+			a, b := s.Partitions[i], s.Partitions[j]
+			return a.Topic < b.Topic || a.Topic == b.Topic && a.Partition < b.Partition
+		})
+		s.Stalled = len(s.StalledReasons) > 0
+
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].GroupID < stats[j].GroupID })
+	return stats
+}
+
+// Healthy returns an error naming the stalled consumer groups, if any
+func (m *Monitor) Healthy() error {
+	var stalled []string
+	for _, s := range m.Stats() {
+		if s.Stalled {
+			stalled = append(stalled, fmt.Sprintf("%s (%s)", s.GroupID, strings.Join(s.StalledReasons, "; ")))
+		}
+	}
+	if len(stalled) > 0 {
+		return fmt.Errorf("stalled consumers: %s", strings.Join(stalled, ", "))
+	}
+	return nil
+}
+
+// monitoredBroker reports the progress of its subscribers to a monitor
+type monitoredBroker struct {
+	Broker
+	m *Monitor
+}
+
+func (b *monitoredBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	b.m.subscribed(cfg)
+	return &monitoredSubscriber{
+		Subscriber: b.Broker.NewSubscriber(cfg),
+		m:          b.m,
+		groupID:    cfg.GroupID,
+	}
+}
+
+// EnsureTopics creates the missing topics on the wrapped broker
+func (b *monitoredBroker) EnsureTopics(ctx context.Context, topics ...string) error {
+	return EnsureTopics(ctx, b.Broker, topics...)
+}
+
+// NewReader creates a reader on the wrapped broker, readers are not monitored
+func (b *monitoredBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	return NewReader(ctx, b.Broker, cfg)
+}
+
+// monitoredSubscriber reports its fetches and commits to a monitor
+type monitoredSubscriber struct {
+	Subscriber
+	m       *Monitor
+	groupID string
+}
+
+func (s *monitoredSubscriber) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.Subscriber.Fetch(ctx)
+	// A canceled fetch or a closed subscriber is a shutdown, not a failure
+	if err != nil && (ctx.Err() != nil || errors.Is(err, ErrClosed) || errors.Is(err, io.EOF)) {
+		return msg, err
+	}
+	s.m.fetched(s.groupID, msg, err)
+	return msg, err
+}
+
+func (s *monitoredSubscriber) Commit(ctx context.Context, msgs ...Message) error {
+	err := s.Subscriber.Commit(ctx, msgs...)
+	s.m.committed(s.groupID, msgs, err)
+	return err
+}
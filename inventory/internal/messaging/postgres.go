@@ -0,0 +1,393 @@
+package messaging
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Messages are claimed for postgresLease, a consumer that crashes while
+// processing a message gives it up to the other consumers of its group once
+// the lease runs out
+const postgresLease = 30 * time.Second
+
+// Published messages are kept for postgresRetention after every group
+// processed them, so groups subscribing later can still read them
+const postgresRetention = 7 * 24 * time.Hour
+
+// postgresPollInterval is how often an idle subscriber looks for new messages
+const postgresPollInterval = 200 * time.Millisecond
+
+// postgresBroker stores messages in Postgres, for deployments without Kafka.
+// Published messages are appended to message_log and queued in message_queue
+// once for every consumer group subscribed to their topic. Consumers claim
+// queued messages with FOR UPDATE SKIP LOCKED and delete them when they
+// commit. A message is only claimed once no earlier message with the same key
+// is left in the queue of its group, which keeps the order per key across
+// consumers. The tables are created by queue-init-scripts/init.sql.
+type postgresBroker struct {
+	db *sql.DB
+}
+
+// NewPostgres creates a broker storing messages in db
+func NewPostgres(db *sql.DB) Broker {
+	return &postgresBroker{db: db}
+}
+
+func (b *postgresBroker) NewPublisher() Publisher {
+	return &postgresPublisher{db: b.db}
+}
+
+func (b *postgresBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	pollInterval := postgresPollInterval
+	if cfg.MaxWait > 0 && cfg.MaxWait < pollInterval {
+		pollInterval = cfg.MaxWait
+	}
+
+	return &postgresSubscriber{
+		db:           b.db,
+		cfg:          cfg,
+		pollInterval: pollInterval,
+		fetched:      make(map[string][]int64),
+		closed:       make(chan struct{}),
+	}
+}
+
+func (b *postgresBroker) Close() error {
+	if err := b.db.Close(); err != nil {
+		return fmt.Errorf("failed to close queue database: %w", err)
+	}
+	return nil
+}
+
+// NewReader creates a reader of the messages of a topic still kept in
+// message_log. Topics have a single partition whose offsets are the message
+// IDs, HighWaterMark is one past the last message of the topic.
+func (b *postgresBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	return &postgresReader{db: b.db, cfg: cfg, next: cfg.Offset}, nil
+}
+
+// postgresReader reads message_log in ID order
+type postgresReader struct {
+	db   *sql.DB
+	cfg  ReaderConfig
+	next int64
+}
+
+func (r *postgresReader) Read(ctx context.Context) (Message, error) {
+	for {
+		var msg Message
+		var headers []byte
+		err := r.db.QueryRowContext(ctx,
+			`SELECT id, topic, key, value, headers, created_at,
+				(SELECT max(id) + 1 FROM message_log WHERE topic = $1)
+			FROM message_log
+			WHERE topic = $1 AND id >= $2 AND created_at >= $3
+			ORDER BY id
+			LIMIT 1`,
+			r.cfg.Topic, r.next, r.cfg.Since,
+		).Scan(&msg.Offset, &msg.Topic, &msg.Key, &msg.Value, &headers, &msg.Time, &msg.HighWaterMark)
+		if err == nil {
+			r.next = msg.Offset + 1
+			return msg, decodeHeaders(&msg, headers)
+		}
+		if err != sql.ErrNoRows {
+			return Message{}, fmt.Errorf("failed to read message: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-time.After(postgresPollInterval):
+		}
+	}
+}
+
+func (r *postgresReader) Close() error {
+	return nil
+}
+
+// decodeHeaders sets the headers of msg from their stored form
+func decodeHeaders(msg *Message, headers []byte) error {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	var stored []postgresHeader
+	if err := json.Unmarshal(headers, &stored); err != nil {
+		return fmt.Errorf("failed to unmarshal headers of message %d: %w", msg.Offset, err)
+	}
+	for _, h := range stored {
+		msg.Headers = append(msg.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return nil
+}
+
+// postgresHeader is a header as stored in message_log
+type postgresHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// lockTopic serializes publishers and new subscriptions of a topic until the
+// transaction ends, so a group subscribing while a message is published gets
+// it either from its backfill or from the publisher
+func lockTopic(ctx context.Context, tx *sql.Tx, topic string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('messaging:' || $1))", topic)
+	return err
+}
+
+// postgresPublisher appends messages to message_log and queues them
+type postgresPublisher struct {
+	db *sql.DB
+}
+
+func (p *postgresPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.Topic == "" {
+			return fmt.Errorf("message without topic")
+		}
+
+		headers := make([]postgresHeader, 0, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers = append(headers, postgresHeader{Key: h.Key, Value: h.Value})
+		}
+		encoded, err := json.Marshal(headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal headers: %w", err)
+		}
+
+		if err := lockTopic(ctx, tx, msg.Topic); err != nil {
+			return fmt.Errorf("failed to lock topic %s: %w", msg.Topic, err)
+		}
+
+		var id int64
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO message_log (topic, key, value, headers, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			msg.Topic, msg.Key, msg.Value, encoded, now,
+		).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to insert message: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO message_queue (group_id, message_id, topic, key)
+			SELECT group_id, $1, topic, $3 FROM message_subscriptions WHERE topic = $2`,
+			id, msg.Topic, msg.Key,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to queue message: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit messages: %w", err)
+	}
+	return nil
+}
+
+func (p *postgresPublisher) Close() error {
+	return nil
+}
+
+// postgresSubscriber claims the queued messages of its group
+type postgresSubscriber struct {
+	db           *sql.DB
+	cfg          SubscriberConfig
+	pollInterval time.Duration
+
+	mu         sync.Mutex
+	subscribed bool
+	// fetched holds the IDs of the messages claimed and not committed yet
+	// by topic
+	fetched   map[string][]int64
+	lastPrune time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// subscribe registers the group for its topics. A group subscribing to a
+// topic for the first time gets the messages already kept in the log queued,
+// unless it starts at the latest message.
+func (s *postgresSubscriber) subscribe(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, topic := range s.cfg.Topics {
+		if err := lockTopic(ctx, tx, topic); err != nil {
+			return fmt.Errorf("failed to lock topic %s: %w", topic, err)
+		}
+
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO message_subscriptions (group_id, topic) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			s.cfg.GroupID, topic,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 || s.cfg.Latest {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO message_queue (group_id, message_id, topic, key)
+			SELECT $1, id, topic, key FROM message_log WHERE topic = $2
+			ON CONFLICT DO NOTHING`,
+			s.cfg.GroupID, topic,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to queue earlier messages of %s: %w", topic, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresSubscriber) Fetch(ctx context.Context) (Message, error) {
+	for {
+		select {
+		case <-s.closed:
+			return Message{}, ErrClosed
+		default:
+		}
+
+		msg, ok, err := s.claim(ctx)
+		if err != nil || ok {
+			return msg, err
+		}
+
+		s.prune(ctx)
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-s.closed:
+			return Message{}, ErrClosed
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// claim leases the oldest queued message of the group that is not claimed
+// and has no earlier message with the same key left in the queue. Its
+// HighWaterMark is one past the last message of its topic, so the monitor can
+// report the lag of the group.
+func (s *postgresSubscriber) claim(ctx context.Context) (Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.subscribed {
+		if err := s.subscribe(ctx); err != nil {
+			return Message{}, false, err
+		}
+		s.subscribed = true
+	}
+
+	var msg Message
+	var headers []byte
+	err := s.db.QueryRowContext(ctx,
+		`UPDATE message_queue q SET locked_until = $3
+		FROM message_log m
+		WHERE m.id = q.message_id AND (q.group_id, q.message_id) = (
+			SELECT c.group_id, c.message_id FROM message_queue c
+			WHERE c.group_id = $1 AND c.topic = ANY($2)
+				AND (c.locked_until IS NULL OR c.locked_until < now())
+				AND NOT EXISTS (
+					SELECT 1 FROM message_queue e
+					WHERE e.group_id = c.group_id AND e.topic = c.topic
+						AND e.key = c.key AND e.message_id < c.message_id
+				)
+			ORDER BY c.message_id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING m.id, m.topic, m.key, m.value, m.headers, m.created_at,
+			(SELECT max(l.id) + 1 FROM message_log l WHERE l.topic = m.topic)`,
+		s.cfg.GroupID, pq.Array(s.cfg.Topics), time.Now().Add(postgresLease),
+	).Scan(&msg.Offset, &msg.Topic, &msg.Key, &msg.Value, &headers, &msg.Time, &msg.HighWaterMark)
+	if err == sql.ErrNoRows {
+		return Message{}, false, nil
+	}
+	if err != nil {
+		return Message{}, false, fmt.Errorf("failed to claim message: %w", err)
+	}
+
+	if err := decodeHeaders(&msg, headers); err != nil {
+		return Message{}, false, err
+	}
+
+	s.fetched[msg.Topic] = append(s.fetched[msg.Topic], msg.Offset)
+	return msg, true, nil
+}
+
+// Commit deletes the given messages, and the earlier messages of their topics
+// claimed by this subscriber, from the queue of the group
+func (s *postgresSubscriber) Commit(ctx context.Context, msgs ...Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []int64
+	for _, msg := range msgs {
+		remaining := s.fetched[msg.Topic][:0]
+		for _, id := range s.fetched[msg.Topic] {
+			if id <= msg.Offset {
+				ids = append(ids, id)
+			} else {
+				remaining = append(remaining, id)
+			}
+		}
+		s.fetched[msg.Topic] = remaining
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM message_queue WHERE group_id = $1 AND message_id = ANY($2)",
+		s.cfg.GroupID, pq.Array(ids),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to commit messages: %w", err)
+	}
+	return nil
+}
+
+// prune deletes messages past their retention that no group has queued any
+// more, at most once a minute
+func (s *postgresSubscriber) prune(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = time.Now()
+
+	// Pruning is best effort and tried again a minute later
+	_, _ = s.db.ExecContext(ctx,
+		`DELETE FROM message_log m WHERE m.created_at < $1
+		AND NOT EXISTS (SELECT 1 FROM message_queue q WHERE q.message_id = m.id)`,
+		time.Now().Add(-postgresRetention),
+	)
+}
+
+func (s *postgresSubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
@@ -0,0 +1,132 @@
+package messaging
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("messaging")
+
+// headerCarrier carries the trace context in the headers of a message
+type headerCarrier struct {
+	msg *Message
+}
+
+func (c headerCarrier) Get(key string) string {
+	return c.msg.Header(key)
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	for i, h := range c.msg.Headers {
+		if h.Key == key {
+			c.msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	c.msg.Headers = append(c.msg.Headers, Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Headers))
+	for _, h := range c.msg.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// StartProcessing starts the span processing msg as a child of the span that
+// published it. The span has to be ended once msg is processed.
+func StartProcessing(ctx context.Context, groupID string, msg Message) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier{msg: &msg})
+	return tracer.Start(ctx, "process "+msg.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingDestinationName(msg.Topic),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(msg.Partition)),
+			semconv.MessagingKafkaOffset(int(msg.Offset)),
+			semconv.MessagingConsumerGroupName(groupID),
+		),
+	)
+}
+
+// tracedBroker records a span for every message published and adds its
+// trace context to the message headers
+type tracedBroker struct {
+	Broker
+	system string
+}
+
+// WithTracing wraps broker so the messages it publishes carry the trace
+// context, system names the backend on the spans
+func WithTracing(broker Broker, system string) Broker {
+	return &tracedBroker{Broker: broker, system: system}
+}
+
+func (b *tracedBroker) NewPublisher() Publisher {
+	return &tracedPublisher{
+		Publisher: b.Broker.NewPublisher(),
+		system:    b.system,
+	}
+}
+
+// EnsureTopics creates the missing topics on the wrapped broker
+func (b *tracedBroker) EnsureTopics(ctx context.Context, topics ...string) error {
+	return EnsureTopics(ctx, b.Broker, topics...)
+}
+
+// NewReader creates a reader on the wrapped broker
+func (b *tracedBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	return NewReader(ctx, b.Broker, cfg)
+}
+
+// tracedPublisher publishes every message in a span of its own
+type tracedPublisher struct {
+	Publisher
+	system string
+}
+
+// Publish publishes msgs with the trace context of their span. A message is
+// published in the trace of ctx, or in the trace found in its headers when
+// ctx has none, as for messages written to an outbox in a traced request and
+// published later by a relay.
+func (p *tracedPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	propagator := otel.GetTextMapPropagator()
+	spans := make([]trace.Span, len(msgs))
+	out := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Headers = append([]Header(nil), msg.Headers...)
+		parent := ctx
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			parent = propagator.Extract(ctx, headerCarrier{msg: &msg})
+		}
+
+		spanCtx, span := tracer.Start(parent, "send "+msg.Topic,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String(p.system),
+				semconv.MessagingOperationTypeSend,
+				semconv.MessagingDestinationName(msg.Topic),
+				semconv.MessagingKafkaMessageKey(string(msg.Key)),
+			),
+		)
+		propagator.Inject(spanCtx, headerCarrier{msg: &msg})
+		spans[i] = span
+		out[i] = msg
+	}
+
+	err := p.Publisher.Publish(ctx, out...)
+	for _, span := range spans {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+	return err
+}
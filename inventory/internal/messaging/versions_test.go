@@ -0,0 +1,109 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lastProcessed returns the last processed offset of a topic of the only
+// group of a monitor
+func lastProcessed(t *testing.T, m *Monitor, topic string) int64 {
+	t.Helper()
+
+	for _, p := range m.Stats()[0].Partitions {
+		if p.Topic == topic {
+			return p.LastProcessedOffset
+		}
+	}
+	return -1
+}
+
+// fetchNothing fails the test unless nothing but copies is left to fetch
+func fetchNothing(t *testing.T, subscriber Subscriber) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if msg, err := subscriber.Fetch(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got message %+v, %v, want nothing to fetch", msg, err)
+	}
+}
+
+func TestSkippedCopiesAreCommitted(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemory()
+	m := NewMonitor(time.Minute)
+	broker := WithVersions(WithMonitor(memory, m), Versions{Current: "1", Previous: "0"})
+
+	subscriber := broker.NewSubscriber(SubscriberConfig{Topics: []string{"requests.0"}, GroupID: "group"})
+	defer subscriber.Close()
+
+	// A message of a migrated producer goes to both versions
+	if err := broker.NewPublisher().Publish(ctx, Message{Topic: "requests.0", Key: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := subscriber.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "requests.1" {
+		t.Fatalf("got message of %s, want requests.1", msg.Topic)
+	}
+	if err := subscriber.Commit(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its copy is skipped and committed although nothing follows it
+	fetchNothing(t, subscriber)
+	if offset := lastProcessed(t, m, "requests.0"); offset != 0 {
+		t.Fatalf("got last processed offset %d of requests.0, want the copy at 0", offset)
+	}
+}
+
+func TestSkippedCopiesWaitForEarlierMessages(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemory()
+	m := NewMonitor(time.Minute)
+	broker := WithVersions(WithMonitor(memory, m), Versions{Current: "1", Previous: "0"})
+
+	subscriber := broker.NewSubscriber(SubscriberConfig{Topics: []string{"requests.0"}, GroupID: "group"})
+	defer subscriber.Close()
+
+	// A producer that is not migrated yet publishes to the previous version
+	// only, a migrated one to both
+	if err := memory.NewPublisher().Publish(ctx, Message{Topic: "requests.0", Key: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.NewPublisher().Publish(ctx, Message{Topic: "requests.0", Key: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var unmigrated Message
+	for i := 0; i < 2; i++ {
+		msg, err := subscriber.Fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Topic == "requests.0" {
+			unmigrated = msg
+		}
+	}
+	if string(unmigrated.Key) != "1" {
+		t.Fatalf("got message %+v of requests.0, want the unmigrated one", unmigrated)
+	}
+
+	// The copy behind the unmigrated message is not committed before it
+	fetchNothing(t, subscriber)
+	if offset := lastProcessed(t, m, "requests.0"); offset != -1 {
+		t.Fatalf("got last processed offset %d of requests.0 before its first message was committed", offset)
+	}
+
+	if err := subscriber.Commit(ctx, unmigrated); err != nil {
+		t.Fatal(err)
+	}
+	if offset := lastProcessed(t, m, "requests.0"); offset != 1 {
+		t.Fatalf("got last processed offset %d of requests.0, want the copy at 1", offset)
+	}
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// StockOuts counts requests refused because a product did not have the
+// requested quantity available, by the operation that asked for it
+var StockOuts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "inventory_stock_outs_total",
+	Help: "Requests refused for lack of available stock, by operation.",
+}, []string{"operation"})
+
+// OperationReduce labels stock-outs of direct quantity reductions
+const OperationReduce = "REDUCE"
@@ -1,20 +1,51 @@
 package model
 
+import "time"
+
 type CreateInventoryRequest struct {
 	ProductID int `json:"product_id"`
 	Quantity  int `json:"quantity"`
 }
 
+// QuantityOfAProduct reports the stock of a product. Quantity is the stock on
+// hand, Reserved the part of it held for in-flight orders and Available what
+// can still be reserved.
 type QuantityOfAProduct struct {
 	ProductID int `json:"product_id"`
 	Quantity  int `json:"quantity"`
+	Reserved  int `json:"reserved"`
+	Available int `json:"available"`
 }
 
 type Inventory struct {
 	ProductID int `json:"product_id"`
 	Quantity  int `json:"quantity"`
+	Reserved  int `json:"reserved"`
+	Available int `json:"available"`
+}
+
+// Reservation holds stock of a product for an order until it is confirmed,
+// cancelled, released or expires
+type Reservation struct {
+	ID        int
+	OrderID   int
+	ProductID int
+	Quantity  int
+	Status    string
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
+// Reservation statuses
+const (
+	ReservationStatusReserved  = "RESERVED"
+	ReservationStatusCommitted = "COMMITTED"
+	ReservationStatusCancelled = "CANCELLED"
+	ReservationStatusReleased  = "RELEASED"
+	ReservationStatusExpired   = "EXPIRED"
+)
+
 type ReduceQuantityOfAProduct struct {
 	Amount int `json:"amount"`
 }
@@ -31,6 +62,72 @@ type ReleaseInventoryRequest struct {
 	Quantity  int `json:"quantity"`
 }
 
+// ReserveOrderRequest reserves every item of an order at once
+type ReserveOrderRequest struct {
+	OrderID int                `json:"order_id"`
+	Items   []ReserveOrderItem `json:"items"`
+}
+
+type ReserveOrderItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// CheckStockRequest asks whether every item is in stock, nothing is reserved
+type CheckStockRequest struct {
+	Items []ReserveOrderItem `json:"items"`
+}
+
+// StockCheckResponse is the reply to a stock check
+type StockCheckResponse struct {
+	// Available is set when every item is in stock
+	Available bool             `json:"available"`
+	Items     []StockCheckItem `json:"items"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// StockCheckItem is the stock available for a single item of a stock check
+type StockCheckItem struct {
+	ProductID int `json:"product_id"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
+}
+
+type ConfirmInventoryRequest struct {
+	OrderID   int `json:"order_id"`
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type CancelInventoryRequest struct {
+	OrderID   int `json:"order_id"`
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// ProcessedOperation records the outcome of an inventory request so
+// redelivered requests are answered without touching the stock again
+type ProcessedOperation struct {
+	OrderID   int
+	ProductID int
+	Operation string
+	Success   bool
+	Error     string
+	CreatedAt time.Time
+}
+
+// OutboxMessage is a Kafka message stored in the same transaction as the
+// stock change it announces and published later by the outbox relay
+type OutboxMessage struct {
+	ID        int64
+	Topic     string
+	Key       string
+	Headers   map[string]string
+	Payload   []byte
+	CreatedAt time.Time
+	SentAt    *time.Time
+}
+
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Code    string `json:"code"`
@@ -41,6 +138,93 @@ type ErrorResponse struct {
 type InventoryResponse struct {
 	OrderID   int    `json:"order_id"`
 	ProductID int    `json:"product_id"`
+	Operation string `json:"operation,omitempty"`
 	Success   bool   `json:"success"`
 	Error     string `json:"error,omitempty"`
+	// Items holds the per-item outcome of an order-level request
+	Items []InventoryItemResult `json:"items,omitempty"`
+}
+
+// InventoryItemResult is the outcome of a single item of an order-level request
+type InventoryItemResult struct {
+	ProductID int    `json:"product_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Inventory operations carried in InventoryResponse
+const (
+	InventoryOperationReserve      = "RESERVE"
+	InventoryOperationReserveOrder = "RESERVE_ORDER"
+	InventoryOperationConfirm      = "CONFIRM"
+	InventoryOperationCancel       = "CANCEL"
+	InventoryOperationRelease      = "RELEASE"
+)
+
+// DeadLetter is a message copied from a dead-letter topic so operators can
+// inspect it and decide whether to republish or discard it
+type DeadLetter struct {
+	ID              int64             `json:"id"`
+	Topic           string            `json:"topic"`
+	Partition       int               `json:"partition"`
+	Offset          int64             `json:"offset"`
+	SourceTopic     string            `json:"source_topic"`
+	SourcePartition int               `json:"source_partition"`
+	SourceOffset    int64             `json:"source_offset"`
+	Key             string            `json:"key"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Payload         string            `json:"payload,omitempty"`
+	Error           string            `json:"error"`
+	Attempts        int               `json:"attempts"`
+	Status          string            `json:"status"`
+	FailedAt        *time.Time        `json:"failed_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// DeadLetterDetail is a dead letter together with its audit trail
+type DeadLetterDetail struct {
+	DeadLetter
+	Audit []DeadLetterAudit `json:"audit"`
+}
+
+// DeadLetterAudit records an action taken on a dead letter
+type DeadLetterAudit struct {
+	ID           int64     `json:"id"`
+	DeadLetterID int64     `json:"dead_letter_id"`
+	Action       string    `json:"action"`
+	Actor        string    `json:"actor"`
+	Note         string    `json:"note,omitempty"`
+	Payload      string    `json:"payload,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Dead letter statuses
+const (
+	DeadLetterStatusPending     = "PENDING"
+	DeadLetterStatusRepublished = "REPUBLISHED"
+	DeadLetterStatusDiscarded   = "DISCARDED"
+)
+
+// Dead letter audit actions
+const (
+	DeadLetterActionRepublish        = "REPUBLISH"
+	DeadLetterActionEditAndRepublish = "EDIT_AND_REPUBLISH"
+	DeadLetterActionDiscard          = "DISCARD"
+)
+
+// RepublishDeadLetterRequest republishes a dead letter to its source topic,
+// with Payload replacing the original payload when set. Actor is the
+// authenticated admin, it is never read from the request body.
+type RepublishDeadLetterRequest struct {
+	Actor   string  `json:"-"`
+	Note    string  `json:"note"`
+	Payload *string `json:"payload,omitempty"`
+}
+
+// DiscardDeadLetterRequest discards a dead letter. Actor is the authenticated
+// admin, it is never read from the request body.
+type DiscardDeadLetterRequest struct {
+	Actor string `json:"-"`
+	Note  string `json:"note"`
 }
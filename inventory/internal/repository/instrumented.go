@@ -0,0 +1,264 @@
+package repository
+
+import (
+	"context"
+	"inventory/internal/model"
+	"maps"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("repository")
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Time taken by repository calls, by method and result.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "result"})
+
+// instrumentedRepository times every call made on a repository bound to a
+// context and records a span for it. Calls are only traced as part of a
+// trace, so background work such as polling the outbox does not start traces
+// of its own.
+type instrumentedRepository struct {
+	r   RepositoryI
+	ctx context.Context
+}
+
+// WithContext returns the repository with its calls timed and traced as
+// children of the span of ctx
+func (r *Repository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: r, ctx: ctx}
+}
+
+func (t *instrumentedRepository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: t.r, ctx: ctx}
+}
+
+// WithTx times and traces the transaction, the calls made in it are its
+// children
+func (t *instrumentedRepository) WithTx(fn func(r RepositoryI) error) error {
+	c := t.start("WithTx")
+	ctx := trace.ContextWithSpan(t.ctx, c.span)
+	err := t.r.WithTx(func(r RepositoryI) error {
+		return fn(&instrumentedRepository{r: r, ctx: ctx})
+	})
+	c.end(err)
+	return err
+}
+
+// call is a repository call being timed and traced
+type call struct {
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+// start starts timing a call and its span, the span is the non-recording
+// span of the context when it is not part of a trace
+func (t *instrumentedRepository) start(method string) call {
+	c := call{method: method, start: time.Now(), span: trace.SpanFromContext(t.ctx)}
+	if c.span.SpanContext().IsValid() {
+		_, c.span = tracer.Start(t.ctx, "repository."+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNamePostgreSQL,
+				semconv.CodeFunctionName("repository."+method),
+			),
+		)
+	}
+	return c
+}
+
+// end ends the span of a call, recording its error, and observes its latency
+func (c call) end(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, err.Error())
+	}
+	c.span.End()
+	queryDuration.WithLabelValues(c.method, result).Observe(time.Since(c.start).Seconds())
+}
+
+// injectHeaders returns headers with the trace context of ctx added
+func injectHeaders(ctx context.Context, headers map[string]string) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return headers
+	}
+	out := make(map[string]string, len(headers)+1)
+	maps.Copy(out, headers)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(out))
+	return out
+}
+
+func (t *instrumentedRepository) CreateInventory(req model.CreateInventoryRequest) error {
+	c := t.start("CreateInventory")
+	err := t.r.CreateInventory(req)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, error) {
+	c := t.start("GetQuantityOfAProduct")
+	v, err := t.r.GetQuantityOfAProduct(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetQuantityOfProducts(ids []int) ([]model.Inventory, error) {
+	c := t.start("GetQuantityOfProducts")
+	v, err := t.r.GetQuantityOfProducts(ids)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) LockQuantityOfProducts(ids []int) ([]model.Inventory, error) {
+	c := t.start("LockQuantityOfProducts")
+	v, err := t.r.LockQuantityOfProducts(ids)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) DeductQuantityOfAProduct(id, amount int) (bool, error) {
+	c := t.start("DeductQuantityOfAProduct")
+	v, err := t.r.DeductQuantityOfAProduct(id, amount)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) CreateReservation(res model.Reservation) (bool, error) {
+	c := t.start("CreateReservation")
+	v, err := t.r.CreateReservation(res)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) ConfirmReservation(orderID, productID int) (bool, error) {
+	c := t.start("ConfirmReservation")
+	v, err := t.r.ConfirmReservation(orderID, productID)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) ReleaseReservation(orderID, productID int, status string) (bool, error) {
+	c := t.start("ReleaseReservation")
+	v, err := t.r.ReleaseReservation(orderID, productID, status)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) ReturnCommittedReservation(orderID, productID int) (bool, error) {
+	c := t.start("ReturnCommittedReservation")
+	v, err := t.r.ReturnCommittedReservation(orderID, productID)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetExpiredReservations(now time.Time, limit int) ([]model.Reservation, error) {
+	c := t.start("GetExpiredReservations")
+	v, err := t.r.GetExpiredReservations(now, limit)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) ClaimOperation(orderID, productID int, operation string) (bool, error) {
+	c := t.start("ClaimOperation")
+	v, err := t.r.ClaimOperation(orderID, productID, operation)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetOperation(orderID, productID int, operation string) (*model.ProcessedOperation, error) {
+	c := t.start("GetOperation")
+	v, err := t.r.GetOperation(orderID, productID, operation)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) CompleteOperation(orderID, productID int, operation string, success bool, errMsg string) error {
+	c := t.start("CompleteOperation")
+	err := t.r.CompleteOperation(orderID, productID, operation, success, errMsg)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	c := t.start("CreateOutboxMessage")
+	// The trace context travels with the message to the outbox relay
+	msg.Headers = injectHeaders(t.ctx, msg.Headers)
+	err := t.r.CreateOutboxMessage(msg)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error) {
+	c := t.start("GetPendingOutboxMessages")
+	v, err := t.r.GetPendingOutboxMessages(limit)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) MarkOutboxMessageSent(id int64, sentAt time.Time) error {
+	c := t.start("MarkOutboxMessageSent")
+	err := t.r.MarkOutboxMessageSent(id, sentAt)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateDeadLetter(dl model.DeadLetter) error {
+	c := t.start("CreateDeadLetter")
+	err := t.r.CreateDeadLetter(dl)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error) {
+	c := t.start("GetDeadLetters")
+	v, err := t.r.GetDeadLetters(status, sourceTopic)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetDeadLetter(id int64) (*model.DeadLetter, error) {
+	c := t.start("GetDeadLetter")
+	v, err := t.r.GetDeadLetter(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error) {
+	c := t.start("GetDeadLetterForUpdate")
+	v, err := t.r.GetDeadLetterForUpdate(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) UpdateDeadLetterStatus(id int64, status string) error {
+	c := t.start("UpdateDeadLetterStatus")
+	err := t.r.UpdateDeadLetterStatus(id, status)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateDeadLetterAudit(a model.DeadLetterAudit) error {
+	c := t.start("CreateDeadLetterAudit")
+	err := t.r.CreateDeadLetterAudit(a)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error) {
+	c := t.start("GetDeadLetterAudits")
+	v, err := t.r.GetDeadLetterAudits(deadLetterID)
+	c.end(err)
+	return v, err
+}
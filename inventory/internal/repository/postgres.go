@@ -1,27 +1,111 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"inventory/internal/model"
 	"log/slog"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+// IsTransient reports whether err is a database failure that may succeed when
+// tried again later, such as a lost connection, a deadlock or a serialization
+// failure. Errors caused by the data itself are not transient.
+func IsTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback, including deadlocks
+			"53", // insufficient resources
+			"57", // operator intervention, such as a shutdown
+			"58": // system error
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type Repository struct {
 	l  *slog.Logger
 	db *sql.DB
+	q  querier
 }
 
 func New(l *slog.Logger, db *sql.DB) *Repository {
 	return &Repository{
 		l:  l,
 		db: db,
+		q:  db,
+	}
+}
+
+// WithTx runs fn with a repository bound to a new transaction. The transaction
+// is committed when fn returns nil and rolled back otherwise. Calls made on an
+// already transactional repository reuse the current transaction.
+func (r *Repository) WithTx(fn func(r RepositoryI) error) error {
+	if _, ok := r.q.(*sql.Tx); ok {
+		return fn(r)
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	if err := fn(&Repository{l: r.l, db: r.db, q: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			r.l.Error("failed to rollback transaction", "error", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DryRun runs fn with a repository bound to a new transaction that is always
+// rolled back, so fn sees its changes without keeping them
+func (r *Repository) DryRun(fn func(r RepositoryI) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
 	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			r.l.Error("failed to rollback transaction", "error", err)
+		}
+	}()
+
+	return fn(&Repository{l: r.l, db: r.db, q: tx})
 }
 
 func (r *Repository) CreateInventory(req model.CreateInventoryRequest) error {
 	query := `INSERT INTO inventory (product_id, quantity) VALUES ($1, $2)`
-	_, err := r.db.Exec(query, req.ProductID, req.Quantity)
+	_, err := r.q.Exec(query, req.ProductID, req.Quantity)
 	if err != nil {
 		return fmt.Errorf("could not insert inventory: %w", err)
 	}
@@ -30,12 +114,12 @@ func (r *Repository) CreateInventory(req model.CreateInventoryRequest) error {
 }
 
 func (r *Repository) GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, error) {
-	query := `SELECT product_id, quantity FROM inventory WHERE product_id = $1`
+	query := `SELECT product_id, quantity, reserved, quantity - reserved FROM inventory WHERE product_id = $1`
 	quantity := &model.QuantityOfAProduct{}
-	err := r.db.QueryRow(query, id).Scan(&quantity.ProductID, &quantity.Quantity)
+	err := r.q.QueryRow(query, id).Scan(&quantity.ProductID, &quantity.Quantity, &quantity.Reserved, &quantity.Available)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("product not found")
+			return nil, ErrProductNotFound
 		}
 		return nil, fmt.Errorf("could not get product: %w", err)
 	}
@@ -43,19 +127,32 @@ func (r *Repository) GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, e
 }
 
 func (r *Repository) GetQuantityOfProducts(ids []int) ([]model.Inventory, error) {
+	return r.getQuantityOfProducts(ids, "")
+}
+
+// LockQuantityOfProducts returns the stock of the given products and locks
+// their rows until the transaction ends. Rows are locked in product order so
+// concurrent callers cannot deadlock.
+func (r *Repository) LockQuantityOfProducts(ids []int) ([]model.Inventory, error) {
+	return r.getQuantityOfProducts(ids, " ORDER BY product_id FOR UPDATE")
+}
+
+// getQuantityOfProducts queries the stock of the given products, suffix is
+// appended to the query
+func (r *Repository) getQuantityOfProducts(ids []int, suffix string) ([]model.Inventory, error) {
 	if len(ids) == 0 {
 		return []model.Inventory{}, nil
 	}
 
 	// Create a parameterized query with the correct number of placeholders
-	query := `SELECT product_id, quantity FROM inventory WHERE product_id IN (`
+	query := `SELECT product_id, quantity, reserved, quantity - reserved FROM inventory WHERE product_id IN (`
 	for i := range ids {
 		if i > 0 {
 			query += ","
 		}
 		query += fmt.Sprintf("$%d", i+1)
 	}
-	query += ")"
+	query += ")" + suffix
 
 	// Convert ids slice to interface{} slice for Exec
 	args := make([]interface{}, len(ids))
@@ -64,7 +161,7 @@ func (r *Repository) GetQuantityOfProducts(ids []int) ([]model.Inventory, error)
 	}
 
 	// Execute the query
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.q.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("could not query inventory: %w", err)
 	}
@@ -74,7 +171,7 @@ func (r *Repository) GetQuantityOfProducts(ids []int) ([]model.Inventory, error)
 	var products []model.Inventory
 	for rows.Next() {
 		var product model.Inventory
-		err := rows.Scan(&product.ProductID, &product.Quantity)
+		err := rows.Scan(&product.ProductID, &product.Quantity, &product.Reserved, &product.Available)
 		if err != nil {
 			return nil, fmt.Errorf("could not scan product: %w", err)
 		}
@@ -88,11 +185,382 @@ func (r *Repository) GetQuantityOfProducts(ids []int) ([]model.Inventory, error)
 	return products, nil
 }
 
-func (r *Repository) UpdateQuantityOfAProduct(id, amount int) error {
-	query := `UPDATE inventory SET quantity = $1 WHERE product_id = $2`
-	_, err := r.db.Exec(query, amount, id)
+// DeductQuantityOfAProduct takes amount from the stock on hand of a product
+// in a single conditional update that never touches reserved stock. It
+// returns false without changing anything when not enough is available.
+func (r *Repository) DeductQuantityOfAProduct(id, amount int) (bool, error) {
+	query := `UPDATE inventory SET quantity = quantity - $1 WHERE product_id = $2 AND quantity - reserved >= $1`
+	return r.updateIfAvailable(query, amount, id)
+}
+
+// CreateReservation holds quantity of a product for an order. The hold is
+// taken with a single conditional update so concurrent reservations can never
+// exceed the available stock; it returns false when not enough is available.
+func (r *Repository) CreateReservation(res model.Reservation) (bool, error) {
+	query := `UPDATE inventory SET reserved = reserved + $1 WHERE product_id = $2 AND quantity - reserved >= $1`
+	ok, err := r.updateIfAvailable(query, res.Quantity, res.ProductID)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	query = `INSERT INTO reservations (order_id, product_id, quantity, status, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)`
+	_, err = r.q.Exec(query, res.OrderID, res.ProductID, res.Quantity, res.Status, res.ExpiresAt, res.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("could not insert reservation: %w", err)
+	}
+	return true, nil
+}
+
+// ConfirmReservation commits the active reservation of a product for an
+// order: the held quantity leaves the stock on hand for good. It returns false
+// when the order holds no active reservation for the product.
+func (r *Repository) ConfirmReservation(orderID, productID int) (bool, error) {
+	quantity, ok, err := r.moveReservation(orderID, productID, model.ReservationStatusReserved, model.ReservationStatusCommitted)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	query := `UPDATE inventory SET quantity = quantity - $1, reserved = reserved - $1 WHERE product_id = $2`
+	_, err = r.q.Exec(query, quantity, productID)
+	if err != nil {
+		return false, fmt.Errorf("could not commit reserved quantity: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseReservation moves the active reservation of a product for an order
+// to status and returns its quantity to the available stock. It returns false
+// when the order holds no active reservation for the product.
+func (r *Repository) ReleaseReservation(orderID, productID int, status string) (bool, error) {
+	quantity, ok, err := r.moveReservation(orderID, productID, model.ReservationStatusReserved, status)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	query := `UPDATE inventory SET reserved = reserved - $1 WHERE product_id = $2`
+	_, err = r.q.Exec(query, quantity, productID)
 	if err != nil {
-		return fmt.Errorf("could not update product: %w", err)
+		return false, fmt.Errorf("could not release reserved quantity: %w", err)
+	}
+	return true, nil
+}
+
+// ReturnCommittedReservation releases a confirmed reservation of a product for
+// an order and puts its quantity back on hand. It returns false when the order
+// holds no committed reservation for the product.
+func (r *Repository) ReturnCommittedReservation(orderID, productID int) (bool, error) {
+	quantity, ok, err := r.moveReservation(orderID, productID, model.ReservationStatusCommitted, model.ReservationStatusReleased)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	query := `UPDATE inventory SET quantity = quantity + $1 WHERE product_id = $2`
+	_, err = r.q.Exec(query, quantity, productID)
+	if err != nil {
+		return false, fmt.Errorf("could not return committed quantity: %w", err)
+	}
+	return true, nil
+}
+
+// moveReservation moves the reservation of a product for an order from one
+// status to another and returns its quantity. It returns false when the
+// reservation is not in the from status.
+func (r *Repository) moveReservation(orderID, productID int, from, to string) (int, bool, error) {
+	query := `UPDATE reservations SET status = $1, updated_at = $2
+		WHERE order_id = $3 AND product_id = $4 AND status = $5 RETURNING quantity`
+	var quantity int
+	err := r.q.QueryRow(query, to, time.Now(), orderID, productID, from).Scan(&quantity)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("could not update reservation: %w", err)
+	}
+	return quantity, true, nil
+}
+
+// GetExpiredReservations returns active reservations past their expiry. Inside
+// a transaction the rows stay locked and are skipped by other sweepers.
+func (r *Repository) GetExpiredReservations(now time.Time, limit int) ([]model.Reservation, error) {
+	query := `SELECT id, order_id, product_id, quantity, status, expires_at, created_at, updated_at FROM reservations
+		WHERE status = $1 AND expires_at < $2 ORDER BY expires_at LIMIT $3 FOR UPDATE SKIP LOCKED`
+	rows, err := r.q.Query(query, model.ReservationStatusReserved, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var reservations []model.Reservation
+	for rows.Next() {
+		var res model.Reservation
+		err := rows.Scan(&res.ID, &res.OrderID, &res.ProductID, &res.Quantity, &res.Status, &res.ExpiresAt, &res.CreatedAt, &res.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan reservation: %w", err)
+		}
+		reservations = append(reservations, res)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating reservation rows: %w", err)
+	}
+
+	return reservations, nil
+}
+
+// updateIfAvailable runs a conditional stock update and reports whether it
+// applied, telling a missing product from an insufficient stock
+func (r *Repository) updateIfAvailable(query string, amount, id int) (bool, error) {
+	result, err := r.q.Exec(query, amount, id)
+	if err != nil {
+		return false, fmt.Errorf("could not update product: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not get rows affected: %w", err)
+	}
+	if rowsAffected > 0 {
+		return true, nil
+	}
+
+	if _, err := r.GetQuantityOfAProduct(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// ClaimOperation records that an operation is being processed and returns
+// false when it was already recorded. A concurrent claim of the same
+// operation blocks until the first transaction ends.
+func (r *Repository) ClaimOperation(orderID, productID int, operation string) (bool, error) {
+	query := `INSERT INTO processed_operations (order_id, product_id, operation, success, error, created_at)
+		VALUES ($1, $2, $3, false, '', $4) ON CONFLICT DO NOTHING`
+	result, err := r.q.Exec(query, orderID, productID, operation, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("could not claim operation: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+func (r *Repository) GetOperation(orderID, productID int, operation string) (*model.ProcessedOperation, error) {
+	query := `SELECT order_id, product_id, operation, success, error, created_at FROM processed_operations
+		WHERE order_id = $1 AND product_id = $2 AND operation = $3`
+	op := &model.ProcessedOperation{}
+	err := r.q.QueryRow(query, orderID, productID, operation).Scan(&op.OrderID, &op.ProductID, &op.Operation, &op.Success, &op.Error, &op.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOperationNotFound
+		}
+		return nil, fmt.Errorf("could not get operation: %w", err)
+	}
+	return op, nil
+}
+
+func (r *Repository) CompleteOperation(orderID, productID int, operation string, success bool, errMsg string) error {
+	query := `UPDATE processed_operations SET success = $1, error = $2 WHERE order_id = $3 AND product_id = $4 AND operation = $5`
+	_, err := r.q.Exec(query, success, errMsg, orderID, productID, operation)
+	if err != nil {
+		return fmt.Errorf("could not complete operation: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return fmt.Errorf("could not marshal outbox headers: %w", err)
+	}
+
+	query := `INSERT INTO outbox (topic, key, headers, payload, created_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err = r.q.Exec(query, msg.Topic, msg.Key, headers, msg.Payload, msg.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("could not insert outbox message: %w", err)
+	}
+	return nil
+}
+
+// GetPendingOutboxMessages returns the oldest unsent outbox messages. Inside a
+// transaction the rows stay locked and are skipped by other relays.
+func (r *Repository) GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error) {
+	query := `SELECT id, topic, key, headers, payload, created_at, sent_at FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`
+	rows, err := r.q.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []model.OutboxMessage
+	for rows.Next() {
+		var msg model.OutboxMessage
+		var headers []byte
+		err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &headers, &msg.Payload, &msg.CreatedAt, &msg.SentAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan outbox message: %w", err)
+		}
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+				return nil, fmt.Errorf("could not unmarshal outbox headers: %w", err)
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbox rows: %w", err)
+	}
+
+	return msgs, nil
+}
+
+func (r *Repository) MarkOutboxMessageSent(id int64, sentAt time.Time) error {
+	query := `UPDATE outbox SET sent_at = $1 WHERE id = $2`
+	_, err := r.q.Exec(query, sentAt, id)
+	if err != nil {
+		return fmt.Errorf("could not mark outbox message sent: %w", err)
+	}
+	return nil
+}
+
+// CreateDeadLetter stores a message read from a dead-letter topic. A message
+// that is already stored is skipped, so the topic can be read again.
+func (r *Repository) CreateDeadLetter(dl model.DeadLetter) error {
+	headers, err := json.Marshal(dl.Headers)
+	if err != nil {
+		return fmt.Errorf("could not marshal dead letter headers: %w", err)
+	}
+
+	query := `INSERT INTO dead_letters (topic, partition, "offset", source_topic, source_partition, source_offset,
+			key, headers, payload, error, attempts, status, failed_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $14)
+		ON CONFLICT (topic, partition, "offset") DO NOTHING`
+	_, err = r.q.Exec(query, dl.Topic, dl.Partition, dl.Offset, dl.SourceTopic, dl.SourcePartition, dl.SourceOffset,
+		dl.Key, headers, []byte(dl.Payload), dl.Error, dl.Attempts, dl.Status, dl.FailedAt, dl.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("could not insert dead letter: %w", err)
+	}
+	return nil
+}
+
+// GetDeadLetters returns the dead letters with a status from a source topic,
+// oldest first. Empty filters match every dead letter.
+func (r *Repository) GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error) {
+	query := deadLetterSelect + ` WHERE ($1 = '' OR status = $1) AND ($2 = '' OR source_topic = $2) ORDER BY id`
+	rows, err := r.q.Query(query, status, sourceTopic)
+	if err != nil {
+		return nil, fmt.Errorf("could not query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters := []model.DeadLetter{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, *dl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dead letter rows: %w", err)
+	}
+
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns a dead letter by ID
+func (r *Repository) GetDeadLetter(id int64) (*model.DeadLetter, error) {
+	return scanDeadLetter(r.q.QueryRow(deadLetterSelect+` WHERE id = $1`, id))
+}
+
+// GetDeadLetterForUpdate returns a dead letter by ID and locks it until the
+// transaction ends
+func (r *Repository) GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error) {
+	return scanDeadLetter(r.q.QueryRow(deadLetterSelect+` WHERE id = $1 FOR UPDATE`, id))
+}
+
+// UpdateDeadLetterStatus sets the status of a dead letter
+func (r *Repository) UpdateDeadLetterStatus(id int64, status string) error {
+	query := `UPDATE dead_letters SET status = $1, updated_at = $2 WHERE id = $3`
+	_, err := r.q.Exec(query, status, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("could not update dead letter: %w", err)
+	}
+	return nil
+}
+
+// CreateDeadLetterAudit records an action taken on a dead letter
+func (r *Repository) CreateDeadLetterAudit(a model.DeadLetterAudit) error {
+	query := `INSERT INTO dead_letter_audit (dead_letter_id, action, actor, note, payload, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	var payload []byte
+	if a.Payload != "" {
+		payload = []byte(a.Payload)
+	}
+	_, err := r.q.Exec(query, a.DeadLetterID, a.Action, a.Actor, a.Note, payload, a.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("could not insert dead letter audit: %w", err)
 	}
 	return nil
 }
+
+// GetDeadLetterAudits returns the audit trail of a dead letter, oldest first
+func (r *Repository) GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error) {
+	query := `SELECT id, dead_letter_id, action, actor, note, payload, created_at FROM dead_letter_audit
+		WHERE dead_letter_id = $1 ORDER BY id`
+	rows, err := r.q.Query(query, deadLetterID)
+	if err != nil {
+		return nil, fmt.Errorf("could not query dead letter audit: %w", err)
+	}
+	defer rows.Close()
+
+	audits := []model.DeadLetterAudit{}
+	for rows.Next() {
+		var a model.DeadLetterAudit
+		var note sql.NullString
+		var payload []byte
+		if err := rows.Scan(&a.ID, &a.DeadLetterID, &a.Action, &a.Actor, &note, &payload, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("could not scan dead letter audit: %w", err)
+		}
+		a.Note = note.String
+		a.Payload = string(payload)
+		audits = append(audits, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dead letter audit rows: %w", err)
+	}
+
+	return audits, nil
+}
+
+// deadLetterSelect selects the columns read by scanDeadLetter
+const deadLetterSelect = `SELECT id, topic, partition, "offset", source_topic, source_partition, source_offset,
+	key, headers, payload, error, attempts, status, failed_at, created_at, updated_at FROM dead_letters`
+
+// scanDeadLetter scans a row selected with deadLetterSelect
+func scanDeadLetter(row interface{ Scan(dest ...any) error }) (*model.DeadLetter, error) {
+	var dl model.DeadLetter
+	var headers, payload []byte
+	err := row.Scan(&dl.ID, &dl.Topic, &dl.Partition, &dl.Offset, &dl.SourceTopic, &dl.SourcePartition, &dl.SourceOffset,
+		&dl.Key, &headers, &payload, &dl.Error, &dl.Attempts, &dl.Status, &dl.FailedAt, &dl.CreatedAt, &dl.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDeadLetterNotFound
+		}
+		return nil, fmt.Errorf("could not scan dead letter: %w", err)
+	}
+
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &dl.Headers); err != nil {
+			return nil, fmt.Errorf("could not unmarshal dead letter headers: %w", err)
+		}
+	}
+	dl.Payload = string(payload)
+	return &dl, nil
+}
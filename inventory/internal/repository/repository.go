@@ -1,10 +1,53 @@
 package repository
 
-import "inventory/internal/model"
+import (
+	"context"
+	"errors"
+	"inventory/internal/model"
+	"time"
+)
+
+// ErrProductNotFound is returned when no inventory row exists for a product
+var ErrProductNotFound = errors.New("product not found")
+
+// ErrOperationNotFound is returned when an operation was never processed
+var ErrOperationNotFound = errors.New("operation not found")
+
+// ErrDeadLetterNotFound is returned when no dead letter exists with an ID
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
 
 type RepositoryI interface {
 	CreateInventory(req model.CreateInventoryRequest) error
 	GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, error)
 	GetQuantityOfProducts(ids []int) ([]model.Inventory, error)
-	UpdateQuantityOfAProduct(id, amount int) error
+	LockQuantityOfProducts(ids []int) ([]model.Inventory, error)
+	DeductQuantityOfAProduct(id, amount int) (bool, error)
+
+	CreateReservation(res model.Reservation) (bool, error)
+	ConfirmReservation(orderID, productID int) (bool, error)
+	ReleaseReservation(orderID, productID int, status string) (bool, error)
+	ReturnCommittedReservation(orderID, productID int) (bool, error)
+	GetExpiredReservations(now time.Time, limit int) ([]model.Reservation, error)
+
+	ClaimOperation(orderID, productID int, operation string) (bool, error)
+	GetOperation(orderID, productID int, operation string) (*model.ProcessedOperation, error)
+	CompleteOperation(orderID, productID int, operation string, success bool, errMsg string) error
+
+	CreateOutboxMessage(msg model.OutboxMessage) error
+	GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error)
+	MarkOutboxMessageSent(id int64, sentAt time.Time) error
+
+	CreateDeadLetter(dl model.DeadLetter) error
+	GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error)
+	GetDeadLetter(id int64) (*model.DeadLetter, error)
+	GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error)
+	UpdateDeadLetterStatus(id int64, status string) error
+	CreateDeadLetterAudit(a model.DeadLetterAudit) error
+	GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error)
+
+	// WithTx runs fn inside a single database transaction
+	WithTx(fn func(r RepositoryI) error) error
+	// WithContext returns the repository with its calls timed and traced
+	// as part of the trace of ctx
+	WithContext(ctx context.Context) RepositoryI
 }
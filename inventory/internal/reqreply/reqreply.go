@@ -0,0 +1,208 @@
+// Package reqreply implements request/reply over the message broker. A
+// request carries a correlation ID and the topic to reply to in its headers;
+// the responder copies the correlation ID onto its reply and sends it to that
+// topic, or to its default topic when none is given. The requester reads
+// replies with a single long-lived consumer and hands each one to the
+// request waiting for it.
+package reqreply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"inventory/internal/envelope"
+	"inventory/internal/messaging"
+)
+
+// Header names carried by requests and replies
+const (
+	HeaderCorrelationID = envelope.HeaderCorrelationID
+	HeaderReplyTo       = "reply-to"
+)
+
+// ErrTimeout is returned when no reply arrived before the request deadline
+var ErrTimeout = errors.New("timed out waiting for reply")
+
+// Requester sends requests and waits for their replies
+type Requester struct {
+	l          *slog.Logger
+	publisher  messaging.Publisher
+	subscriber messaging.Subscriber
+	replyTopic string
+
+	mu      sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+// pendingRequest is a request waiting for its reply
+type pendingRequest struct {
+	reply    chan messaging.Message
+	deadline time.Time
+}
+
+// NewRequester creates a requester receiving replies on replyTopic. Every
+// process needs its own groupID so it sees all replies, replies to requests
+// of other processes are skipped. The group starts at the end of the topic,
+// replies sent to an earlier process are of no use.
+func NewRequester(l *slog.Logger, broker messaging.Broker, replyTopic string, groupID string) *Requester {
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{
+		Topics:  []string{replyTopic},
+		GroupID: groupID,
+		MaxWait: 100 * time.Millisecond,
+		Latest:  true,
+	})
+
+	return &Requester{
+		l:          l,
+		publisher:  broker.NewPublisher(),
+		subscriber: subscriber,
+		replyTopic: replyTopic,
+		pending:    make(map[string]*pendingRequest),
+	}
+}
+
+// Start starts consuming replies
+func (q *Requester) Start(ctx context.Context) error {
+	q.l.InfoContext(ctx, "Starting reply consumer", "topic", q.replyTopic)
+
+	go q.consume(ctx)
+
+	return nil
+}
+
+// Close closes the requester
+func (q *Requester) Close() error {
+	if err := q.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close request publisher: %w", err)
+	}
+	if err := q.subscriber.Close(); err != nil {
+		return fmt.Errorf("failed to close reply subscriber: %w", err)
+	}
+	return nil
+}
+
+// Request sends msg and waits until its reply arrives, the timeout passes or
+// ctx is done. The correlation ID header of msg is kept when it is set.
+func (q *Requester) Request(ctx context.Context, msg messaging.Message, timeout time.Duration) (messaging.Message, error) {
+	id := msg.Header(HeaderCorrelationID)
+	if id == "" {
+		var err error
+		if id, err = envelope.NewID(); err != nil {
+			return messaging.Message{}, err
+		}
+		msg.Headers = append(msg.Headers, messaging.Header{Key: HeaderCorrelationID, Value: []byte(id)})
+	}
+	msg.Headers = append(msg.Headers, messaging.Header{Key: HeaderReplyTo, Value: []byte(q.replyTopic)})
+
+	deadline := time.Now().Add(timeout)
+	p := &pendingRequest{
+		reply:    make(chan messaging.Message, 1),
+		deadline: deadline,
+	}
+	q.mu.Lock()
+	q.pending[id] = p
+	q.mu.Unlock()
+	defer q.forget(id)
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	if err := q.publisher.Publish(ctx, msg); err != nil {
+		return messaging.Message{}, fmt.Errorf("failed to write request: %w", err)
+	}
+
+	q.l.InfoContext(ctx, "Sent request", "topic", msg.Topic, "correlation_id", id, "deadline", deadline)
+
+	select {
+	case reply := <-p.reply:
+		return reply, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return messaging.Message{}, ErrTimeout
+		}
+		return messaging.Message{}, ctx.Err()
+	}
+}
+
+// Pending returns the number of requests waiting for a reply
+func (q *Requester) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// consume reads replies until the context is canceled
+func (q *Requester) consume(ctx context.Context) {
+	for {
+		msg, err := q.subscriber.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, messaging.ErrClosed) {
+				q.l.InfoContext(ctx, "Stopping reply consumer")
+				return
+			}
+			q.l.ErrorContext(ctx, "failed to fetch reply", "error", err)
+			continue
+		}
+
+		if id := msg.Header(HeaderCorrelationID); id != "" {
+			q.deliver(ctx, id, msg)
+		} else {
+			q.l.InfoContext(ctx, "Skipping reply without correlation ID", "topic", msg.Topic, "key", string(msg.Key))
+		}
+
+		// The offset is committed once the reply was handed over
+		if err := q.subscriber.Commit(ctx, msg); err != nil {
+			q.l.ErrorContext(ctx, "failed to commit reply", "error", err, "partition", msg.Partition, "offset", msg.Offset)
+		}
+	}
+}
+
+// deliver hands a reply to the request waiting for it
+func (q *Requester) deliver(ctx context.Context, id string, msg messaging.Message) {
+	q.mu.Lock()
+	p, ok := q.pending[id]
+	if ok {
+		delete(q.pending, id)
+	}
+	q.mu.Unlock()
+
+	switch {
+	case !ok:
+		// Replies to other processes or to requests that gave up
+		q.l.DebugContext(ctx, "No pending request for reply", "correlation_id", id)
+	case time.Now().After(p.deadline):
+		q.l.InfoContext(ctx, "Dropping reply that arrived after the deadline", "correlation_id", id, "deadline", p.deadline)
+	default:
+		p.reply <- msg
+	}
+}
+
+// forget removes a request from the pending map
+func (q *Requester) forget(id string) {
+	q.mu.Lock()
+	delete(q.pending, id)
+	q.mu.Unlock()
+}
+
+// Route is where the reply to a request has to be sent
+type Route struct {
+	Topic         string
+	CorrelationID string
+}
+
+// RouteOf returns the reply route of a request. Requests without a reply-to
+// header are answered on defaultTopic.
+func RouteOf(msg messaging.Message, defaultTopic string) Route {
+	route := Route{
+		Topic:         msg.Header(HeaderReplyTo),
+		CorrelationID: msg.Header(HeaderCorrelationID),
+	}
+	if route.Topic == "" {
+		route.Topic = defaultTopic
+	}
+	return route
+}
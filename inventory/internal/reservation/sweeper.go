@@ -0,0 +1,85 @@
+package reservation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"inventory/internal/model"
+	"inventory/internal/repository"
+)
+
+// sweepBatchSize is the number of reservations expired per transaction
+const sweepBatchSize = 100
+
+// Sweeper periodically releases reservations that passed their expiry
+type Sweeper struct {
+	l        *slog.Logger
+	r        repository.RepositoryI
+	interval time.Duration
+}
+
+// NewSweeper creates a new reservation sweeper
+func NewSweeper(l *slog.Logger, r repository.RepositoryI, interval time.Duration) *Sweeper {
+	return &Sweeper{
+		l:        l,
+		r:        r,
+		interval: interval,
+	}
+}
+
+// Start starts the reservation sweeper
+func (s *Sweeper) Start(ctx context.Context) error {
+	s.l.Info("Starting reservation sweeper", "interval", s.interval)
+
+	go s.run(ctx)
+
+	return nil
+}
+
+// run sweeps expired reservations until the context is canceled
+func (s *Sweeper) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.l.Info("Context canceled, stopping reservation sweeper")
+			return
+		case now := <-ticker.C:
+			for {
+				expired, err := s.sweep(ctx, now)
+				if err != nil {
+					s.l.Error("failed to expire reservations", "error", err)
+					break
+				}
+				if expired < sweepBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// sweep expires one batch of reservations and returns how many were expired
+func (s *Sweeper) sweep(ctx context.Context, now time.Time) (int, error) {
+	expired := 0
+	err := s.r.WithContext(ctx).WithTx(func(r repository.RepositoryI) error {
+		reservations, err := r.GetExpiredReservations(now, sweepBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get expired reservations: %w", err)
+		}
+
+		for _, res := range reservations {
+			if _, err := r.ReleaseReservation(res.OrderID, res.ProductID, model.ReservationStatusExpired); err != nil {
+				return fmt.Errorf("failed to expire reservation %d: %w", res.ID, err)
+			}
+			s.l.Info("Reservation expired", "order_id", res.OrderID, "product_id", res.ProductID, "quantity", res.Quantity, "expires_at", res.ExpiresAt)
+			expired++
+		}
+		return nil
+	})
+	return expired, err
+}
@@ -0,0 +1,245 @@
+// Package retrytopic retries messages that failed with a transient error
+// through a ladder of retry topics with increasing delays. A failed message is
+// written to the retry topic of its next tier, a forwarder reading that topic
+// waits until the delay has passed and writes it back to its source topic,
+// where it is processed again. Messages that still fail after the last tier
+// are left to the caller, which dead-letters them.
+package retrytopic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"inventory/internal/messaging"
+)
+
+// Header names added to retried messages
+const (
+	HeaderAttempt   = "retry-attempt"
+	HeaderNotBefore = "retry-not-before"
+	HeaderError     = "retry-error"
+)
+
+// ErrExhausted is returned when a message already went through every tier
+var ErrExhausted = errors.New("retry tiers exhausted")
+
+// Tier is a retry topic and the delay its messages wait before they are
+// processed again
+type Tier struct {
+	Suffix string
+	Delay  time.Duration
+}
+
+// DefaultTiers retries after 5 seconds, 1 minute and 10 minutes
+var DefaultTiers = []Tier{
+	{Suffix: ".retry.5s", Delay: 5 * time.Second},
+	{Suffix: ".retry.1m", Delay: time.Minute},
+	{Suffix: ".retry.10m", Delay: 10 * time.Minute},
+}
+
+// Topic returns the retry topic of a topic for a tier
+func Topic(topic string, tier Tier) string {
+	return topic + tier.Suffix
+}
+
+// Attempt returns how many retry tiers a message already went through
+func Attempt(msg messaging.Message) int {
+	attempt, _ := strconv.Atoi(msg.Header(HeaderAttempt))
+	return attempt
+}
+
+// withHeaders returns the headers of msg with the given ones set, replacing
+// earlier values
+func withHeaders(msg messaging.Message, set ...messaging.Header) []messaging.Header {
+	headers := make([]messaging.Header, 0, len(msg.Headers)+len(set))
+	for _, h := range msg.Headers {
+		replaced := false
+		for _, s := range set {
+			if h.Key == s.Key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			headers = append(headers, h)
+		}
+	}
+	return append(headers, set...)
+}
+
+// Publisher writes failed messages to the retry topic of their next tier
+type Publisher struct {
+	l         *slog.Logger
+	publisher messaging.Publisher
+	tiers     []Tier
+}
+
+// NewPublisher creates a new retry publisher
+func NewPublisher(l *slog.Logger, broker messaging.Broker, tiers []Tier) *Publisher {
+	return &Publisher{
+		l:         l,
+		publisher: broker.NewPublisher(),
+		tiers:     tiers,
+	}
+}
+
+// Exhausted reports whether msg already went through every tier
+func (p *Publisher) Exhausted(msg messaging.Message) bool {
+	return Attempt(msg) >= len(p.tiers)
+}
+
+// Publish writes msg to the retry topic of its next tier together with the
+// error that made it fail. It returns ErrExhausted when no tier is left.
+func (p *Publisher) Publish(ctx context.Context, msg messaging.Message, reason error) error {
+	if p.Exhausted(msg) {
+		return ErrExhausted
+	}
+	attempt := Attempt(msg)
+	tier := p.tiers[attempt]
+
+	notBefore := time.Now().Add(tier.Delay)
+	topic := Topic(msg.Topic, tier)
+	err := p.publisher.Publish(ctx, messaging.Message{
+		Topic: topic,
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: withHeaders(msg,
+			messaging.Header{Key: HeaderAttempt, Value: []byte(strconv.Itoa(attempt + 1))},
+			messaging.Header{Key: HeaderNotBefore, Value: []byte(notBefore.UTC().Format(time.RFC3339Nano))},
+			messaging.Header{Key: HeaderError, Value: []byte(reason.Error())},
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %w", topic, err)
+	}
+
+	p.l.Warn("Scheduled message retry", "reason", reason, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "attempt", attempt+1, "retry_topic", topic, "not_before", notBefore)
+	return nil
+}
+
+// Close closes the publisher
+func (p *Publisher) Close() error {
+	if err := p.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close retry publisher: %w", err)
+	}
+	return nil
+}
+
+// Forwarder moves the messages of the retry topics of a tier back to their
+// source topics once their delay has passed
+type Forwarder struct {
+	l          *slog.Logger
+	tier       Tier
+	subscriber messaging.Subscriber
+	publisher  messaging.Publisher
+}
+
+// NewForwarder creates a forwarder for the retry topics of topics in a tier
+func NewForwarder(l *slog.Logger, broker messaging.Broker, groupID string, topics []string, tier Tier) *Forwarder {
+	retryTopics := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		retryTopics = append(retryTopics, Topic(topic, tier))
+	}
+
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{
+		Topics:  retryTopics,
+		GroupID: groupID,
+		// Messages wait in the tier until they are due
+		ProcessingDelay: tier.Delay,
+	})
+
+	return &Forwarder{
+		l:          l,
+		tier:       tier,
+		subscriber: subscriber,
+		publisher:  broker.NewPublisher(),
+	}
+}
+
+// Start starts the forwarder
+func (f *Forwarder) Start(ctx context.Context) error {
+	f.l.InfoContext(ctx, "Starting retry forwarder", "tier", f.tier.Suffix, "delay", f.tier.Delay)
+
+	go f.run(ctx)
+
+	return nil
+}
+
+// Stop stops the forwarder
+func (f *Forwarder) Stop() error {
+	if err := f.subscriber.Close(); err != nil {
+		return fmt.Errorf("failed to close retry subscriber: %w", err)
+	}
+	if err := f.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close retry publisher: %w", err)
+	}
+	return nil
+}
+
+// run forwards due messages until the context is canceled. Messages of a
+// retry topic share one delay, so they become due in the order they were
+// written and waiting for the first one never holds back a due one.
+func (f *Forwarder) run(ctx context.Context) {
+	for {
+		msg, err := f.subscriber.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				f.l.InfoContext(ctx, "Context canceled, stopping retry forwarder", "tier", f.tier.Suffix)
+				return
+			}
+			f.l.ErrorContext(ctx, "failed to fetch retry message", "error", err, "tier", f.tier.Suffix)
+			continue
+		}
+
+		if notBefore, err := time.Parse(time.RFC3339Nano, msg.Header(HeaderNotBefore)); err == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(notBefore)):
+			}
+		}
+
+		// The message is committed only once it is back on its source topic,
+		// so it is forwarded again after a crash rather than lost
+		source := strings.TrimSuffix(msg.Topic, f.tier.Suffix)
+		if err := f.forward(ctx, source, msg); err != nil {
+			f.l.InfoContext(ctx, "Context canceled, stopping retry forwarder", "tier", f.tier.Suffix)
+			return
+		}
+
+		if err := f.subscriber.Commit(ctx, msg); err != nil {
+			f.l.ErrorContext(ctx, "failed to commit retry message", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+			continue
+		}
+
+		f.l.InfoContext(ctx, "Forwarded retry message", "topic", source, "key", string(msg.Key), "attempt", Attempt(msg))
+	}
+}
+
+// forward writes msg to its source topic, trying again until it succeeds or
+// the context is canceled
+func (f *Forwarder) forward(ctx context.Context, source string, msg messaging.Message) error {
+	for {
+		err := f.publisher.Publish(ctx, messaging.Message{
+			Topic:   source,
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: msg.Headers,
+		})
+		if err == nil {
+			return nil
+		}
+		f.l.ErrorContext(ctx, "failed to forward retry message", "error", err, "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -1,14 +1,30 @@
 package routes
 
 import (
+	"expvar"
+	"inventory/internal/admin"
 	"inventory/internal/handler"
+	"inventory/internal/metrics"
 	"net/http"
 )
 
-func RegisterRoutes(mux *http.ServeMux, h *handler.Handler) {
+func RegisterRoutes(mux *http.ServeMux, h *handler.Handler, tokens admin.Tokens) {
 	mux.HandleFunc("GET /health", h.Health)
 	mux.HandleFunc("POST /inventory", h.CreateInventory)
 	mux.HandleFunc("GET /inventory/{id}", h.GetQuantityOfAProduct)
 	mux.HandleFunc("GET /inventory", h.GetQuantityOfProducts)
 	mux.HandleFunc("POST /inventory/product/{id}/reduce", h.ReduceQuantityOfAProduct)
+
+	// Consumer lag and progress, also published as the consumers expvar
+	mux.HandleFunc("GET /admin/consumers", h.GetConsumers)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	// Prometheus metrics, the consumer lag included
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	// Dead letter administration, for operators holding an admin token
+	mux.HandleFunc("GET /admin/dlq", tokens.Middleware(h.GetDeadLetters))
+	mux.HandleFunc("GET /admin/dlq/{id}", tokens.Middleware(h.GetDeadLetter))
+	mux.HandleFunc("POST /admin/dlq/{id}/republish", tokens.Middleware(h.RepublishDeadLetter))
+	mux.HandleFunc("POST /admin/dlq/{id}/discard", tokens.Middleware(h.DiscardDeadLetter))
 }
@@ -8,10 +8,10 @@ import (
 
 var srv *http.Server
 
-func Init(port string, mux *http.ServeMux) error {
+func Init(port string, handler http.Handler) error {
 	srv = &http.Server{
 		Addr:              port,
-		Handler:           mux,
+		Handler:           handler,
 		ReadTimeout:       1 * time.Second,
 		ReadHeaderTimeout: 1 * time.Second,
 		WriteTimeout:      1 * time.Second,
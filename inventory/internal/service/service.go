@@ -1,7 +1,10 @@
 package service
 
 import (
+	"context"
 	"fmt"
+	"inventory/internal/deadletter"
+	"inventory/internal/metrics"
 	"inventory/internal/model"
 	"inventory/internal/repository"
 	"log/slog"
@@ -20,14 +23,19 @@ func New(l *slog.Logger, r repository.RepositoryI) *Service {
 }
 
 type ServiceI interface {
-	CreateInventory(req model.CreateInventoryRequest) error
-	GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, error)
-	GetQuantityOfProducts(ids []int) ([]model.Inventory, error)
-	ReduceQuantityOfAProduct(id int, a model.ReduceQuantityOfAProduct) error
+	CreateInventory(ctx context.Context, req model.CreateInventoryRequest) error
+	GetQuantityOfAProduct(ctx context.Context, id int) (*model.QuantityOfAProduct, error)
+	GetQuantityOfProducts(ctx context.Context, ids []int) ([]model.Inventory, error)
+	ReduceQuantityOfAProduct(ctx context.Context, id int, a model.ReduceQuantityOfAProduct) error
+
+	GetDeadLetters(ctx context.Context, status, sourceTopic string) ([]model.DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int64) (*model.DeadLetterDetail, error)
+	RepublishDeadLetter(ctx context.Context, id int64, req model.RepublishDeadLetterRequest) error
+	DiscardDeadLetter(ctx context.Context, id int64, req model.DiscardDeadLetterRequest) error
 }
 
-func (s *Service) CreateInventory(req model.CreateInventoryRequest) error {
-	err := s.r.CreateInventory(req)
+func (s *Service) CreateInventory(ctx context.Context, req model.CreateInventoryRequest) error {
+	err := s.r.WithContext(ctx).CreateInventory(req)
 	if err != nil {
 		s.l.Error("failed to create inventoruy for product", "error", err)
 		return fmt.Errorf("failed to create inventoruy for product: %w", err)
@@ -36,8 +44,8 @@ func (s *Service) CreateInventory(req model.CreateInventoryRequest) error {
 	return nil
 }
 
-func (s *Service) GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, error) {
-	quantity, err := s.r.GetQuantityOfAProduct(id)
+func (s *Service) GetQuantityOfAProduct(ctx context.Context, id int) (*model.QuantityOfAProduct, error) {
+	quantity, err := s.r.WithContext(ctx).GetQuantityOfAProduct(id)
 	if err != nil {
 		s.l.Error("failed to get quantity of product", "error", err, "product_id", id)
 		return nil, fmt.Errorf("failed to get quantity of product: %w", err)
@@ -46,10 +54,10 @@ func (s *Service) GetQuantityOfAProduct(id int) (*model.QuantityOfAProduct, erro
 	return quantity, nil
 }
 
-func (s *Service) GetQuantityOfProducts(ids []int) ([]model.Inventory, error) {
+func (s *Service) GetQuantityOfProducts(ctx context.Context, ids []int) ([]model.Inventory, error) {
 	s.l.Info("getting quantities", "ids", ids)
 
-	products, err := s.r.GetQuantityOfProducts(ids)
+	products, err := s.r.WithContext(ctx).GetQuantityOfProducts(ids)
 	if err != nil {
 		s.l.Error("failed to get quantities", "ids", ids, "error", err)
 		return nil, fmt.Errorf("failed to get quantities: %w", err)
@@ -59,24 +67,73 @@ func (s *Service) GetQuantityOfProducts(ids []int) ([]model.Inventory, error) {
 	return products, nil
 }
 
-func (s *Service) ReduceQuantityOfAProduct(id int, a model.ReduceQuantityOfAProduct) error {
-	quantity, err := s.r.GetQuantityOfAProduct(id)
+func (s *Service) ReduceQuantityOfAProduct(ctx context.Context, id int, a model.ReduceQuantityOfAProduct) error {
+	if a.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+
+	ok, err := s.r.WithContext(ctx).DeductQuantityOfAProduct(id, a.Amount)
 	if err != nil {
-		s.l.Error("failed to get quantity of product", "error", err, "product_id", id)
-		return fmt.Errorf("failed to get quantity of product: %w", err)
+		s.l.Error("failed to update quantity of product", "error", err, "product_id", id)
+		return fmt.Errorf("failed to update quantity of product: %w", err)
 	}
 
-	if quantity.Quantity < a.Amount {
+	if !ok {
+		metrics.StockOuts.WithLabelValues(metrics.OperationReduce).Inc()
 		return fmt.Errorf("not enough quantity")
 	}
 
-	quantity.Quantity = quantity.Quantity - a.Amount
+	return nil
+}
 
-	err = s.r.UpdateQuantityOfAProduct(id, quantity.Quantity)
+func (s *Service) GetDeadLetters(ctx context.Context, status, sourceTopic string) ([]model.DeadLetter, error) {
+	deadLetters, err := s.r.WithContext(ctx).GetDeadLetters(status, sourceTopic)
 	if err != nil {
-		s.l.Error("failed to update quantity of product", "error", err, "product_id", id)
-		return fmt.Errorf("failed to update quantity of product: %w", err)
+		s.l.Error("failed to get dead letters", "error", err)
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+
+	// Payloads are only returned for a single dead letter
+	for i := range deadLetters {
+		deadLetters[i].Payload = ""
+	}
+	return deadLetters, nil
+}
+
+func (s *Service) GetDeadLetter(ctx context.Context, id int64) (*model.DeadLetterDetail, error) {
+	dl, err := s.r.WithContext(ctx).GetDeadLetter(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+
+	audit, err := s.r.WithContext(ctx).GetDeadLetterAudits(id)
+	if err != nil {
+		s.l.Error("failed to get dead letter audit", "error", err, "id", id)
+		return nil, fmt.Errorf("failed to get dead letter audit: %w", err)
+	}
+
+	return &model.DeadLetterDetail{DeadLetter: *dl, Audit: audit}, nil
+}
+
+// RepublishDeadLetter writes a dead letter, or its edited payload, back to
+// its source topic through the outbox and records the action
+func (s *Service) RepublishDeadLetter(ctx context.Context, id int64, req model.RepublishDeadLetterRequest) error {
+	if err := deadletter.Republish(s.r.WithContext(ctx), id, req); err != nil {
+		s.l.Error("failed to republish dead letter", "error", err, "id", id)
+		return fmt.Errorf("failed to republish dead letter: %w", err)
+	}
+
+	s.l.Info("Republished dead letter", "id", id, "actor", req.Actor)
+	return nil
+}
+
+// DiscardDeadLetter marks a dead letter as discarded and records the action
+func (s *Service) DiscardDeadLetter(ctx context.Context, id int64, req model.DiscardDeadLetterRequest) error {
+	if err := deadletter.Discard(s.r.WithContext(ctx), id, req); err != nil {
+		s.l.Error("failed to discard dead letter", "error", err, "id", id)
+		return fmt.Errorf("failed to discard dead letter: %w", err)
 	}
 
+	s.l.Info("Discarded dead letter", "id", id, "actor", req.Actor)
 	return nil
 }
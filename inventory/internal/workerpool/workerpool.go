@@ -0,0 +1,89 @@
+// Package workerpool runs jobs concurrently while keeping the jobs of a key in
+// order
+package workerpool
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Pool runs jobs on a fixed number of workers. Jobs with the same key always
+// run on the same worker, one after another in the order they were submitted,
+// while jobs with different keys run concurrently.
+type Pool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+
+	// closing is closed by Close to release blocked submitters, mu keeps the
+	// queues open until every submitter has left
+	closing   chan struct{}
+	closeOnce sync.Once
+	mu        sync.RWMutex
+}
+
+// New creates a pool with the given number of workers, each queueing up to
+// queueSize jobs before Submit blocks
+func New(workers, queueSize int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{
+		queues:  make([]chan func(), workers),
+		closing: make(chan struct{}),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// Submit queues job on the worker of key, it blocks while that worker's queue
+// is full. It returns false without queueing job once the pool is closing,
+// including when Close is called while Submit is blocked.
+func (p *Pool) Submit(key []byte, job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	select {
+	case <-p.closing:
+		return false
+	default:
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- job:
+		return true
+	case <-p.closing:
+		return false
+	}
+}
+
+// Close stops accepting jobs and waits until every queued job has run, it
+// may be called more than once
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+
+		// Blocked submitters return once closing is closed, the queues
+		// are closed after the last one left
+		p.mu.Lock()
+		for _, q := range p.queues {
+			close(q)
+		}
+		p.mu.Unlock()
+	})
+	p.wg.Wait()
+}
+
+// work runs the jobs of a queue until it is closed
+func (p *Pool) work(queue chan func()) {
+	defer p.wg.Done()
+	for job := range queue {
+		job()
+	}
+}
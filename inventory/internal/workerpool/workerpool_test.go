@@ -0,0 +1,94 @@
+package workerpool
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitKeepsTheOrderOfAKey(t *testing.T) {
+	p := New(4, 2)
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for _, key := range keys {
+			i, key := i, key
+			if !p.Submit([]byte(key), func() {
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			}) {
+				t.Fatal("Submit refused a job of an open pool")
+			}
+		}
+	}
+	p.Close()
+
+	for _, key := range keys {
+		if len(got[key]) != 100 {
+			t.Fatalf("got %d jobs of key %s, want 100", len(got[key]), key)
+		}
+		for i, v := range got[key] {
+			if v != i {
+				t.Fatalf("job %d of key %s ran as number %d", v, key, i)
+			}
+		}
+	}
+}
+
+func TestCloseReleasesABlockedSubmit(t *testing.T) {
+	p := New(1, 1)
+
+	// The worker is stuck in the first job and the queue holds the second,
+	// the third submit blocks
+	release := make(chan struct{})
+	ran := make(chan struct{}, 3)
+	job := func() {
+		<-release
+		ran <- struct{}{}
+	}
+	p.Submit(nil, job)
+	p.Submit(nil, job)
+
+	submitted := make(chan bool)
+	go func() { submitted <- p.Submit(nil, job) }()
+
+	select {
+	case <-submitted:
+		t.Fatal("Submit returned although the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case ok := <-submitted:
+		if ok {
+			t.Fatal("Submit accepted a job of a closing pool")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submit stayed blocked after Close")
+	}
+
+	// Close waits for the queued jobs
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if len(ran) != 2 {
+		t.Fatalf("got %d jobs run, want the 2 queued before Close", len(ran))
+	}
+
+	if p.Submit(nil, job) {
+		t.Fatal("Submit accepted a job after Close")
+	}
+	p.Close()
+}
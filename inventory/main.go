@@ -3,14 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"expvar"
 	"fmt"
+	"inventory/internal/admin"
+	"inventory/internal/env"
 	"inventory/internal/handler"
 	"inventory/internal/kafka"
 	"inventory/internal/logger"
+	"inventory/internal/messaging"
+	"inventory/internal/metrics"
 	"inventory/internal/repository"
+	"inventory/internal/reservation"
 	"inventory/internal/routes"
 	"inventory/internal/server"
 	"inventory/internal/service"
+	"inventory/internal/tracing"
 	"log"
 	"net/http"
 	"os"
@@ -54,16 +61,62 @@ func main() {
 
 	logger := logger.Init()
 
+	// Spans are exported with OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	// and written to TRACE_FILE when it is set
+	shutdownTracing, err := tracing.Init(context.Background(), "inventory")
+	if err != nil {
+		logger.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 
 	repository := repository.New(logger, db)
 	service := service.New(logger, repository)
-	handler := handler.New(logger, service)
+	// Messages go through Kafka unless MESSAGING_BACKEND selects the
+	// Postgres queue at MESSAGING_POSTGRES_URL or an in-process broker
+	messagingConfig, err := messaging.ConfigFromEnv()
+	if err != nil {
+		logger.Error("Invalid messaging configuration", "error", err)
+		os.Exit(1)
+	}
+	broker, err := messaging.New(messagingConfig)
+	if err != nil {
+		logger.Error("Failed to create message broker", "error", err)
+		os.Exit(1)
+	}
+	defer broker.Close()
+
+	// Track the progress of every consumer for the health check, the
+	// consumers endpoint, the consumers expvar and the metrics
+	monitor := messaging.NewMonitor(messagingConfig.StallTimeout)
+	broker = messaging.WithMonitor(broker, monitor)
+	expvar.Publish("consumers", expvar.Func(func() any { return monitor.Stats() }))
+	if err := messaging.RegisterMonitor(monitor); err != nil {
+		logger.Error("Failed to register consumer metrics", "error", err)
+		os.Exit(1)
+	}
+
+	handler := handler.New(logger, service, monitor)
+
+	// The dead letter admin API accepts the operators of ADMIN_TOKENS
+	adminTokens, err := admin.TokensFromEnv()
+	if err != nil {
+		logger.Error("Invalid admin configuration", "error", err)
+		os.Exit(1)
+	}
 
-	routes.RegisterRoutes(mux, handler)
+	routes.RegisterRoutes(mux, handler, adminTokens)
 
 	// Create Kafka server with repository directly
-	kafkaServer, err := kafka.New(logger, repository)
+	kafkaServer, err := kafka.New(logger, repository, broker)
 	if err != nil {
 		logger.Error("Failed to create Kafka server", "error", err)
 		os.Exit(1)
@@ -80,13 +133,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Start the sweeper releasing expired reservations
+	sweepInterval, err := env.Interval("RESERVATION_SWEEP_INTERVAL", 10*time.Second)
+	if err != nil {
+		logger.Error("Invalid reservation sweep interval", "error", err)
+		os.Exit(1)
+	}
+	sweeper := reservation.NewSweeper(logger, repository, sweepInterval)
+	if err := sweeper.Start(ctx); err != nil {
+		logger.Error("Failed to start reservation sweeper", "error", err)
+		os.Exit(1)
+	}
+
 	// Create a channel to receive the server instance from server.Init
 	serverReady := make(chan struct{})
 
 	// Start the HTTP server in a goroutine
 	go func() {
 		logger.Info("Starting HTTP server at", "port", port)
-		err := server.Init(port, mux)
+		err := server.Init(port, tracing.Middleware(metrics.Middleware(mux)))
 		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Failed to start HTTP server", "error", err)
 			os.Exit(1)
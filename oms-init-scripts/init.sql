@@ -18,6 +18,66 @@ CREATE TABLE IF NOT EXISTS order_sagas (
     order_id INTEGER PRIMARY KEY,
     status VARCHAR(20) NOT NULL,
     step INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    deadline TIMESTAMP
+);
+
+CREATE INDEX ON order_sagas (deadline) WHERE deadline IS NOT NULL;
+
+
+CREATE TABLE IF NOT EXISTS order_saga_steps (
+    order_id INTEGER NOT NULL,
+    product_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (order_id, product_id),
+    FOREIGN KEY (order_id) REFERENCES order_sagas(order_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    headers JSONB,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX ON outbox (id) WHERE sent_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    partition integer NOT NULL,
+    "offset" bigint NOT NULL,
+    source_topic VARCHAR(255) NOT NULL,
+    source_partition integer NOT NULL,
+    source_offset bigint NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    headers JSONB,
+    payload BYTEA NOT NULL,
+    error TEXT NOT NULL,
+    attempts integer NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    failed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    UNIQUE (topic, partition, "offset")
+);
+
+CREATE INDEX ON dead_letters (status, source_topic);
+
+CREATE TABLE IF NOT EXISTS dead_letter_audit (
+    id BIGSERIAL PRIMARY KEY,
+    dead_letter_id bigint NOT NULL REFERENCES dead_letters (id),
+    action VARCHAR(30) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    note TEXT,
+    payload BYTEA,
     created_at TIMESTAMP NOT NULL
 );
 
+CREATE INDEX ON dead_letter_audit (dead_letter_id);
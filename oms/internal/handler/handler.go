@@ -2,26 +2,40 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"oms/internal/admin"
+	"oms/internal/deadletter"
+	"oms/internal/messaging"
 	"oms/internal/model"
 	"oms/internal/service"
+	"strconv"
 )
 
 type Handler struct {
 	l *slog.Logger
 	s service.ServiceI
+	m *messaging.Monitor
 }
 
-func New(l *slog.Logger, s service.ServiceI) *Handler {
+func New(l *slog.Logger, s service.ServiceI, m *messaging.Monitor) *Handler {
 	return &Handler{
 		l: l,
 		s: s,
+		m: m,
 	}
 }
 
+// Health fails while one of the consumers of the service is stalled
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	if err := h.m.Healthy(); err != nil {
+		h.l.Error("Health check failed", "error", err)
+		h.sendError(w, http.StatusServiceUnavailable, "Consumer stalled", err.Error())
+		return
+	}
+
 	_, err := w.Write([]byte("OK"))
 	if err != nil {
 		h.l.Error("Failed to write response", "error", err)
@@ -38,7 +52,11 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create order using service
-	if err := h.s.CreateOrderFromRequest(req); err != nil {
+	if err := h.s.CreateOrderFromRequest(r.Context(), req); err != nil {
+		if errors.Is(err, service.ErrOutOfStock) {
+			h.sendError(w, http.StatusConflict, "Not enough stock", err.Error())
+			return
+		}
 		h.l.Error("failed to create order", "error", err)
 		h.sendError(w, http.StatusInternalServerError, "Failed to create order", err.Error())
 		return
@@ -49,7 +67,7 @@ func (h *Handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := h.s.GetOrders()
+	orders, err := h.s.GetOrders(r.Context())
 	if err != nil {
 		h.l.Error("failed to get orders", "error", err)
 		h.sendError(w, http.StatusInternalServerError, "Failed to get orders", err.Error())
@@ -60,6 +78,103 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(orders)
 }
 
+// GetConsumers returns the lag and progress of the consumers of the service
+func (h *Handler) GetConsumers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.m.Stats())
+}
+
+func (h *Handler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deadLetters, err := h.s.GetDeadLetters(r.Context(), query.Get("status"), query.Get("topic"))
+	if err != nil {
+		h.l.Error("failed to get dead letters", "error", err)
+		h.sendError(w, http.StatusInternalServerError, "Failed to get dead letters", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deadLetters)
+}
+
+func (h *Handler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, "Invalid dead letter ID", err.Error())
+		return
+	}
+
+	dl, err := h.s.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		h.l.Error("failed to get dead letter", "error", err, "id", id)
+		h.sendError(w, deadLetterErrorStatus(err), "Failed to get dead letter", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dl)
+}
+
+func (h *Handler) RepublishDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, "Invalid dead letter ID", err.Error())
+		return
+	}
+
+	var req model.RepublishDeadLetterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	req.Actor = admin.Actor(r.Context())
+
+	if err := h.s.RepublishDeadLetter(r.Context(), id, req); err != nil {
+		h.l.Error("failed to republish dead letter", "error", err, "id", id)
+		h.sendError(w, deadLetterErrorStatus(err), "Failed to republish dead letter", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, "Invalid dead letter ID", err.Error())
+		return
+	}
+
+	var req model.DiscardDeadLetterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	req.Actor = admin.Actor(r.Context())
+
+	if err := h.s.DiscardDeadLetter(r.Context(), id, req); err != nil {
+		h.l.Error("failed to discard dead letter", "error", err, "id", id)
+		h.sendError(w, deadLetterErrorStatus(err), "Failed to discard dead letter", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deadLetterErrorStatus maps dead letter errors to HTTP status codes
+func deadLetterErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, deadletter.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, deadletter.ErrResolved):
+		return http.StatusConflict
+	case errors.Is(err, deadletter.ErrActorRequired):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (h *Handler) sendError(w http.ResponseWriter, status int, message string, details interface{}) {
 	var detailsStr string
 	if details != nil {
@@ -1,6 +1,11 @@
 package kafka
 
-import "time"
+import (
+	"fmt"
+	"oms/internal/envelope"
+	"oms/internal/model"
+	"time"
+)
 
 // InventoryEvent represents an inventory-related event
 type InventoryEvent struct {
@@ -9,3 +14,125 @@ type InventoryEvent struct {
 	Quantity  int       `json:"quantity"`
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// ReserveOrderEvent asks inventory to reserve every item of an order at once
+type ReserveOrderEvent struct {
+	OrderID   int                `json:"order_id"`
+	Items     []ReserveOrderItem `json:"items"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// ReserveOrderItem is a single item of a ReserveOrderEvent
+type ReserveOrderItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// CheckStockEvent asks inventory whether every item is in stock, nothing is
+// reserved
+type CheckStockEvent struct {
+	Items     []ReserveOrderItem `json:"items"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// messageTypes maps the request topics to the type of their messages
+var messageTypes = map[string]string{
+	ReserveInventoryTopic: ReserveInventoryMessageType,
+	ReserveOrderTopic:     ReserveOrderMessageType,
+	ConfirmInventoryTopic: ConfirmInventoryMessageType,
+	CancelInventoryTopic:  CancelInventoryMessageType,
+	ReleaseInventoryTopic: ReleaseInventoryMessageType,
+	CheckStockTopic:       CheckStockMessageType,
+}
+
+// NewReserveOrderMessage builds the outbox message reserving all steps of an order
+func NewReserveOrderMessage(orderID int, steps []model.OrderSagaStep) (model.OutboxMessage, error) {
+	now := time.Now()
+	event := ReserveOrderEvent{
+		OrderID:   orderID,
+		Items:     make([]ReserveOrderItem, 0, len(steps)),
+		Timestamp: now,
+	}
+	for _, step := range steps {
+		event.Items = append(event.Items, ReserveOrderItem{
+			ProductID: step.ProductID,
+			Quantity:  step.Quantity,
+		})
+	}
+
+	return newMessage(ReserveOrderTopic, fmt.Sprintf("%d", orderID), orderCorrelationID(orderID), event)
+}
+
+// NewCheckStockMessage builds the message of a stock check of items
+func NewCheckStockMessage(correlationID string, items []model.OrderItem) (model.OutboxMessage, error) {
+	event := CheckStockEvent{
+		Items:     make([]ReserveOrderItem, 0, len(items)),
+		Timestamp: time.Now(),
+	}
+	for _, item := range items {
+		event.Items = append(event.Items, ReserveOrderItem{
+			ProductID: item.Product.ID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	return newMessage(CheckStockTopic, correlationID, correlationID, event)
+}
+
+// NewConfirmInventoryMessage builds the outbox message of a confirm inventory request
+func NewConfirmInventoryMessage(orderID int, productID int, quantity int) (model.OutboxMessage, error) {
+	return newInventoryEventMessage(ConfirmInventoryTopic, orderCorrelationID(orderID), orderID, productID, quantity)
+}
+
+// NewCancelInventoryMessage builds the outbox message of a cancel inventory request
+func NewCancelInventoryMessage(orderID int, productID int, quantity int) (model.OutboxMessage, error) {
+	return newInventoryEventMessage(CancelInventoryTopic, orderCorrelationID(orderID), orderID, productID, quantity)
+}
+
+// NewReleaseInventoryMessage builds the outbox message of a release inventory request
+func NewReleaseInventoryMessage(orderID int, productID int, quantity int) (model.OutboxMessage, error) {
+	return newInventoryEventMessage(ReleaseInventoryTopic, orderCorrelationID(orderID), orderID, productID, quantity)
+}
+
+// newInventoryEventMessage builds an outbox message carrying an InventoryEvent
+func newInventoryEventMessage(topic string, correlationID string, orderID int, productID int, quantity int) (model.OutboxMessage, error) {
+	event := InventoryEvent{
+		OrderID:   orderID,
+		ProductID: productID,
+		Quantity:  quantity,
+		Timestamp: time.Now(),
+	}
+	return newMessage(topic, fmt.Sprintf("%d-%d", orderID, productID), correlationID, event)
+}
+
+// newMessage wraps data in an envelope and builds the outbox message
+// publishing it to topic
+func newMessage(topic string, key string, correlationID string, data any) (model.OutboxMessage, error) {
+	msgType, ok := messageTypes[topic]
+	if !ok {
+		return model.OutboxMessage{}, fmt.Errorf("no message type for topic %s", topic)
+	}
+
+	env, err := envelope.New(msgType, SchemaVersion, Producer, correlationID, data)
+	if err != nil {
+		return model.OutboxMessage{}, err
+	}
+	value, err := env.Marshal()
+	if err != nil {
+		return model.OutboxMessage{}, err
+	}
+
+	return model.OutboxMessage{
+		Topic:     topic,
+		Key:       key,
+		Headers:   env.Headers(),
+		Payload:   value,
+		CreatedAt: env.Time,
+	}, nil
+}
+
+// orderCorrelationID returns the correlation ID shared by all messages of the
+// saga of an order
+func orderCorrelationID(orderID int) string {
+	return fmt.Sprintf("order-%d", orderID)
+}
@@ -2,53 +2,75 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
+	"oms/internal/deadletter"
+	"oms/internal/envelope"
+	"oms/internal/messaging"
 	"oms/internal/model"
-	"oms/internal/repository"
 	"time"
 
-	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// ResponseProcessor applies inventory responses to the order they belong to
+type ResponseProcessor interface {
+	HandleInventoryResponse(ctx context.Context, response model.InventoryResponse) error
+}
+
+// responseGroupID is the consumer group reading the inventory responses
+const responseGroupID = "oms-group"
+
 // InventoryResponseHandler handles processing inventory responses
 type InventoryResponseHandler struct {
-	l      *slog.Logger
-	r      repository.RepositoryI
-	reader *kafka.Reader
+	l          *slog.Logger
+	p          ResponseProcessor
+	subscriber messaging.Subscriber
+	dlq        *deadletter.Publisher
 }
 
+// Processing of a response is attempted processingAttempts times, waiting
+// processingBackoff after the first failure and doubling the wait after each
+// further one
+const (
+	processingAttempts = 3
+	processingBackoff  = 200 * time.Millisecond
+)
+
+// publishBackoff is the wait between attempts to write a message to the
+// dead-letter topic
+const publishBackoff = time.Second
+
 // NewInventoryResponseHandler creates a new inventory response handler
-func NewInventoryResponseHandler(l *slog.Logger, r repository.RepositoryI, brokers []string) *InventoryResponseHandler {
-	// Create a reader for receiving responses
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  brokers,
-		Topic:    InventoryResponseTopic,
-		GroupID:  "oms-group",
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-		MaxWait:  time.Second,
+func NewInventoryResponseHandler(l *slog.Logger, p ResponseProcessor, dlq *deadletter.Publisher, broker messaging.Broker, commitInterval time.Duration) *InventoryResponseHandler {
+	// Create a subscriber for receiving responses, offsets are committed
+	// after processing, batched every commitInterval or one by one when it
+	// is zero
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{
+		Topics:         []string{InventoryResponseTopic},
+		GroupID:        responseGroupID,
+		CommitInterval: commitInterval,
 	})
 
 	return &InventoryResponseHandler{
-		l:      l,
-		r:      r,
-		reader: reader,
+		l:          l,
+		p:          p,
+		subscriber: subscriber,
+		dlq:        dlq,
 	}
 }
 
 // Close closes the inventory response handler
 func (h *InventoryResponseHandler) Close() error {
-	if err := h.reader.Close(); err != nil {
-		return fmt.Errorf("failed to close reader: %w", err)
+	if err := h.subscriber.Close(); err != nil {
+		return fmt.Errorf("failed to close subscriber: %w", err)
 	}
 	return nil
 }
 
 // Start starts the inventory response handler
 func (h *InventoryResponseHandler) Start(ctx context.Context) error {
-	h.l.Info("Starting inventory response handler")
+	h.l.InfoContext(ctx, "Starting inventory response handler")
 
 	go h.handleMessages(ctx)
 
@@ -57,59 +79,79 @@ func (h *InventoryResponseHandler) Start(ctx context.Context) error {
 
 // handleMessages handles incoming inventory response messages
 func (h *InventoryResponseHandler) handleMessages(ctx context.Context) {
-	h.l.Info("Starting to handle inventory responses")
+	h.l.InfoContext(ctx, "Starting to handle inventory responses")
 
 	for {
 		select {
 		case <-ctx.Done():
-			h.l.Info("Context canceled, stopping inventory response handler")
+			h.l.InfoContext(ctx, "Context canceled, stopping inventory response handler")
 			return
 		default:
 			// Read message
-			h.l.Info("Waiting for inventory response...")
-			msg, err := h.reader.ReadMessage(ctx)
+			h.l.InfoContext(ctx, "Waiting for inventory response...")
+			msg, err := h.subscriber.Fetch(ctx)
 			if err != nil {
 				if err == context.Canceled {
-					h.l.Info("Context canceled while reading message")
+					h.l.InfoContext(ctx, "Context canceled while fetching message")
 					return
 				}
-				h.l.Error("failed to read message", "error", err)
+				h.l.ErrorContext(ctx, "failed to fetch message", "error", err)
 				continue
 			}
 
-			h.l.Info("Received inventory response", "key", string(msg.Key), "value_length", len(msg.Value))
+			// A response that could neither be applied nor dead-lettered
+			// is left uncommitted and the handler stops, it is delivered
+			// again after a restart
+			if err := h.handle(ctx, msg); err != nil {
+				h.l.ErrorContext(ctx, "message left uncommitted, stopping inventory response handler", "error", err, "partition", msg.Partition, "offset", msg.Offset)
+				return
+			}
 
-			// Parse response
-			var response model.InventoryResponse
-			if err := json.Unmarshal(msg.Value, &response); err != nil {
-				h.l.Error("failed to unmarshal response", "error", err)
-				continue
+			// The offset is committed only once the saga state is durable,
+			// so a response interrupted by a crash is delivered again
+			if err := h.subscriber.Commit(ctx, msg); err != nil {
+				h.l.ErrorContext(ctx, "failed to commit message", "error", err, "partition", msg.Partition, "offset", msg.Offset)
 			}
+		}
+	}
+}
 
-			h.l.Info("Processing inventory response", "order_id", response.OrderID, "product_id", response.ProductID, "success", response.Success)
+// handle processes a single inventory response in the trace of the request
+// it answers. It returns an error when the response could neither be applied
+// nor dead-lettered.
+func (h *InventoryResponseHandler) handle(ctx context.Context, msg messaging.Message) error {
+	ctx, span := messaging.StartProcessing(ctx, responseGroupID, msg)
+	defer span.End()
+
+	h.l.InfoContext(ctx, "Received inventory response", "key", string(msg.Key), "value_length", len(msg.Value))
+
+	// Parse response
+	var response model.InventoryResponse
+	env, err := envelope.Open(msg, InventoryResponseMessageType, SchemaVersion, &response)
+	if err != nil {
+		h.l.ErrorContext(ctx, "failed to open response", "error", err)
+		return h.deadLetter(ctx, msg, err, 1)
+	}
 
-			// Process response
-			if response.Success {
-				h.l.Info("Inventory operation successful", "order_id", response.OrderID, "product_id", response.ProductID)
+	h.l.InfoContext(ctx, "Processing inventory response", "message_id", env.ID, "correlation_id", env.CorrelationID, "order_id", response.OrderID, "product_id", response.ProductID, "operation", response.Operation, "success", response.Success)
 
-				// Update saga status
-				err = h.r.UpdateSagaStatus(response.OrderID, "COMPLETED")
-				if err != nil {
-					h.l.Error("failed to update saga status", "error", err, "order_id", response.OrderID)
-				} else {
-					h.l.Info("Updated saga status to COMPLETED", "order_id", response.OrderID)
-				}
-			} else {
-				h.l.Error("Inventory operation failed", "order_id", response.OrderID, "product_id", response.ProductID, "error", response.Error)
-
-				// Update saga status
-				err = h.r.UpdateSagaStatus(response.OrderID, "FAILED")
-				if err != nil {
-					h.l.Error("failed to update saga status", "error", err, "order_id", response.OrderID)
-				} else {
-					h.l.Info("Updated saga status to FAILED", "order_id", response.OrderID)
-				}
-			}
-		}
+	// Failures are retried, a response that keeps failing is
+	// dead-lettered and the saga is left to its timeout
+	attempts, err := deadletter.Retry(ctx, processingAttempts, processingBackoff, func() error {
+		return h.p.HandleInventoryResponse(ctx, response)
+	})
+	if err != nil {
+		h.l.ErrorContext(ctx, "failed to process inventory response", "error", err, "order_id", response.OrderID, "product_id", response.ProductID, "attempts", attempts)
+		span.SetStatus(codes.Error, err.Error())
+		return h.deadLetter(ctx, msg, err, attempts)
 	}
+	return nil
+}
+
+// deadLetter moves an unprocessable message to the dead-letter topic of its
+// topic, trying again until it succeeds or the context is canceled
+func (h *InventoryResponseHandler) deadLetter(ctx context.Context, msg messaging.Message, reason error, attempts int) error {
+	return deadletter.RetryUntil(ctx, publishBackoff, func() error {
+		return h.dlq.Publish(ctx, msg, reason, attempts)
+	})
 }
@@ -2,62 +2,110 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"time"
 
+	"oms/internal/deadletter"
+	"oms/internal/envelope"
+	"oms/internal/messaging"
 	"oms/internal/model"
 	"oms/internal/repository"
-
-	"github.com/segmentio/kafka-go"
+	"oms/internal/reqreply"
 )
 
 const (
 	// Topic names
 	ReserveInventoryTopic  = "oms.reserve-inventory.0"
+	ReserveOrderTopic      = "oms.reserve-order.0"
+	ConfirmInventoryTopic  = "oms.confirm-inventory.0"
+	CancelInventoryTopic   = "oms.cancel-inventory.0"
 	ReleaseInventoryTopic  = "oms.release-inventory.0"
 	InventoryResponseTopic = "oms.order-item-stock-reserved.0"
+	CheckStockTopic        = "oms.check-stock.0"
+	InventoryReplyTopic    = "oms.inventory-replies.0"
+)
+
+// provisionedTopics are the topics OMS publishes to and consumes from
+var provisionedTopics = []string{
+	ReserveInventoryTopic,
+	ReserveOrderTopic,
+	ConfirmInventoryTopic,
+	CancelInventoryTopic,
+	ReleaseInventoryTopic,
+	InventoryResponseTopic,
+	deadletter.Topic(InventoryResponseTopic),
+	CheckStockTopic,
+	InventoryReplyTopic,
+}
+
+// provisionTimeout bounds the creation of missing topics at startup
+const provisionTimeout = 30 * time.Second
+
+const (
+	// Producer is the producer name OMS puts on its messages
+	Producer = "oms"
+
+	// SchemaVersion is the envelope schema version produced, and the highest
+	// one understood, for every message type
+	SchemaVersion = 1
+
+	// Message types
+	ReserveInventoryMessageType  = "oms.reserve-inventory"
+	ReserveOrderMessageType      = "oms.reserve-order"
+	ConfirmInventoryMessageType  = "oms.confirm-inventory"
+	CancelInventoryMessageType   = "oms.cancel-inventory"
+	ReleaseInventoryMessageType  = "oms.release-inventory"
+	InventoryResponseMessageType = "inventory.inventory-response"
+	CheckStockMessageType        = "oms.check-stock"
+	StockCheckMessageType        = "inventory.stock-check"
 )
 
+// stockCheckTimeout is how long an order waits for the stock check of
+// inventory before it is left to the saga
+const stockCheckTimeout = 2 * time.Second
+
 // KafkaClient handles Kafka operations
 type KafkaClient struct {
-	l        *slog.Logger
-	r        repository.RepositoryI
-	producer *InventoryProducer
-	reader   *kafka.Reader
+	l         *slog.Logger
+	r         repository.RepositoryI
+	producer  *InventoryProducer
+	requester *reqreply.Requester
 }
 
-// New creates a new Kafka client
-func New(l *slog.Logger, r repository.RepositoryI) (*KafkaClient, error) {
-	// Get Kafka brokers from environment or use default
-	brokers := []string{"localhost:9092"}
-	if envBrokers := os.Getenv("KAFKA_BROKERS"); envBrokers != "" {
-		brokers = []string{envBrokers}
+// New creates a new Kafka client publishing and consuming through broker
+func New(l *slog.Logger, r repository.RepositoryI, broker messaging.Broker) (*KafkaClient, error) {
+	// Create the topics that do not exist yet
+	ctx, cancel := context.WithTimeout(context.Background(), provisionTimeout)
+	defer cancel()
+	if err := messaging.EnsureTopics(ctx, broker, provisionedTopics...); err != nil {
+		return nil, fmt.Errorf("failed to provision topics: %w", err)
 	}
 
 	// Create the inventory producer
-	producer := NewInventoryProducer(l, brokers)
-
-	// Create a reader for receiving responses
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  brokers,
-		Topic:    InventoryResponseTopic,
-		GroupID:  "oms-group",
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-		MaxWait:  time.Second,
-	})
+	producer := NewInventoryProducer(l, broker)
+
+	// Every instance reads all replies with its own consumer group
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	requester := reqreply.NewRequester(l, broker, InventoryReplyTopic, "oms-replies-"+hostname)
 
 	return &KafkaClient{
-		l:        l,
-		r:        r,
-		producer: producer,
-		reader:   reader,
+		l:         l,
+		r:         r,
+		producer:  producer,
+		requester: requester,
 	}, nil
 }
 
+// Start starts consuming replies to inventory requests
+func (k *KafkaClient) Start(ctx context.Context) error {
+	return k.requester.Start(ctx)
+}
+
 // Close closes the Kafka client
 func (k *KafkaClient) Close() error {
 	// Close the producer
@@ -66,92 +114,52 @@ func (k *KafkaClient) Close() error {
 		return fmt.Errorf("failed to close producer: %w", err)
 	}
 
-	// Close the reader
-	if err := k.reader.Close(); err != nil {
-		k.l.Error("failed to close reader", "error", err)
-		return fmt.Errorf("failed to close reader: %w", err)
+	// Close the requester
+	if err := k.requester.Close(); err != nil {
+		k.l.Error("failed to close requester", "error", err)
+		return fmt.Errorf("failed to close requester: %w", err)
 	}
 
 	return nil
 }
 
-// ReserveInventory sends a reserve inventory request to Kafka
-func (k *KafkaClient) ReserveInventory(orderID int, productID int, quantity int) error {
-	return k.producer.ReserveInventory(orderID, productID, quantity)
+// Publish writes outbox messages to Kafka
+func (k *KafkaClient) Publish(ctx context.Context, msgs ...model.OutboxMessage) error {
+	return k.producer.Publish(ctx, msgs...)
 }
 
-// ReleaseInventory sends a release inventory request to Kafka
-func (k *KafkaClient) ReleaseInventory(orderID int, productID int, quantity int) error {
-	return k.producer.ReleaseInventory(orderID, productID, quantity)
-}
+// CheckStock asks inventory whether every item is in stock and waits for its
+// reply. The reply is correlated by ID and sent to the reply topic of this
+// process instead of the saga's response topic.
+func (k *KafkaClient) CheckStock(ctx context.Context, items []model.OrderItem) (*model.StockCheckResponse, error) {
+	// Every request needs its own correlation ID to be matched with its reply
+	correlationID, err := envelope.NewID()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := NewCheckStockMessage(correlationID, items)
+	if err != nil {
+		return nil, err
+	}
 
-// WaitForInventoryResponse waits for a response from the inventory service
-func (k *KafkaClient) WaitForInventoryResponse(orderID int, productID int, timeout time.Duration) error {
-	k.l.Info("Waiting for inventory response", "order_id", orderID, "product_id", productID, "timeout", timeout)
+	k.l.InfoContext(ctx, "Checking stock", "items", len(items), "correlation_id", correlationID, "timeout", stockCheckTimeout)
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	reply, err := k.requester.Request(ctx, messaging.Message{
+		Topic:   msg.Topic,
+		Key:     []byte(msg.Key),
+		Value:   msg.Payload,
+		Headers: envelope.ToHeaders(msg.Headers),
+	}, stockCheckTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check stock: %w", err)
+	}
 
-	// Get broker addresses from the existing reader
-	brokers := k.reader.Config().Brokers
-
-	// Create a dedicated reader for this response
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  brokers,
-		GroupID:  fmt.Sprintf("oms-response-%d-%d", orderID, productID), // Unique group ID for this request
-		Topic:    InventoryResponseTopic,
-		MaxBytes: 10e6, // 10MB
-		MinBytes: 10e3, // 10KB
-		MaxWait:  time.Second,
-	})
-	defer reader.Close()
-
-	k.l.Info("Created dedicated reader for inventory response", "order_id", orderID, "product_id", productID, "brokers", brokers)
-
-	// Read messages until we find a match or context is canceled
-	for {
-		select {
-		case <-ctx.Done():
-			k.l.Error("Context deadline exceeded while waiting for inventory response", "order_id", orderID, "product_id", productID)
-			return fmt.Errorf("timeout waiting for inventory response: %w", ctx.Err())
-		default:
-			// Read message with a shorter timeout to allow for more frequent checking of context
-			readCtx, readCancel := context.WithTimeout(ctx, 1*time.Second)
-			msg, err := reader.ReadMessage(readCtx)
-			readCancel()
-
-			if err != nil {
-				if err == context.DeadlineExceeded || err == context.Canceled {
-					// This is just the short read timeout or context canceled, continue waiting
-					continue
-				}
-				k.l.Error("failed to read message", "error", err)
-				continue
-			}
-
-			k.l.Info("Received message from Kafka", "key", string(msg.Key), "value_length", len(msg.Value))
-
-			// Check if this is the response we're looking for
-			expectedKey := fmt.Sprintf("%d-%d", orderID, productID)
-			if string(msg.Key) == expectedKey {
-				k.l.Info("Found matching response", "order_id", orderID, "product_id", productID)
-				var response model.InventoryResponse
-				if err := json.Unmarshal(msg.Value, &response); err != nil {
-					k.l.Error("Failed to unmarshal response", "error", err)
-					return fmt.Errorf("failed to unmarshal response: %w", err)
-				}
-
-				if !response.Success {
-					k.l.Error("Inventory operation failed", "order_id", orderID, "product_id", productID, "error", response.Error)
-					return fmt.Errorf("inventory operation failed: %s", response.Error)
-				}
-
-				k.l.Info("Received successful inventory response", "order_id", orderID, "product_id", productID)
-				return nil
-			} else {
-				k.l.Info("Received response for different key", "expected", expectedKey, "received", string(msg.Key))
-			}
-		}
+	var response model.StockCheckResponse
+	if _, err := envelope.Open(reply, StockCheckMessageType, SchemaVersion, &response); err != nil {
+		return nil, fmt.Errorf("failed to open stock check: %w", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("inventory failed to check stock: %s", response.Error)
 	}
+	return &response, nil
 }
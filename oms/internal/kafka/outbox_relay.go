@@ -0,0 +1,109 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"oms/internal/model"
+	"oms/internal/repository"
+)
+
+// outboxBatchSize is the number of outbox messages published per transaction
+const outboxBatchSize = 100
+
+// OutboxPublisher publishes stored outbox messages
+type OutboxPublisher interface {
+	// Publish returns once the broker acknowledged every message
+	Publish(ctx context.Context, msgs ...model.OutboxMessage) error
+}
+
+// OutboxRelay publishes pending outbox messages to Kafka and marks them sent.
+// A message is marked only after Kafka acknowledged it, so every committed
+// message is delivered at least once.
+type OutboxRelay struct {
+	l        *slog.Logger
+	r        repository.RepositoryI
+	p        OutboxPublisher
+	interval time.Duration
+}
+
+// NewOutboxRelay creates a new outbox relay
+func NewOutboxRelay(l *slog.Logger, r repository.RepositoryI, p OutboxPublisher, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		l:        l,
+		r:        r,
+		p:        p,
+		interval: interval,
+	}
+}
+
+// Start starts the outbox relay
+func (o *OutboxRelay) Start(ctx context.Context) error {
+	o.l.InfoContext(ctx, "Starting outbox relay", "interval", o.interval)
+
+	go o.run(ctx)
+
+	return nil
+}
+
+// run relays pending messages until the context is canceled
+func (o *OutboxRelay) run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.l.InfoContext(ctx, "Context canceled, stopping outbox relay")
+			return
+		case <-ticker.C:
+			for {
+				sent, err := o.relayBatch(ctx)
+				if err != nil {
+					o.l.ErrorContext(ctx, "failed to relay outbox messages", "error", err)
+					break
+				}
+				if sent < outboxBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// relayBatch publishes one batch of pending messages in order with a single
+// publish and returns how many were sent. The batch is marked sent only once
+// the broker acknowledged all of it, after a failure it is published again
+// as a whole.
+func (o *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	sent := 0
+	err := o.r.WithContext(ctx).WithTx(func(r repository.RepositoryI) error {
+		msgs, err := r.GetPendingOutboxMessages(outboxBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to get pending outbox messages: %w", err)
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := o.p.Publish(publishCtx, msgs...); err != nil {
+			return fmt.Errorf("failed to publish %d outbox messages: %w", len(msgs), err)
+		}
+
+		now := time.Now()
+		for _, msg := range msgs {
+			if err := r.MarkOutboxMessageSent(msg.ID, now); err != nil {
+				return fmt.Errorf("failed to mark outbox message %d sent: %w", msg.ID, err)
+			}
+		}
+
+		o.l.InfoContext(ctx, "Published outbox messages", "count", len(msgs), "first_id", msgs[0].ID, "last_id", msgs[len(msgs)-1].ID)
+		sent = len(msgs)
+		return nil
+	})
+	return sent, err
+}
@@ -2,112 +2,46 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"time"
 
-	"github.com/segmentio/kafka-go"
+	"oms/internal/envelope"
+	"oms/internal/messaging"
+	"oms/internal/model"
 )
 
-// InventoryProducer handles sending inventory-related events to Kafka
+// InventoryProducer handles sending inventory-related events to the broker
 type InventoryProducer struct {
-	l             *slog.Logger
-	reserveWriter *kafka.Writer
-	releaseWriter *kafka.Writer
+	l         *slog.Logger
+	publisher messaging.Publisher
 }
 
 // NewInventoryProducer creates a new inventory producer
-func NewInventoryProducer(l *slog.Logger, brokers []string) *InventoryProducer {
-	// Create writers for sending messages
-	reserveWriter := &kafka.Writer{
-		Addr:         kafka.TCP(brokers...),
-		Topic:        ReserveInventoryTopic,
-		Balancer:     &kafka.LeastBytes{},
-		RequiredAcks: kafka.RequireOne,
-		Async:        false, // Ensure messages are written before returning
-	}
-
-	releaseWriter := &kafka.Writer{
-		Addr:         kafka.TCP(brokers...),
-		Topic:        ReleaseInventoryTopic,
-		Balancer:     &kafka.LeastBytes{},
-		RequiredAcks: kafka.RequireOne,
-		Async:        false, // Ensure messages are written before returning
-	}
-
+func NewInventoryProducer(l *slog.Logger, broker messaging.Broker) *InventoryProducer {
 	return &InventoryProducer{
-		l:             l,
-		reserveWriter: reserveWriter,
-		releaseWriter: releaseWriter,
+		l:         l,
+		publisher: broker.NewPublisher(),
 	}
 }
 
-// ReserveInventory sends a reserve inventory request to Kafka
-func (p *InventoryProducer) ReserveInventory(orderID int, productID int, quantity int) error {
-	event := InventoryEvent{
-		OrderID:   orderID,
-		ProductID: productID,
-		Quantity:  quantity,
-		Timestamp: time.Now(),
-	}
-
-	value, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal reserve inventory event: %w", err)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	err = p.reserveWriter.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(fmt.Sprintf("%d-%d", orderID, productID)),
-		Value: value,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to write reserve inventory message: %w", err)
-	}
-
-	p.l.Info("sent reserve inventory request", "order_id", orderID, "product_id", productID, "quantity", quantity)
-	return nil
-}
-
-// ReleaseInventory sends a release inventory request to Kafka
-func (p *InventoryProducer) ReleaseInventory(orderID int, productID int, quantity int) error {
-	event := InventoryEvent{
-		OrderID:   orderID,
-		ProductID: productID,
-		Quantity:  quantity,
-		Timestamp: time.Now(),
-	}
-
-	value, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal release inventory event: %w", err)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	err = p.releaseWriter.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(fmt.Sprintf("%d-%d", orderID, productID)),
-		Value: value,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to write release inventory message: %w", err)
-	}
-
-	p.l.Info("sent release inventory request", "order_id", orderID, "product_id", productID, "quantity", quantity)
-	return nil
+// Publish writes outbox messages to their topics in one batch
+func (p *InventoryProducer) Publish(ctx context.Context, msgs ...model.OutboxMessage) error {
+	out := make([]messaging.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		out = append(out, messaging.Message{
+			Topic:   msg.Topic,
+			Key:     []byte(msg.Key),
+			Value:   msg.Payload,
+			Headers: envelope.ToHeaders(msg.Headers),
+		})
+	}
+	return p.publisher.Publish(ctx, out...)
 }
 
 // Close closes the inventory producer
 func (p *InventoryProducer) Close() error {
-	if err := p.reserveWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close reserve writer: %w", err)
-	}
-	if err := p.releaseWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close release writer: %w", err)
+	if err := p.publisher.Close(); err != nil {
+		return fmt.Errorf("failed to close publisher: %w", err)
 	}
 	return nil
 }
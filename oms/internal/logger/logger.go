@@ -3,10 +3,12 @@ package logger
 import (
 	"log/slog"
 	"os"
+
+	"oms/internal/tracing"
 )
 
 func Init() *slog.Logger {
-	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	return slog.New(tracing.NewLogHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: true,
-	}))
+	})))
 }
@@ -0,0 +1,139 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messaging_messages_published_total",
+		Help: "Messages published, by topic and result.",
+	}, []string{"topic", "result"})
+
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messaging_messages_consumed_total",
+		Help: "Messages fetched by consumer groups, by topic and group.",
+	}, []string{"topic", "group"})
+
+	fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "messaging_fetch_errors_total",
+		Help: "Failed fetches of consumer groups, by group.",
+	}, []string{"group"})
+)
+
+// meteredBroker counts the messages published and fetched through a broker
+type meteredBroker struct {
+	Broker
+}
+
+// WithMetrics wraps broker so the messages published and consumed through it
+// are counted
+func WithMetrics(broker Broker) Broker {
+	return &meteredBroker{Broker: broker}
+}
+
+func (b *meteredBroker) NewPublisher() Publisher {
+	return &meteredPublisher{Publisher: b.Broker.NewPublisher()}
+}
+
+func (b *meteredBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	return &meteredSubscriber{
+		Subscriber: b.Broker.NewSubscriber(cfg),
+		groupID:    cfg.GroupID,
+	}
+}
+
+// EnsureTopics creates the missing topics on the wrapped broker
+func (b *meteredBroker) EnsureTopics(ctx context.Context, topics ...string) error {
+	return EnsureTopics(ctx, b.Broker, topics...)
+}
+
+// NewReader creates a reader on the wrapped broker, reads are not counted
+func (b *meteredBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	return NewReader(ctx, b.Broker, cfg)
+}
+
+// meteredPublisher counts the messages it publishes by topic
+type meteredPublisher struct {
+	Publisher
+}
+
+func (p *meteredPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	err := p.Publisher.Publish(ctx, msgs...)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	for _, msg := range msgs {
+		messagesPublished.WithLabelValues(msg.Topic, result).Inc()
+	}
+	return err
+}
+
+// meteredSubscriber counts the messages it fetches and its failed fetches
+type meteredSubscriber struct {
+	Subscriber
+	groupID string
+}
+
+func (s *meteredSubscriber) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.Subscriber.Fetch(ctx)
+	switch {
+	case err == nil:
+		messagesConsumed.WithLabelValues(msg.Topic, s.groupID).Inc()
+	case ctx.Err() == nil && !errors.Is(err, ErrClosed) && !errors.Is(err, io.EOF):
+		// A canceled fetch or a closed subscriber is a shutdown, not a failure
+		fetchErrors.WithLabelValues(s.groupID).Inc()
+	}
+	return msg, err
+}
+
+var (
+	consumerLagDesc = prometheus.NewDesc("messaging_consumer_lag",
+		"Messages of a partition not processed yet by a consumer group.",
+		[]string{"group", "topic", "partition"}, nil)
+	consumerProcessedDesc = prometheus.NewDesc("messaging_consumer_processed_total",
+		"Messages processed by a consumer group in this process.",
+		[]string{"group"}, nil)
+	consumerStalledDesc = prometheus.NewDesc("messaging_consumer_stalled",
+		"Whether a consumer group is stalled, 1 when it is.",
+		[]string{"group"}, nil)
+)
+
+// monitorCollector exposes the progress tracked by a monitor as metrics
+type monitorCollector struct {
+	m *Monitor
+}
+
+// RegisterMonitor exposes the consumer lag, processed messages and stalls
+// tracked by m with the default Prometheus registry
+func RegisterMonitor(m *Monitor) error {
+	return prometheus.Register(monitorCollector{m: m})
+}
+
+func (c monitorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- consumerLagDesc
+	ch <- consumerProcessedDesc
+	ch <- consumerStalledDesc
+}
+
+func (c monitorCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.m.Stats() {
+		for _, p := range s.Partitions {
+			ch <- prometheus.MustNewConstMetric(consumerLagDesc, prometheus.GaugeValue, float64(p.Lag), s.GroupID, p.Topic, strconv.Itoa(p.Partition))
+		}
+		ch <- prometheus.MustNewConstMetric(consumerProcessedDesc, prometheus.CounterValue, float64(s.Processed), s.GroupID)
+
+		stalled := 0.0
+		if s.Stalled {
+			stalled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(consumerStalledDesc, prometheus.GaugeValue, stalled, s.GroupID)
+	}
+}
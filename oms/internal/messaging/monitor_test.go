@@ -0,0 +1,54 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMonitorReportsLagOfABacklog(t *testing.T) {
+	ctx := context.Background()
+	m := NewMonitor(time.Minute)
+	broker := WithMonitor(NewMemory(), m)
+
+	publisher := broker.NewPublisher()
+	for i := 0; i < 10; i++ {
+		if err := publisher.Publish(ctx, Message{Topic: "requests", Key: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriber := broker.NewSubscriber(SubscriberConfig{Topics: []string{"requests"}, GroupID: "group"})
+	defer subscriber.Close()
+	for i := 0; i < 3; i++ {
+		msg, err := subscriber.Fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := subscriber.Commit(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := m.Stats()
+	if len(stats) != 1 || len(stats[0].Partitions) != 1 {
+		t.Fatalf("got stats %+v, want one group with one partition", stats)
+	}
+	partition := stats[0].Partitions[0]
+	if partition.HighWaterMark != 10 {
+		t.Fatalf("got high water mark %d, want 10", partition.HighWaterMark)
+	}
+	if stats[0].Lag != 7 || partition.Lag != 7 {
+		t.Fatalf("got lag %d of the group and %d of the partition, want 7", stats[0].Lag, partition.Lag)
+	}
+}
+
+func TestFromKafkaKeepsHighWaterMark(t *testing.T) {
+	msg := fromKafka(kafka.Message{Topic: "requests", Offset: 3, HighWaterMark: 10})
+	if msg.HighWaterMark != 10 {
+		t.Fatalf("got high water mark %d, want 10", msg.HighWaterMark)
+	}
+}
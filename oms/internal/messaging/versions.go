@@ -0,0 +1,229 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// HeaderMigrationCopy marks the copy of a message published to the previous
+// version of its topic while topics are migrated
+const HeaderMigrationCopy = "migration-copy"
+
+// versionedTopic matches topics named with a version, like
+// oms.reserve-inventory.0, and the topics derived from them such as
+// oms.reserve-inventory.0.dlq and oms.reserve-inventory.0.retry.5s
+var versionedTopic = regexp.MustCompile(`^(.+?)\.(\d+)(\..+)?$`)
+
+// Versions moves the versioned topics to another version. The zero value
+// keeps the versions the topics are named with.
+type Versions struct {
+	// Current is the version published to and consumed from
+	Current string
+	// Previous is the version migrated from. Until the cut-over, when it is
+	// unset, messages are published to both versions and consumed from both;
+	// consumers skip the copies on the previous version.
+	Previous string
+}
+
+// migrating reports whether a migration from the previous version runs
+func (v Versions) migrating() bool {
+	return v.Previous != "" && v.Previous != v.Current
+}
+
+// topics returns the topics a topic is published to and consumed from: its
+// current version and, during a migration, its previous version. Topics
+// without a version are kept.
+func (v Versions) topics(topic string) []string {
+	m := versionedTopic.FindStringSubmatch(topic)
+	if m == nil {
+		return []string{topic}
+	}
+
+	topics := []string{m[1] + "." + v.Current + m[3]}
+	if v.migrating() {
+		topics = append(topics, m[1]+"."+v.Previous+m[3])
+	}
+	return topics
+}
+
+// versionedBroker moves the topics of a broker to the versions it is
+// configured with
+type versionedBroker struct {
+	broker   Broker
+	versions Versions
+}
+
+// WithVersions wraps broker so its versioned topics use the versions of v
+func WithVersions(broker Broker, v Versions) Broker {
+	if v.Current == "" {
+		return broker
+	}
+	return &versionedBroker{broker: broker, versions: v}
+}
+
+func (b *versionedBroker) NewPublisher() Publisher {
+	return &versionedPublisher{
+		publisher: b.broker.NewPublisher(),
+		versions:  b.versions,
+	}
+}
+
+func (b *versionedBroker) NewSubscriber(cfg SubscriberConfig) Subscriber {
+	topics := make([]string, 0, len(cfg.Topics))
+	for _, topic := range cfg.Topics {
+		topics = append(topics, b.versions.topics(topic)...)
+	}
+	cfg.Topics = topics
+
+	return &versionedSubscriber{
+		subscriber: b.broker.NewSubscriber(cfg),
+		skipCopies: b.versions.migrating(),
+		partitions: make(map[partitionKey]*versionedPartition),
+	}
+}
+
+func (b *versionedBroker) Close() error {
+	return b.broker.Close()
+}
+
+// EnsureTopics creates every version of the topics in use
+func (b *versionedBroker) EnsureTopics(ctx context.Context, topics ...string) error {
+	var versioned []string
+	for _, topic := range topics {
+		versioned = append(versioned, b.versions.topics(topic)...)
+	}
+	return EnsureTopics(ctx, b.broker, versioned...)
+}
+
+// NewReader reads the topic as named, so any version can be read again
+func (b *versionedBroker) NewReader(ctx context.Context, cfg ReaderConfig) (Reader, error) {
+	return NewReader(ctx, b.broker, cfg)
+}
+
+// versionedPublisher publishes to the current version of a topic and, during
+// a migration, a marked copy to its previous version for consumers that are
+// not migrated yet
+type versionedPublisher struct {
+	publisher Publisher
+	versions  Versions
+}
+
+func (p *versionedPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	out := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		for i, topic := range p.versions.topics(msg.Topic) {
+			versioned := msg
+			versioned.Topic = topic
+			if i > 0 {
+				versioned.Headers = append(append([]Header(nil), msg.Headers...), Header{Key: HeaderMigrationCopy, Value: []byte("true")})
+			}
+			out = append(out, versioned)
+		}
+	}
+	return p.publisher.Publish(ctx, out...)
+}
+
+func (p *versionedPublisher) Close() error {
+	return p.publisher.Close()
+}
+
+// versionedSubscriber consumes the versions of its topics. The copies it skips
+// are committed as soon as no earlier message of their partition is left
+// uncommitted, since committing an offset commits the ones before it too.
+type versionedSubscriber struct {
+	subscriber Subscriber
+	skipCopies bool
+
+	mu         sync.Mutex
+	partitions map[partitionKey]*versionedPartition
+}
+
+// versionedPartition tracks a partition read while copies are skipped
+type versionedPartition struct {
+	// fetched holds the offsets handed out and not committed yet, in order
+	fetched []int64
+	// skipped is the latest copy waiting for fetched to be committed
+	skipped *Message
+}
+
+// partition returns the tracking of the partition of msg, s.mu must be held
+func (s *versionedSubscriber) partition(msg Message) *versionedPartition {
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := s.partitions[key]
+	if !ok {
+		p = &versionedPartition{}
+		s.partitions[key] = p
+	}
+	return p
+}
+
+func (s *versionedSubscriber) Fetch(ctx context.Context) (Message, error) {
+	for {
+		msg, err := s.subscriber.Fetch(ctx)
+		if err != nil || !s.skipCopies {
+			return msg, err
+		}
+
+		s.mu.Lock()
+		p := s.partition(msg)
+		if msg.Header(HeaderMigrationCopy) == "" {
+			p.fetched = append(p.fetched, msg.Offset)
+			s.mu.Unlock()
+			return msg, nil
+		}
+
+		// The message is consumed from the current version, its copy is
+		// committed here unless earlier messages are still processed
+		commit := len(p.fetched) == 0
+		if !commit {
+			p.skipped = &msg
+		}
+		s.mu.Unlock()
+
+		if commit {
+			if err := s.subscriber.Commit(ctx, msg); err != nil {
+				return Message{}, fmt.Errorf("failed to commit migration copy: %w", err)
+			}
+		}
+	}
+}
+
+func (s *versionedSubscriber) Commit(ctx context.Context, msgs ...Message) error {
+	if err := s.subscriber.Commit(ctx, msgs...); err != nil || !s.skipCopies {
+		return err
+	}
+
+	// Commit the copies skipped behind the committed messages
+	var skipped []Message
+	s.mu.Lock()
+	for _, msg := range msgs {
+		p := s.partition(msg)
+		remaining := p.fetched[:0]
+		for _, offset := range p.fetched {
+			if offset > msg.Offset {
+				remaining = append(remaining, offset)
+			}
+		}
+		p.fetched = remaining
+
+		if p.skipped != nil && (len(p.fetched) == 0 || p.fetched[0] > p.skipped.Offset) {
+			skipped = append(skipped, *p.skipped)
+			p.skipped = nil
+		}
+	}
+	s.mu.Unlock()
+
+	if len(skipped) == 0 {
+		return nil
+	}
+	if err := s.subscriber.Commit(ctx, skipped...); err != nil {
+		return fmt.Errorf("failed to commit migration copies: %w", err)
+	}
+	return nil
+}
+
+func (s *versionedSubscriber) Close() error {
+	return s.subscriber.Close()
+}
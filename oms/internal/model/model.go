@@ -36,6 +36,80 @@ type OrderSaga struct {
 	Status    string
 	Step      int
 	CreatedAt time.Time
+	// Deadline is when the current step expires, nil once the saga has
+	// nothing left to wait for
+	Deadline *time.Time
+}
+
+// OrderSagaStep tracks the inventory reservation of a single order item
+type OrderSagaStep struct {
+	OrderID   int
+	ProductID int
+	Quantity  int
+	Status    string
+	Error     string
+	UpdatedAt time.Time
+}
+
+// Order statuses
+const (
+	OrderStatusCreated   = "CREATED"
+	OrderStatusCompleted = "COMPLETED"
+	OrderStatusFailed    = "FAILED"
+	OrderStatusTimedOut  = "TIMED_OUT"
+)
+
+// Saga statuses
+const (
+	SagaStatusStarted           = "STARTED"
+	SagaStatusInventoryReserved = "INVENTORY_RESERVED"
+	SagaStatusCompleted         = "COMPLETED"
+	SagaStatusCompensating      = "COMPENSATING"
+	SagaStatusFailed            = "FAILED"
+	SagaStatusTimedOut          = "TIMED_OUT"
+	// SagaStatusTimedOutReleased ends a timed out saga once every item that
+	// might have been reserved is released
+	SagaStatusTimedOutReleased = "TIMED_OUT_RELEASED"
+)
+
+// Saga steps stored in OrderSaga.Step
+const (
+	SagaStepReserveInventory = 0
+	SagaStepConfirmInventory = 1
+	SagaStepCompleteOrder    = 2
+	SagaStepCompensate       = 3
+)
+
+// Saga step statuses
+const (
+	StepStatusPending    = "PENDING"
+	StepStatusReserved   = "RESERVED"
+	StepStatusConfirming = "CONFIRMING"
+	StepStatusConfirmed  = "CONFIRMED"
+	StepStatusFailed     = "FAILED"
+	StepStatusReleasing  = "RELEASING"
+	StepStatusReleased   = "RELEASED"
+)
+
+// Inventory operations carried in InventoryResponse
+const (
+	InventoryOperationReserve      = "RESERVE"
+	InventoryOperationReserveOrder = "RESERVE_ORDER"
+	InventoryOperationConfirm      = "CONFIRM"
+	InventoryOperationCancel       = "CANCEL"
+	InventoryOperationRelease      = "RELEASE"
+)
+
+// OutboxMessage is a Kafka message stored in the same transaction as the
+// state change it announces and published later by the outbox relay
+type OutboxMessage struct {
+	ID        int64
+	Topic     string
+	Key       string
+	Headers   map[string]string
+	Payload   []byte
+	CreatedAt time.Time
+	SentAt    *time.Time
 }
 
 type ErrorResponse struct {
@@ -58,7 +132,100 @@ type ReleaseInventoryRequest struct {
 
 type InventoryResponse struct {
 	OrderID   int    `json:"order_id"`
+	ProductID int    `json:"product_id"`
+	Operation string `json:"operation,omitempty"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	// Items holds the per-item outcome of an order-level request
+	Items []InventoryItemResult `json:"items,omitempty"`
+}
+
+// InventoryItemResult is the outcome of a single item of an order-level request
+type InventoryItemResult struct {
 	ProductID int    `json:"product_id"`
 	Success   bool   `json:"success"`
 	Error     string `json:"error,omitempty"`
 }
+
+// StockCheckResponse is the reply of inventory to a stock check
+type StockCheckResponse struct {
+	// Available is set when every item is in stock
+	Available bool             `json:"available"`
+	Items     []StockCheckItem `json:"items"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// StockCheckItem is the stock available for a single item of a stock check
+type StockCheckItem struct {
+	ProductID int `json:"product_id"`
+	Requested int `json:"requested"`
+	Available int `json:"available"`
+}
+
+// DeadLetter is a message copied from a dead-letter topic so operators can
+// inspect it and decide whether to republish or discard it
+type DeadLetter struct {
+	ID              int64             `json:"id"`
+	Topic           string            `json:"topic"`
+	Partition       int               `json:"partition"`
+	Offset          int64             `json:"offset"`
+	SourceTopic     string            `json:"source_topic"`
+	SourcePartition int               `json:"source_partition"`
+	SourceOffset    int64             `json:"source_offset"`
+	Key             string            `json:"key"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Payload         string            `json:"payload,omitempty"`
+	Error           string            `json:"error"`
+	Attempts        int               `json:"attempts"`
+	Status          string            `json:"status"`
+	FailedAt        *time.Time        `json:"failed_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// DeadLetterDetail is a dead letter together with its audit trail
+type DeadLetterDetail struct {
+	DeadLetter
+	Audit []DeadLetterAudit `json:"audit"`
+}
+
+// DeadLetterAudit records an action taken on a dead letter
+type DeadLetterAudit struct {
+	ID           int64     `json:"id"`
+	DeadLetterID int64     `json:"dead_letter_id"`
+	Action       string    `json:"action"`
+	Actor        string    `json:"actor"`
+	Note         string    `json:"note,omitempty"`
+	Payload      string    `json:"payload,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Dead letter statuses
+const (
+	DeadLetterStatusPending     = "PENDING"
+	DeadLetterStatusRepublished = "REPUBLISHED"
+	DeadLetterStatusDiscarded   = "DISCARDED"
+)
+
+// Dead letter audit actions
+const (
+	DeadLetterActionRepublish        = "REPUBLISH"
+	DeadLetterActionEditAndRepublish = "EDIT_AND_REPUBLISH"
+	DeadLetterActionDiscard          = "DISCARD"
+)
+
+// RepublishDeadLetterRequest republishes a dead letter to its source topic,
+// with Payload replacing the original payload when set. Actor is the
+// authenticated admin, it is never read from the request body.
+type RepublishDeadLetterRequest struct {
+	Actor   string  `json:"-"`
+	Note    string  `json:"note"`
+	Payload *string `json:"payload,omitempty"`
+}
+
+// DiscardDeadLetterRequest discards a dead letter. Actor is the authenticated
+// admin, it is never read from the request body.
+type DiscardDeadLetterRequest struct {
+	Actor string `json:"-"`
+	Note  string `json:"note"`
+}
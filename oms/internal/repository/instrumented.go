@@ -0,0 +1,285 @@
+package repository
+
+import (
+	"context"
+	"maps"
+	"oms/internal/model"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("repository")
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Time taken by repository calls, by method and result.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "result"})
+
+// instrumentedRepository times every call made on a repository bound to a
+// context and records a span for it. Calls are only traced as part of a
+// trace, so background work such as polling the outbox does not start traces
+// of its own.
+type instrumentedRepository struct {
+	r   RepositoryI
+	ctx context.Context
+}
+
+// WithContext returns the repository with its calls timed and traced as
+// children of the span of ctx
+func (r *Repository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: r, ctx: ctx}
+}
+
+func (t *instrumentedRepository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: t.r, ctx: ctx}
+}
+
+// WithTx times and traces the transaction, the calls made in it are its
+// children
+func (t *instrumentedRepository) WithTx(fn func(r RepositoryI) error) error {
+	c := t.start("WithTx")
+	ctx := trace.ContextWithSpan(t.ctx, c.span)
+	err := t.r.WithTx(func(r RepositoryI) error {
+		return fn(&instrumentedRepository{r: r, ctx: ctx})
+	})
+	c.end(err)
+	return err
+}
+
+// call is a repository call being timed and traced
+type call struct {
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+// start starts timing a call and its span, the span is the non-recording
+// span of the context when it is not part of a trace
+func (t *instrumentedRepository) start(method string) call {
+	c := call{method: method, start: time.Now(), span: trace.SpanFromContext(t.ctx)}
+	if c.span.SpanContext().IsValid() {
+		_, c.span = tracer.Start(t.ctx, "repository."+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNamePostgreSQL,
+				semconv.CodeFunctionName("repository."+method),
+			),
+		)
+	}
+	return c
+}
+
+// end ends the span of a call, recording its error, and observes its latency
+func (c call) end(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, err.Error())
+	}
+	c.span.End()
+	queryDuration.WithLabelValues(c.method, result).Observe(time.Since(c.start).Seconds())
+}
+
+// injectHeaders returns headers with the trace context of ctx added
+func injectHeaders(ctx context.Context, headers map[string]string) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return headers
+	}
+	out := make(map[string]string, len(headers)+1)
+	maps.Copy(out, headers)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(out))
+	return out
+}
+
+func (t *instrumentedRepository) CreateOrder(order model.CreateOrder) (int, error) {
+	c := t.start("CreateOrder")
+	v, err := t.r.CreateOrder(order)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetOrder(id int) (*model.Order, error) {
+	c := t.start("GetOrder")
+	v, err := t.r.GetOrder(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetOrders() ([]model.Order, error) {
+	c := t.start("GetOrders")
+	v, err := t.r.GetOrders()
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) CreateOrderItems(orderID int, items []model.OrderItem) error {
+	c := t.start("CreateOrderItems")
+	err := t.r.CreateOrderItems(orderID, items)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetOrderItems() (map[int][]model.OrderItem, error) {
+	c := t.start("GetOrderItems")
+	v, err := t.r.GetOrderItems()
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) CreateSaga(saga model.OrderSaga) error {
+	c := t.start("CreateSaga")
+	err := t.r.CreateSaga(saga)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetSaga(orderID int) (*model.OrderSaga, error) {
+	c := t.start("GetSaga")
+	v, err := t.r.GetSaga(orderID)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetSagasByStatus(status string) ([]*model.OrderSaga, error) {
+	c := t.start("GetSagasByStatus")
+	v, err := t.r.GetSagasByStatus(status)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) UpdateSagaStatus(orderID int, status string) error {
+	c := t.start("UpdateSagaStatus")
+	err := t.r.UpdateSagaStatus(orderID, status)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) UpdateSagaStep(orderID int, status string, step int, deadline *time.Time) error {
+	c := t.start("UpdateSagaStep")
+	err := t.r.UpdateSagaStep(orderID, status, step, deadline)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetSagaForUpdate(orderID int) (*model.OrderSaga, error) {
+	c := t.start("GetSagaForUpdate")
+	v, err := t.r.GetSagaForUpdate(orderID)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetExpiredSagas(now time.Time) ([]*model.OrderSaga, error) {
+	c := t.start("GetExpiredSagas")
+	v, err := t.r.GetExpiredSagas(now)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) CreateSagaSteps(steps []model.OrderSagaStep) error {
+	c := t.start("CreateSagaSteps")
+	err := t.r.CreateSagaSteps(steps)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetSagaSteps(orderID int) ([]model.OrderSagaStep, error) {
+	c := t.start("GetSagaSteps")
+	v, err := t.r.GetSagaSteps(orderID)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) UpdateSagaStepStatus(orderID int, productID int, status string, errMsg string) error {
+	c := t.start("UpdateSagaStepStatus")
+	err := t.r.UpdateSagaStepStatus(orderID, productID, status, errMsg)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) UpdateOrderStatus(orderID int, status string) error {
+	c := t.start("UpdateOrderStatus")
+	err := t.r.UpdateOrderStatus(orderID, status)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	c := t.start("CreateOutboxMessage")
+	// The trace context travels with the message to the outbox relay
+	msg.Headers = injectHeaders(t.ctx, msg.Headers)
+	err := t.r.CreateOutboxMessage(msg)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error) {
+	c := t.start("GetPendingOutboxMessages")
+	v, err := t.r.GetPendingOutboxMessages(limit)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) MarkOutboxMessageSent(id int64, sentAt time.Time) error {
+	c := t.start("MarkOutboxMessageSent")
+	err := t.r.MarkOutboxMessageSent(id, sentAt)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateDeadLetter(dl model.DeadLetter) error {
+	c := t.start("CreateDeadLetter")
+	err := t.r.CreateDeadLetter(dl)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error) {
+	c := t.start("GetDeadLetters")
+	v, err := t.r.GetDeadLetters(status, sourceTopic)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetDeadLetter(id int64) (*model.DeadLetter, error) {
+	c := t.start("GetDeadLetter")
+	v, err := t.r.GetDeadLetter(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error) {
+	c := t.start("GetDeadLetterForUpdate")
+	v, err := t.r.GetDeadLetterForUpdate(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) UpdateDeadLetterStatus(id int64, status string) error {
+	c := t.start("UpdateDeadLetterStatus")
+	err := t.r.UpdateDeadLetterStatus(id, status)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) CreateDeadLetterAudit(a model.DeadLetterAudit) error {
+	c := t.start("CreateDeadLetterAudit")
+	err := t.r.CreateDeadLetterAudit(a)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error) {
+	c := t.start("GetDeadLetterAudits")
+	v, err := t.r.GetDeadLetterAudits(deadLetterID)
+	c.end(err)
+	return v, err
+}
@@ -1,11 +1,18 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"oms/internal/model"
+	"time"
 )
 
+// ErrDeadLetterNotFound is returned when no dead letter exists with an ID
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
 // RepositoryI defines the interface for repository operations
 type RepositoryI interface {
 	// Order operations
@@ -20,12 +27,50 @@ type RepositoryI interface {
 	GetSaga(orderID int) (*model.OrderSaga, error)
 	GetSagasByStatus(status string) ([]*model.OrderSaga, error)
 	UpdateSagaStatus(orderID int, status string) error
+	UpdateSagaStep(orderID int, status string, step int, deadline *time.Time) error
+	GetSagaForUpdate(orderID int) (*model.OrderSaga, error)
+	GetExpiredSagas(now time.Time) ([]*model.OrderSaga, error)
+
+	// Saga step operations
+	CreateSagaSteps(steps []model.OrderSagaStep) error
+	GetSagaSteps(orderID int) ([]model.OrderSagaStep, error)
+	UpdateSagaStepStatus(orderID int, productID int, status string, errMsg string) error
+
+	UpdateOrderStatus(orderID int, status string) error
+
+	// Outbox operations
+	CreateOutboxMessage(msg model.OutboxMessage) error
+	GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error)
+	MarkOutboxMessageSent(id int64, sentAt time.Time) error
+
+	// Dead letter operations
+	CreateDeadLetter(dl model.DeadLetter) error
+	GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error)
+	GetDeadLetter(id int64) (*model.DeadLetter, error)
+	GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error)
+	UpdateDeadLetterStatus(id int64, status string) error
+	CreateDeadLetterAudit(a model.DeadLetterAudit) error
+	GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error)
+
+	// WithTx runs fn inside a single database transaction
+	WithTx(fn func(r RepositoryI) error) error
+	// WithContext returns the repository with its calls timed and traced
+	// as part of the trace of ctx
+	WithContext(ctx context.Context) RepositoryI
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 // Repository implements the RepositoryI interface
 type Repository struct {
 	l  *slog.Logger
 	db *sql.DB
+	q  querier
 }
 
 // New creates a new repository instance
@@ -33,13 +78,42 @@ func New(l *slog.Logger, db *sql.DB) *Repository {
 	return &Repository{
 		l:  l,
 		db: db,
+		q:  db,
+	}
+}
+
+// WithTx runs fn with a repository bound to a new transaction. The transaction
+// is committed when fn returns nil and rolled back otherwise. Calls made on an
+// already transactional repository reuse the current transaction.
+func (r *Repository) WithTx(fn func(r RepositoryI) error) error {
+	if _, ok := r.q.(*sql.Tx); ok {
+		return fn(r)
 	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		r.l.Error("failed to begin transaction", "error", err)
+		return err
+	}
+
+	if err := fn(&Repository{l: r.l, db: r.db, q: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			r.l.Error("failed to rollback transaction", "error", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.l.Error("failed to commit transaction", "error", err)
+		return err
+	}
+	return nil
 }
 
 // CreateOrder creates a new order
 func (r *Repository) CreateOrder(order model.CreateOrder) (int, error) {
 	var orderID int
-	err := r.db.QueryRow(
+	err := r.q.QueryRow(
 		"INSERT INTO orders (status, created_at) VALUES ($1, $2) RETURNING id",
 		order.Status, order.CreatedAt,
 	).Scan(&orderID)
@@ -55,7 +129,7 @@ func (r *Repository) CreateOrder(order model.CreateOrder) (int, error) {
 // GetOrder gets an order by ID
 func (r *Repository) GetOrder(id int) (*model.Order, error) {
 	var order model.Order
-	err := r.db.QueryRow("SELECT id, status, created_at FROM orders WHERE id = $1", id).Scan(&order.ID, &order.Status, &order.CreatedAt)
+	err := r.q.QueryRow("SELECT id, status, created_at FROM orders WHERE id = $1", id).Scan(&order.ID, &order.Status, &order.CreatedAt)
 	if err != nil {
 		r.l.Error("failed to get order", "error", err, "order_id", id)
 		return nil, err
@@ -65,7 +139,7 @@ func (r *Repository) GetOrder(id int) (*model.Order, error) {
 
 // GetOrders gets all orders
 func (r *Repository) GetOrders() ([]model.Order, error) {
-	rows, err := r.db.Query("SELECT id, status, created_at FROM orders")
+	rows, err := r.q.Query("SELECT id, status, created_at FROM orders")
 	if err != nil {
 		r.l.Error("failed to get orders", "error", err)
 		return nil, err
@@ -88,7 +162,7 @@ func (r *Repository) GetOrders() ([]model.Order, error) {
 // CreateOrderItems creates order items for an order
 func (r *Repository) CreateOrderItems(orderID int, items []model.OrderItem) error {
 	for _, item := range items {
-		_, err := r.db.Exec(
+		_, err := r.q.Exec(
 			"INSERT INTO order_items (order_id, product_id, product_name, product_description, quantity) VALUES ($1, $2, $3, $4, $5)",
 			orderID, item.Product.ID, item.Product.Name, item.Product.Description, item.Quantity,
 		)
@@ -102,7 +176,7 @@ func (r *Repository) CreateOrderItems(orderID int, items []model.OrderItem) erro
 
 // GetOrderItems gets all order items
 func (r *Repository) GetOrderItems() (map[int][]model.OrderItem, error) {
-	rows, err := r.db.Query("SELECT order_id, product_id, product_name, product_description, quantity FROM order_items")
+	rows, err := r.q.Query("SELECT order_id, product_id, product_name, product_description, quantity FROM order_items")
 	if err != nil {
 		r.l.Error("failed to get order items", "error", err)
 		return nil, err
@@ -125,9 +199,9 @@ func (r *Repository) GetOrderItems() (map[int][]model.OrderItem, error) {
 
 // CreateSaga creates a new saga
 func (r *Repository) CreateSaga(saga model.OrderSaga) error {
-	_, err := r.db.Exec(
-		"INSERT INTO order_sagas (order_id, status, step, created_at) VALUES ($1, $2, $3, $4)",
-		saga.OrderID, saga.Status, saga.Step, saga.CreatedAt,
+	_, err := r.q.Exec(
+		"INSERT INTO order_sagas (order_id, status, step, created_at, deadline) VALUES ($1, $2, $3, $4, $5)",
+		saga.OrderID, saga.Status, saga.Step, saga.CreatedAt, saga.Deadline,
 	)
 	if err != nil {
 		r.l.Error("failed to create saga", "error", err, "order_id", saga.OrderID)
@@ -139,7 +213,7 @@ func (r *Repository) CreateSaga(saga model.OrderSaga) error {
 // GetSaga gets a saga by order ID
 func (r *Repository) GetSaga(orderID int) (*model.OrderSaga, error) {
 	var saga model.OrderSaga
-	err := r.db.QueryRow("SELECT order_id, status, step, created_at FROM order_sagas WHERE order_id = $1", orderID).Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt)
+	err := r.q.QueryRow("SELECT order_id, status, step, created_at, deadline FROM order_sagas WHERE order_id = $1", orderID).Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt, &saga.Deadline)
 	if err != nil {
 		r.l.Error("failed to get saga", "error", err, "order_id", orderID)
 		return nil, err
@@ -149,7 +223,7 @@ func (r *Repository) GetSaga(orderID int) (*model.OrderSaga, error) {
 
 // GetSagasByStatus gets all sagas with a specific status
 func (r *Repository) GetSagasByStatus(status string) ([]*model.OrderSaga, error) {
-	rows, err := r.db.Query("SELECT order_id, status, step, created_at FROM order_sagas WHERE status = $1", status)
+	rows, err := r.q.Query("SELECT order_id, status, step, created_at, deadline FROM order_sagas WHERE status = $1", status)
 	if err != nil {
 		r.l.Error("failed to get sagas", "error", err)
 		return nil, err
@@ -159,7 +233,7 @@ func (r *Repository) GetSagasByStatus(status string) ([]*model.OrderSaga, error)
 	var sagas []*model.OrderSaga
 	for rows.Next() {
 		var saga model.OrderSaga
-		err := rows.Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt)
+		err := rows.Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt, &saga.Deadline)
 		if err != nil {
 			r.l.Error("failed to scan saga", "error", err)
 			return nil, err
@@ -171,10 +245,326 @@ func (r *Repository) GetSagasByStatus(status string) ([]*model.OrderSaga, error)
 
 // UpdateSagaStatus updates a saga's status
 func (r *Repository) UpdateSagaStatus(orderID int, status string) error {
-	_, err := r.db.Exec("UPDATE order_sagas SET status = $1 WHERE order_id = $2", status, orderID)
+	_, err := r.q.Exec("UPDATE order_sagas SET status = $1 WHERE order_id = $2", status, orderID)
 	if err != nil {
 		r.l.Error("failed to update saga status", "error", err, "order_id", orderID)
 		return err
 	}
 	return nil
 }
+
+// UpdateSagaStep moves a saga to a new status and step with the deadline of that step
+func (r *Repository) UpdateSagaStep(orderID int, status string, step int, deadline *time.Time) error {
+	_, err := r.q.Exec("UPDATE order_sagas SET status = $1, step = $2, deadline = $3 WHERE order_id = $4", status, step, deadline, orderID)
+	if err != nil {
+		r.l.Error("failed to update saga step", "error", err, "order_id", orderID)
+		return err
+	}
+	return nil
+}
+
+// GetExpiredSagas gets all sagas whose current step is past its deadline
+func (r *Repository) GetExpiredSagas(now time.Time) ([]*model.OrderSaga, error) {
+	rows, err := r.q.Query("SELECT order_id, status, step, created_at, deadline FROM order_sagas WHERE deadline < $1 ORDER BY deadline", now)
+	if err != nil {
+		r.l.Error("failed to get expired sagas", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sagas []*model.OrderSaga
+	for rows.Next() {
+		var saga model.OrderSaga
+		err := rows.Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt, &saga.Deadline)
+		if err != nil {
+			r.l.Error("failed to scan saga", "error", err)
+			return nil, err
+		}
+		sagas = append(sagas, &saga)
+	}
+	return sagas, rows.Err()
+}
+
+// GetSagaForUpdate gets a saga by order ID and locks its row until the
+// surrounding transaction ends
+func (r *Repository) GetSagaForUpdate(orderID int) (*model.OrderSaga, error) {
+	var saga model.OrderSaga
+	err := r.q.QueryRow("SELECT order_id, status, step, created_at, deadline FROM order_sagas WHERE order_id = $1 FOR UPDATE", orderID).Scan(&saga.OrderID, &saga.Status, &saga.Step, &saga.CreatedAt, &saga.Deadline)
+	if err != nil {
+		r.l.Error("failed to lock saga", "error", err, "order_id", orderID)
+		return nil, err
+	}
+	return &saga, nil
+}
+
+// CreateSagaSteps creates the per-item steps of a saga
+func (r *Repository) CreateSagaSteps(steps []model.OrderSagaStep) error {
+	for _, step := range steps {
+		_, err := r.q.Exec(
+			"INSERT INTO order_saga_steps (order_id, product_id, quantity, status, error, updated_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			step.OrderID, step.ProductID, step.Quantity, step.Status, step.Error, step.UpdatedAt,
+		)
+		if err != nil {
+			r.l.Error("failed to create saga step", "error", err, "order_id", step.OrderID, "product_id", step.ProductID)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSagaSteps gets all steps of a saga
+func (r *Repository) GetSagaSteps(orderID int) ([]model.OrderSagaStep, error) {
+	rows, err := r.q.Query("SELECT order_id, product_id, quantity, status, error, updated_at FROM order_saga_steps WHERE order_id = $1 ORDER BY product_id", orderID)
+	if err != nil {
+		r.l.Error("failed to get saga steps", "error", err, "order_id", orderID)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []model.OrderSagaStep
+	for rows.Next() {
+		var step model.OrderSagaStep
+		err := rows.Scan(&step.OrderID, &step.ProductID, &step.Quantity, &step.Status, &step.Error, &step.UpdatedAt)
+		if err != nil {
+			r.l.Error("failed to scan saga step", "error", err)
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+// UpdateSagaStepStatus updates the status of a saga step
+func (r *Repository) UpdateSagaStepStatus(orderID int, productID int, status string, errMsg string) error {
+	_, err := r.q.Exec(
+		"UPDATE order_saga_steps SET status = $1, error = $2, updated_at = $3 WHERE order_id = $4 AND product_id = $5",
+		status, errMsg, time.Now(), orderID, productID,
+	)
+	if err != nil {
+		r.l.Error("failed to update saga step status", "error", err, "order_id", orderID, "product_id", productID)
+		return err
+	}
+	return nil
+}
+
+// UpdateOrderStatus updates an order's status
+func (r *Repository) UpdateOrderStatus(orderID int, status string) error {
+	_, err := r.q.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, orderID)
+	if err != nil {
+		r.l.Error("failed to update order status", "error", err, "order_id", orderID)
+		return err
+	}
+	return nil
+}
+
+// CreateOutboxMessage stores a message to be published by the outbox relay
+func (r *Repository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		r.l.Error("failed to marshal outbox headers", "error", err, "topic", msg.Topic, "key", msg.Key)
+		return err
+	}
+
+	_, err = r.q.Exec(
+		"INSERT INTO outbox (topic, key, headers, payload, created_at) VALUES ($1, $2, $3, $4, $5)",
+		msg.Topic, msg.Key, headers, msg.Payload, msg.CreatedAt,
+	)
+	if err != nil {
+		r.l.Error("failed to create outbox message", "error", err, "topic", msg.Topic, "key", msg.Key)
+		return err
+	}
+	return nil
+}
+
+// GetPendingOutboxMessages gets the oldest unsent outbox messages. Inside a
+// transaction the rows stay locked and are skipped by other relays.
+func (r *Repository) GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error) {
+	rows, err := r.q.Query(
+		"SELECT id, topic, key, headers, payload, created_at, sent_at FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+		limit,
+	)
+	if err != nil {
+		r.l.Error("failed to get pending outbox messages", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []model.OutboxMessage
+	for rows.Next() {
+		var msg model.OutboxMessage
+		var headers []byte
+		err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &headers, &msg.Payload, &msg.CreatedAt, &msg.SentAt)
+		if err != nil {
+			r.l.Error("failed to scan outbox message", "error", err)
+			return nil, err
+		}
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+				r.l.Error("failed to unmarshal outbox headers", "error", err, "id", msg.ID)
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// MarkOutboxMessageSent marks an outbox message as published
+func (r *Repository) MarkOutboxMessageSent(id int64, sentAt time.Time) error {
+	_, err := r.q.Exec("UPDATE outbox SET sent_at = $1 WHERE id = $2", sentAt, id)
+	if err != nil {
+		r.l.Error("failed to mark outbox message sent", "error", err, "id", id)
+		return err
+	}
+	return nil
+}
+
+// CreateDeadLetter stores a message read from a dead-letter topic. A message
+// that is already stored is skipped, so the topic can be read again.
+func (r *Repository) CreateDeadLetter(dl model.DeadLetter) error {
+	headers, err := json.Marshal(dl.Headers)
+	if err != nil {
+		r.l.Error("failed to marshal dead letter headers", "error", err, "topic", dl.Topic, "offset", dl.Offset)
+		return err
+	}
+
+	_, err = r.q.Exec(
+		`INSERT INTO dead_letters (topic, partition, "offset", source_topic, source_partition, source_offset,
+			key, headers, payload, error, attempts, status, failed_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $14)
+		ON CONFLICT (topic, partition, "offset") DO NOTHING`,
+		dl.Topic, dl.Partition, dl.Offset, dl.SourceTopic, dl.SourcePartition, dl.SourceOffset,
+		dl.Key, headers, []byte(dl.Payload), dl.Error, dl.Attempts, dl.Status, dl.FailedAt, dl.CreatedAt,
+	)
+	if err != nil {
+		r.l.Error("failed to create dead letter", "error", err, "topic", dl.Topic, "offset", dl.Offset)
+		return err
+	}
+	return nil
+}
+
+// GetDeadLetters gets the dead letters with a status from a source topic,
+// oldest first. Empty filters match every dead letter.
+func (r *Repository) GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error) {
+	rows, err := r.q.Query(
+		deadLetterSelect+` WHERE ($1 = '' OR status = $1) AND ($2 = '' OR source_topic = $2) ORDER BY id`,
+		status, sourceTopic,
+	)
+	if err != nil {
+		r.l.Error("failed to get dead letters", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []model.DeadLetter{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			r.l.Error("failed to scan dead letter", "error", err)
+			return nil, err
+		}
+		deadLetters = append(deadLetters, *dl)
+	}
+	return deadLetters, rows.Err()
+}
+
+// GetDeadLetter gets a dead letter by ID
+func (r *Repository) GetDeadLetter(id int64) (*model.DeadLetter, error) {
+	dl, err := scanDeadLetter(r.q.QueryRow(deadLetterSelect+` WHERE id = $1`, id))
+	if err != nil && err != ErrDeadLetterNotFound {
+		r.l.Error("failed to get dead letter", "error", err, "id", id)
+	}
+	return dl, err
+}
+
+// GetDeadLetterForUpdate gets a dead letter by ID and locks it until the
+// transaction ends
+func (r *Repository) GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error) {
+	dl, err := scanDeadLetter(r.q.QueryRow(deadLetterSelect+` WHERE id = $1 FOR UPDATE`, id))
+	if err != nil && err != ErrDeadLetterNotFound {
+		r.l.Error("failed to lock dead letter", "error", err, "id", id)
+	}
+	return dl, err
+}
+
+// UpdateDeadLetterStatus sets the status of a dead letter
+func (r *Repository) UpdateDeadLetterStatus(id int64, status string) error {
+	_, err := r.q.Exec("UPDATE dead_letters SET status = $1, updated_at = $2 WHERE id = $3", status, time.Now(), id)
+	if err != nil {
+		r.l.Error("failed to update dead letter status", "error", err, "id", id)
+		return err
+	}
+	return nil
+}
+
+// CreateDeadLetterAudit records an action taken on a dead letter
+func (r *Repository) CreateDeadLetterAudit(a model.DeadLetterAudit) error {
+	var payload []byte
+	if a.Payload != "" {
+		payload = []byte(a.Payload)
+	}
+
+	_, err := r.q.Exec(
+		"INSERT INTO dead_letter_audit (dead_letter_id, action, actor, note, payload, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		a.DeadLetterID, a.Action, a.Actor, a.Note, payload, a.CreatedAt,
+	)
+	if err != nil {
+		r.l.Error("failed to create dead letter audit", "error", err, "dead_letter_id", a.DeadLetterID)
+		return err
+	}
+	return nil
+}
+
+// GetDeadLetterAudits gets the audit trail of a dead letter, oldest first
+func (r *Repository) GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error) {
+	rows, err := r.q.Query(
+		"SELECT id, dead_letter_id, action, actor, note, payload, created_at FROM dead_letter_audit WHERE dead_letter_id = $1 ORDER BY id",
+		deadLetterID,
+	)
+	if err != nil {
+		r.l.Error("failed to get dead letter audit", "error", err, "dead_letter_id", deadLetterID)
+		return nil, err
+	}
+	defer rows.Close()
+
+	audits := []model.DeadLetterAudit{}
+	for rows.Next() {
+		var a model.DeadLetterAudit
+		var note sql.NullString
+		var payload []byte
+		if err := rows.Scan(&a.ID, &a.DeadLetterID, &a.Action, &a.Actor, &note, &payload, &a.CreatedAt); err != nil {
+			r.l.Error("failed to scan dead letter audit", "error", err)
+			return nil, err
+		}
+		a.Note = note.String
+		a.Payload = string(payload)
+		audits = append(audits, a)
+	}
+	return audits, rows.Err()
+}
+
+// deadLetterSelect selects the columns read by scanDeadLetter
+const deadLetterSelect = `SELECT id, topic, partition, "offset", source_topic, source_partition, source_offset,
+	key, headers, payload, error, attempts, status, failed_at, created_at, updated_at FROM dead_letters`
+
+// scanDeadLetter scans a row selected with deadLetterSelect
+func scanDeadLetter(row interface{ Scan(dest ...any) error }) (*model.DeadLetter, error) {
+	var dl model.DeadLetter
+	var headers, payload []byte
+	err := row.Scan(&dl.ID, &dl.Topic, &dl.Partition, &dl.Offset, &dl.SourceTopic, &dl.SourcePartition, &dl.SourceOffset,
+		&dl.Key, &headers, &payload, &dl.Error, &dl.Attempts, &dl.Status, &dl.FailedAt, &dl.CreatedAt, &dl.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &dl.Headers); err != nil {
+			return nil, err
+		}
+	}
+	dl.Payload = string(payload)
+	return &dl, nil
+}
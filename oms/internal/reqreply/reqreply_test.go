@@ -0,0 +1,170 @@
+package reqreply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"oms/internal/messaging"
+)
+
+const (
+	requestTopic = "requests"
+	replyTopic   = "replies"
+)
+
+// newTestRequester starts a requester over broker, it stops when the test ends
+func newTestRequester(t *testing.T, broker messaging.Broker) *Requester {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	q := NewRequester(l, broker, replyTopic, "test-replies")
+	t.Cleanup(func() {
+		cancel()
+		q.Close()
+	})
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// respond reads n requests and answers them in reverse order, each reply
+// carrying the value of its request
+func respond(t *testing.T, broker messaging.Broker, n int) {
+	t.Helper()
+
+	subscriber := broker.NewSubscriber(messaging.SubscriberConfig{Topics: []string{requestTopic}, GroupID: "responder"})
+	publisher := broker.NewPublisher()
+	t.Cleanup(func() { subscriber.Close() })
+
+	go func() {
+		ctx := context.Background()
+		var requests []messaging.Message
+		for len(requests) < n {
+			msg, err := subscriber.Fetch(ctx)
+			if err != nil {
+				return
+			}
+			requests = append(requests, msg)
+		}
+
+		for i := len(requests) - 1; i >= 0; i-- {
+			route := RouteOf(requests[i], "unused")
+			publisher.Publish(ctx, messaging.Message{
+				Topic:   route.Topic,
+				Value:   requests[i].Value,
+				Headers: []messaging.Header{{Key: HeaderCorrelationID, Value: []byte(route.CorrelationID)}},
+			})
+		}
+	}()
+}
+
+func TestRequestReceivesItsReply(t *testing.T) {
+	broker := messaging.NewMemory()
+	q := newTestRequester(t, broker)
+
+	const n = 5
+	respond(t, broker, n)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprintf("request %d", i)
+			reply, err := q.Request(context.Background(), messaging.Message{Topic: requestTopic, Value: []byte(value)}, 5*time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(reply.Value) != value {
+				errs <- fmt.Errorf("got reply %q to %q", reply.Value, value)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if pending := q.Pending(); pending != 0 {
+		t.Fatalf("got %d pending requests after every reply arrived", pending)
+	}
+}
+
+func TestRequestKeepsItsCorrelationID(t *testing.T) {
+	broker := messaging.NewMemory()
+	q := newTestRequester(t, broker)
+	respond(t, broker, 1)
+
+	msg := messaging.Message{
+		Topic:   requestTopic,
+		Headers: []messaging.Header{{Key: HeaderCorrelationID, Value: []byte("order-1")}},
+	}
+	reply, err := q.Request(context.Background(), msg, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := reply.Header(HeaderCorrelationID); id != "order-1" {
+		t.Fatalf("got correlation ID %q, want order-1", id)
+	}
+}
+
+func TestRequestTimesOut(t *testing.T) {
+	broker := messaging.NewMemory()
+	q := newTestRequester(t, broker)
+
+	_, err := q.Request(context.Background(), messaging.Message{Topic: requestTopic}, 50*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want %v", err, ErrTimeout)
+	}
+	if pending := q.Pending(); pending != 0 {
+		t.Fatalf("got %d pending requests after the timeout", pending)
+	}
+
+	// The late reply is dropped and the next request gets its own
+	respond(t, broker, 2)
+	value := []byte("after timeout")
+	reply, err := q.Request(context.Background(), messaging.Message{Topic: requestTopic, Value: value}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Value) != string(value) {
+		t.Fatalf("got reply %q, want %q", reply.Value, value)
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	broker := messaging.NewMemory()
+	q := newTestRequester(t, broker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.Request(ctx, messaging.Message{Topic: requestTopic}, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	route := RouteOf(messaging.Message{}, "responses")
+	if route.Topic != "responses" || route.CorrelationID != "" {
+		t.Fatalf("got route %+v for a request without headers", route)
+	}
+
+	route = RouteOf(messaging.Message{Headers: []messaging.Header{
+		{Key: HeaderReplyTo, Value: []byte(replyTopic)},
+		{Key: HeaderCorrelationID, Value: []byte("abc")},
+	}}, "responses")
+	if route.Topic != replyTopic || route.CorrelationID != "abc" {
+		t.Fatalf("got route %+v, want %s and abc", route, replyTopic)
+	}
+}
@@ -1,15 +1,18 @@
 package routes
 
 import (
+	"expvar"
 	"net/http"
+	"oms/internal/admin"
 	"oms/internal/handler"
+	"oms/internal/metrics"
 )
 
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, traceparent, tracestate")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -20,8 +23,22 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func RegisterRoutes(mux *http.ServeMux, h *handler.Handler) {
+func RegisterRoutes(mux *http.ServeMux, h *handler.Handler, tokens admin.Tokens) {
 	mux.HandleFunc("GET /health", corsMiddleware(h.Health))
 	mux.HandleFunc("POST /orders", corsMiddleware(h.CreateOrder))
 	mux.HandleFunc("GET /orders", corsMiddleware(h.GetOrders))
+
+	// Consumer lag and progress, also published as the consumers expvar
+	mux.HandleFunc("GET /admin/consumers", h.GetConsumers)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	// Prometheus metrics, the consumer lag included
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	// Dead letter administration, for operators holding an admin token.
+	// Admin routes are not open to other origins.
+	mux.HandleFunc("GET /admin/dlq", tokens.Middleware(h.GetDeadLetters))
+	mux.HandleFunc("GET /admin/dlq/{id}", tokens.Middleware(h.GetDeadLetter))
+	mux.HandleFunc("POST /admin/dlq/{id}/republish", tokens.Middleware(h.RepublishDeadLetter))
+	mux.HandleFunc("POST /admin/dlq/{id}/discard", tokens.Middleware(h.DiscardDeadLetter))
 }
@@ -0,0 +1,72 @@
+package saga
+
+import (
+	"strings"
+	"time"
+
+	"oms/internal/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons an order fails for
+const (
+	failedError    = "error"
+	failedRejected = "rejected"
+	failedTimedOut = "timed_out"
+)
+
+var (
+	ordersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_created_total",
+		Help: "Orders created, each starts a checkout saga.",
+	})
+
+	ordersFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orders_failed_total",
+		Help: "Orders that failed: could not be created (error), were refused by inventory (rejected) or timed out (timed_out).",
+	}, []string{"reason"})
+
+	sagaDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "saga_duration_seconds",
+		Help:    "Time from the start of a checkout saga until it ends, by final status.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"outcome"})
+)
+
+// observeEnd records the duration of a saga that just ended
+func observeEnd(saga *model.OrderSaga) {
+	sagaDuration.WithLabelValues(strings.ToLower(saga.Status)).Observe(time.Since(saga.CreatedAt).Seconds())
+}
+
+// outcome collects the metrics of a saga transaction. They are recorded only
+// once the transaction committed, so a rolled back or retried transaction
+// counts nothing.
+type outcome struct {
+	// failed is the reason the order failed for, empty if it did not
+	failed string
+	// ended is the saga as it ended, nil if it did not
+	ended *model.OrderSaga
+}
+
+// fail records that the order failed for reason
+func (m *outcome) fail(reason string) {
+	m.failed = reason
+}
+
+// end records that the saga ended
+func (m *outcome) end(saga *model.OrderSaga) {
+	ended := *saga
+	m.ended = &ended
+}
+
+// record records the collected metrics
+func (m *outcome) record() {
+	if m.failed != "" {
+		ordersFailed.WithLabelValues(m.failed).Inc()
+	}
+	if m.ended != nil {
+		observeEnd(m.ended)
+	}
+}
@@ -0,0 +1,87 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"oms/internal/model"
+	"oms/internal/repository"
+)
+
+// Recover resumes or compensates every saga left unfinished by a previous
+// run. It is meant to run once at startup, before new orders are accepted.
+func (o *Orchestrator) Recover(ctx context.Context) error {
+	o.l.InfoContext(ctx, "Recovering unfinished sagas")
+
+	recovered := 0
+	for _, status := range []string{model.SagaStatusStarted, model.SagaStatusInventoryReserved, model.SagaStatusCompensating, model.SagaStatusTimedOut} {
+		sagas, err := o.r.WithContext(ctx).GetSagasByStatus(status)
+		if err != nil {
+			return fmt.Errorf("failed to get %s sagas: %w", status, err)
+		}
+
+		for _, saga := range sagas {
+			if err := o.recoverSaga(ctx, saga.OrderID); err != nil {
+				o.l.ErrorContext(ctx, "failed to recover saga", "error", err, "order_id", saga.OrderID, "status", saga.Status)
+				continue
+			}
+			recovered++
+		}
+	}
+
+	o.l.InfoContext(ctx, "Saga recovery finished", "recovered", recovered)
+	return nil
+}
+
+// recoverSaga re-derives where a saga stopped from its steps and moves it on
+func (o *Orchestrator) recoverSaga(ctx context.Context, orderID int) error {
+	return o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, err := r.GetSagaForUpdate(orderID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+
+		steps, err := r.GetSagaSteps(orderID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga steps: %w", err)
+		}
+
+		switch saga.Status {
+		case model.SagaStatusStarted:
+			if allInStatus(steps, model.StepStatusReserved) {
+				o.l.InfoContext(ctx, "Resuming saga with all items reserved", "order_id", orderID)
+				return o.confirm(r, saga, steps)
+			}
+
+			for _, step := range steps {
+				if step.Status == model.StepStatusFailed {
+					o.l.InfoContext(ctx, "Compensating interrupted saga", "order_id", orderID)
+					return o.compensate(ctx, r, m, saga, steps)
+				}
+			}
+
+			// Replies for the pending steps may still be waiting on the
+			// response topic; the scheduler times the saga out otherwise
+			o.l.InfoContext(ctx, "Waiting for outstanding reservations", "order_id", orderID, "deadline", saga.Deadline)
+			return nil
+
+		case model.SagaStatusInventoryReserved:
+			if allInStatus(steps, model.StepStatusConfirmed) {
+				o.l.InfoContext(ctx, "Resuming saga with all items confirmed", "order_id", orderID)
+				return o.complete(ctx, r, m, saga)
+			}
+
+			// Confirm requests are delivered by the outbox and retried by
+			// the scheduler once overdue
+			o.l.InfoContext(ctx, "Waiting for outstanding confirmations", "order_id", orderID, "deadline", saga.Deadline)
+			return nil
+
+		case model.SagaStatusCompensating, model.SagaStatusTimedOut:
+			// Release requests are delivered by the outbox and retried by
+			// the scheduler once overdue, only unreleased steps remain
+			o.l.InfoContext(ctx, "Resuming saga compensation", "order_id", orderID)
+			return o.compensate(ctx, r, m, saga, steps)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,567 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"oms/internal/kafka"
+	"oms/internal/model"
+	"oms/internal/repository"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("saga")
+
+// Timeouts configures how long each saga step may run before it expires
+type Timeouts struct {
+	Reserve time.Duration
+	Confirm time.Duration
+	Release time.Duration
+}
+
+// DefaultTimeouts returns the step timeouts used when none are configured
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Reserve: 30 * time.Second,
+		Confirm: 30 * time.Second,
+		Release: time.Minute,
+	}
+}
+
+// Orchestrator drives the checkout saga of an order as a try-confirm-cancel
+// flow. Every item of the order is a saga step that is first reserved and,
+// once all items are reserved, confirmed; the order only completes when
+// inventory confirmed all of them and is compensated as soon as one of them
+// fails. Inventory commands are written to the outbox in the same
+// transaction as the saga state.
+type Orchestrator struct {
+	l *slog.Logger
+	r repository.RepositoryI
+	t Timeouts
+}
+
+// New creates a new saga orchestrator
+func New(l *slog.Logger, r repository.RepositoryI, t Timeouts) *Orchestrator {
+	return &Orchestrator{
+		l: l,
+		r: r,
+		t: t,
+	}
+}
+
+// Start persists the order together with its saga and the reserve request of
+// the whole order. The outcome of the saga is decided later by the inventory
+// responses.
+func (o *Orchestrator) Start(ctx context.Context, order model.CreateOrder) (int, error) {
+	ctx, span := tracer.Start(ctx, "saga.Start")
+	defer span.End()
+
+	var orderID int
+	err := o.r.WithContext(ctx).WithTx(func(r repository.RepositoryI) error {
+		id, err := r.CreateOrder(order)
+		if err != nil {
+			return fmt.Errorf("failed to create order: %w", err)
+		}
+
+		if err := r.CreateOrderItems(id, order.Items); err != nil {
+			return fmt.Errorf("failed to create order items: %w", err)
+		}
+
+		now := time.Now()
+		saga := model.OrderSaga{
+			OrderID:   id,
+			Status:    model.SagaStatusStarted,
+			Step:      model.SagaStepReserveInventory,
+			CreatedAt: now,
+			Deadline:  deadline(now, o.t.Reserve),
+		}
+		if err := r.CreateSaga(saga); err != nil {
+			return fmt.Errorf("failed to create saga: %w", err)
+		}
+
+		steps := make([]model.OrderSagaStep, 0, len(order.Items))
+		for _, item := range order.Items {
+			steps = append(steps, model.OrderSagaStep{
+				OrderID:   id,
+				ProductID: item.Product.ID,
+				Quantity:  item.Quantity,
+				Status:    model.StepStatusPending,
+				UpdatedAt: now,
+			})
+		}
+		if err := r.CreateSagaSteps(steps); err != nil {
+			return fmt.Errorf("failed to create saga steps: %w", err)
+		}
+
+		// Step 1: Reserve inventory for all items in a single request, so
+		// inventory reserves all of them or none
+		msg, err := kafka.NewReserveOrderMessage(id, steps)
+		if err != nil {
+			return err
+		}
+		if err := r.CreateOutboxMessage(msg); err != nil {
+			return fmt.Errorf("failed to enqueue reserve order request: %w", err)
+		}
+
+		orderID = id
+		return nil
+	})
+	if err != nil {
+		o.l.ErrorContext(ctx, "failed to start saga", "error", err)
+		ordersFailed.WithLabelValues(failedError).Inc()
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+
+	span.SetAttributes(attribute.Int("order_id", orderID))
+	ordersCreated.Inc()
+	o.l.InfoContext(ctx, "Started saga", "order_id", orderID, "items", len(order.Items))
+	return orderID, nil
+}
+
+// HandleInventoryResponse applies an inventory response to the saga of its order
+func (o *Orchestrator) HandleInventoryResponse(ctx context.Context, response model.InventoryResponse) error {
+	ctx, span := tracer.Start(ctx, "saga.HandleInventoryResponse", trace.WithAttributes(
+		attribute.Int("order_id", response.OrderID),
+		attribute.Int("product_id", response.ProductID),
+		attribute.String("operation", response.Operation),
+	))
+	defer span.End()
+
+	var err error
+	switch response.Operation {
+	case model.InventoryOperationReserveOrder:
+		err = o.handleReserveOrderResponse(ctx, response)
+	case model.InventoryOperationConfirm:
+		err = o.handleConfirmResponse(ctx, response)
+	case model.InventoryOperationCancel, model.InventoryOperationRelease:
+		err = o.handleReleaseResponse(ctx, response)
+	default:
+		// Responses without an operation come from reserve requests
+		err = o.handleReserveResponse(ctx, response)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// handleReserveResponse records the outcome of a reservation and moves the saga forward
+func (o *Orchestrator) handleReserveResponse(ctx context.Context, response model.InventoryResponse) error {
+	err := o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, steps, step, err := o.load(r, response.OrderID, response.ProductID)
+		if err != nil {
+			return err
+		}
+
+		if saga.Status != model.SagaStatusStarted {
+			// The saga is already being compensated, anything reserved from
+			// now on has to be given back
+			switch {
+			case response.Success && (step.Status == model.StepStatusPending || step.Status == model.StepStatusFailed):
+				o.l.InfoContext(ctx, "Releasing late reservation", "order_id", saga.OrderID, "product_id", step.ProductID)
+				return o.release(r, step, "")
+			case !response.Success && step.Status == model.StepStatusPending:
+				step.Status = model.StepStatusFailed
+				step.Error = response.Error
+				if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, step.Error); err != nil {
+					return err
+				}
+				return o.finishCompensation(ctx, r, m, saga, steps)
+			default:
+				o.l.InfoContext(ctx, "Ignoring reserve response", "order_id", saga.OrderID, "saga_status", saga.Status, "product_id", step.ProductID, "step_status", step.Status)
+			}
+			return nil
+		}
+
+		if step.Status != model.StepStatusPending {
+			o.l.InfoContext(ctx, "Ignoring duplicate reserve response", "order_id", step.OrderID, "product_id", step.ProductID, "step_status", step.Status)
+			return nil
+		}
+
+		if response.Success {
+			step.Status = model.StepStatusReserved
+			if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, ""); err != nil {
+				return err
+			}
+
+			if !allInStatus(steps, model.StepStatusReserved) {
+				return nil
+			}
+
+			o.l.InfoContext(ctx, "All items reserved", "order_id", saga.OrderID)
+			return o.confirm(r, saga, steps)
+		}
+
+		step.Status = model.StepStatusFailed
+		step.Error = response.Error
+		if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, step.Error); err != nil {
+			return err
+		}
+
+		return o.compensate(ctx, r, m, saga, steps)
+	})
+	if err != nil {
+		o.l.ErrorContext(ctx, "failed to handle reserve response", "error", err, "order_id", response.OrderID, "product_id", response.ProductID)
+	}
+	return err
+}
+
+// handleReserveOrderResponse applies the per-item results of an order-level
+// reservation. Items missing from the results share the outcome of the
+// order, which is how inventory answers a request it could not process.
+func (o *Orchestrator) handleReserveOrderResponse(ctx context.Context, response model.InventoryResponse) error {
+	err := o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, steps, err := o.loadSaga(r, response.OrderID)
+		if err != nil {
+			return err
+		}
+
+		results := make(map[int]model.InventoryItemResult, len(response.Items))
+		for _, item := range response.Items {
+			results[item.ProductID] = item
+		}
+
+		failed := false
+		for i := range steps {
+			step := &steps[i]
+			result, ok := results[step.ProductID]
+			if !ok {
+				result = model.InventoryItemResult{ProductID: step.ProductID, Success: response.Success, Error: response.Error}
+			}
+
+			switch {
+			case saga.Status != model.SagaStatusStarted && result.Success && (step.Status == model.StepStatusPending || step.Status == model.StepStatusFailed):
+				// The saga is already being compensated, anything reserved
+				// from now on has to be given back
+				o.l.InfoContext(ctx, "Releasing late reservation", "order_id", saga.OrderID, "product_id", step.ProductID)
+				if err := o.release(r, step, ""); err != nil {
+					return err
+				}
+			case step.Status != model.StepStatusPending:
+				o.l.InfoContext(ctx, "Ignoring reserve order result", "order_id", saga.OrderID, "saga_status", saga.Status, "product_id", step.ProductID, "step_status", step.Status)
+			case result.Success:
+				step.Status = model.StepStatusReserved
+				if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, ""); err != nil {
+					return err
+				}
+			default:
+				failed = true
+				step.Status = model.StepStatusFailed
+				step.Error = result.Error
+				if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, step.Error); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch {
+		case saga.Status != model.SagaStatusStarted:
+			return o.finishCompensation(ctx, r, m, saga, steps)
+		case failed:
+			return o.compensate(ctx, r, m, saga, steps)
+		case allInStatus(steps, model.StepStatusReserved):
+			o.l.InfoContext(ctx, "All items reserved", "order_id", saga.OrderID)
+			return o.confirm(r, saga, steps)
+		}
+		return nil
+	})
+	if err != nil {
+		o.l.ErrorContext(ctx, "failed to handle reserve order response", "error", err, "order_id", response.OrderID)
+	}
+	return err
+}
+
+// handleConfirmResponse records the outcome of a confirmation and completes
+// the order once every item is confirmed
+func (o *Orchestrator) handleConfirmResponse(ctx context.Context, response model.InventoryResponse) error {
+	err := o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, steps, step, err := o.load(r, response.OrderID, response.ProductID)
+		if err != nil {
+			return err
+		}
+
+		// A step that is no longer confirming was already compensated and
+		// its release covers the confirmation as well
+		if step.Status != model.StepStatusConfirming {
+			o.l.InfoContext(ctx, "Ignoring confirm response", "order_id", step.OrderID, "product_id", step.ProductID, "step_status", step.Status)
+			return nil
+		}
+
+		if response.Success {
+			step.Status = model.StepStatusConfirmed
+			if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, ""); err != nil {
+				return err
+			}
+
+			if !allInStatus(steps, model.StepStatusConfirmed) {
+				return nil
+			}
+			return o.complete(ctx, r, m, saga)
+		}
+
+		// The reservation expired or was released before it was confirmed
+		step.Status = model.StepStatusFailed
+		step.Error = response.Error
+		if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, step.Error); err != nil {
+			return err
+		}
+
+		return o.compensate(ctx, r, m, saga, steps)
+	})
+	if err != nil {
+		o.l.ErrorContext(ctx, "failed to handle confirm response", "error", err, "order_id", response.OrderID, "product_id", response.ProductID)
+	}
+	return err
+}
+
+// handleReleaseResponse records a cancelled or released item and finishes the
+// compensation once every item is settled
+func (o *Orchestrator) handleReleaseResponse(ctx context.Context, response model.InventoryResponse) error {
+	err := o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, steps, step, err := o.load(r, response.OrderID, response.ProductID)
+		if err != nil {
+			return err
+		}
+
+		if step.Status != model.StepStatusReleasing {
+			o.l.InfoContext(ctx, "Ignoring release response", "order_id", step.OrderID, "product_id", step.ProductID, "step_status", step.Status)
+			return nil
+		}
+
+		if !response.Success {
+			// The step stays RELEASING so the release is retried
+			o.l.ErrorContext(ctx, "Inventory release failed", "order_id", step.OrderID, "product_id", step.ProductID, "error", response.Error)
+			return nil
+		}
+
+		step.Status = model.StepStatusReleased
+		if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, step.Error); err != nil {
+			return err
+		}
+
+		return o.finishCompensation(ctx, r, m, saga, steps)
+	})
+	if err != nil {
+		o.l.ErrorContext(ctx, "failed to handle release response", "error", err, "order_id", response.OrderID, "product_id", response.ProductID)
+	}
+	return err
+}
+
+// inTx runs fn in a transaction and records the metrics it collected once the
+// transaction committed
+func (o *Orchestrator) inTx(ctx context.Context, fn func(r repository.RepositoryI, m *outcome) error) error {
+	var m outcome
+	err := o.r.WithContext(ctx).WithTx(func(r repository.RepositoryI) error {
+		m = outcome{}
+		return fn(r, &m)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.record()
+	return nil
+}
+
+// confirm moves a saga whose items are all reserved to the confirm step and
+// enqueues the confirm request of every item
+func (o *Orchestrator) confirm(r repository.RepositoryI, saga *model.OrderSaga, steps []model.OrderSagaStep) error {
+	saga.Status = model.SagaStatusInventoryReserved
+	saga.Deadline = deadline(time.Now(), o.t.Confirm)
+
+	// Step 2: Confirm the reservation of all items
+	if err := r.UpdateSagaStep(saga.OrderID, saga.Status, model.SagaStepConfirmInventory, saga.Deadline); err != nil {
+		return err
+	}
+
+	for i := range steps {
+		if steps[i].Status != model.StepStatusReserved {
+			continue
+		}
+		steps[i].Status = model.StepStatusConfirming
+		if err := r.UpdateSagaStepStatus(steps[i].OrderID, steps[i].ProductID, steps[i].Status, ""); err != nil {
+			return err
+		}
+		if err := o.enqueueConfirm(r, steps[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete finishes a saga whose items are all confirmed
+func (o *Orchestrator) complete(ctx context.Context, r repository.RepositoryI, m *outcome, saga *model.OrderSaga) error {
+	// Step 3: Complete the order
+	if err := r.UpdateOrderStatus(saga.OrderID, model.OrderStatusCompleted); err != nil {
+		return err
+	}
+
+	saga.Status = model.SagaStatusCompleted
+	saga.Deadline = nil
+	if err := r.UpdateSagaStep(saga.OrderID, saga.Status, model.SagaStepCompleteOrder, saga.Deadline); err != nil {
+		return err
+	}
+
+	m.end(saga)
+	o.l.InfoContext(ctx, "Saga completed", "order_id", saga.OrderID)
+	return nil
+}
+
+// compensate fails the order and gives back the stock of every reserved or
+// confirmed step
+func (o *Orchestrator) compensate(ctx context.Context, r repository.RepositoryI, m *outcome, saga *model.OrderSaga, steps []model.OrderSagaStep) error {
+	if saga.Status == model.SagaStatusStarted || saga.Status == model.SagaStatusInventoryReserved {
+		if err := r.UpdateSagaStep(saga.OrderID, model.SagaStatusCompensating, model.SagaStepCompensate, deadline(time.Now(), o.t.Release)); err != nil {
+			return err
+		}
+		if err := r.UpdateOrderStatus(saga.OrderID, model.OrderStatusFailed); err != nil {
+			return err
+		}
+		saga.Status = model.SagaStatusCompensating
+		m.fail(failedRejected)
+		o.l.InfoContext(ctx, "Compensating saga", "order_id", saga.OrderID)
+	}
+
+	for i := range steps {
+		switch steps[i].Status {
+		case model.StepStatusReserved, model.StepStatusConfirming, model.StepStatusConfirmed:
+			if err := o.release(r, &steps[i], ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return o.finishCompensation(ctx, r, m, saga, steps)
+}
+
+// finishCompensation marks a compensating saga as failed, and a timed out one
+// as released, once none of its steps holds or awaits inventory any more
+func (o *Orchestrator) finishCompensation(ctx context.Context, r repository.RepositoryI, m *outcome, saga *model.OrderSaga, steps []model.OrderSagaStep) error {
+	if saga.Status != model.SagaStatusCompensating && saga.Status != model.SagaStatusTimedOut {
+		return nil
+	}
+
+	for _, step := range steps {
+		if step.Status != model.StepStatusFailed && step.Status != model.StepStatusReleased {
+			return nil
+		}
+	}
+
+	if saga.Status == model.SagaStatusCompensating {
+		saga.Status = model.SagaStatusFailed
+	} else {
+		saga.Status = model.SagaStatusTimedOutReleased
+	}
+	saga.Deadline = nil
+	if err := r.UpdateSagaStep(saga.OrderID, saga.Status, model.SagaStepCompensate, saga.Deadline); err != nil {
+		return err
+	}
+	m.end(saga)
+
+	o.l.InfoContext(ctx, "Saga compensated", "order_id", saga.OrderID)
+	return nil
+}
+
+// release marks a step as RELEASING and enqueues the request giving its stock
+// back: a cancel while the reservation is only held, a release once it may
+// have been confirmed
+func (o *Orchestrator) release(r repository.RepositoryI, step *model.OrderSagaStep, reason string) error {
+	previous := step.Status
+	step.Status = model.StepStatusReleasing
+	if err := r.UpdateSagaStepStatus(step.OrderID, step.ProductID, step.Status, reason); err != nil {
+		return err
+	}
+
+	if previous == model.StepStatusConfirming || previous == model.StepStatusConfirmed {
+		return o.enqueueRelease(r, *step)
+	}
+	return o.enqueueCancel(r, *step)
+}
+
+// enqueueConfirm writes the confirm request of a step to the outbox
+func (o *Orchestrator) enqueueConfirm(r repository.RepositoryI, step model.OrderSagaStep) error {
+	msg, err := kafka.NewConfirmInventoryMessage(step.OrderID, step.ProductID, step.Quantity)
+	if err != nil {
+		return err
+	}
+	if err := r.CreateOutboxMessage(msg); err != nil {
+		return fmt.Errorf("failed to enqueue confirm inventory request: %w", err)
+	}
+	return nil
+}
+
+// enqueueCancel writes the cancel request of a step to the outbox
+func (o *Orchestrator) enqueueCancel(r repository.RepositoryI, step model.OrderSagaStep) error {
+	msg, err := kafka.NewCancelInventoryMessage(step.OrderID, step.ProductID, step.Quantity)
+	if err != nil {
+		return err
+	}
+	if err := r.CreateOutboxMessage(msg); err != nil {
+		return fmt.Errorf("failed to enqueue cancel inventory request: %w", err)
+	}
+	return nil
+}
+
+// enqueueRelease writes the release request of a step to the outbox
+func (o *Orchestrator) enqueueRelease(r repository.RepositoryI, step model.OrderSagaStep) error {
+	msg, err := kafka.NewReleaseInventoryMessage(step.OrderID, step.ProductID, step.Quantity)
+	if err != nil {
+		return err
+	}
+	if err := r.CreateOutboxMessage(msg); err != nil {
+		return fmt.Errorf("failed to enqueue release inventory request: %w", err)
+	}
+	return nil
+}
+
+// load locks the saga of an order and returns it with its steps and the step
+// of the given product
+func (o *Orchestrator) load(r repository.RepositoryI, orderID int, productID int) (*model.OrderSaga, []model.OrderSagaStep, *model.OrderSagaStep, error) {
+	saga, steps, err := o.loadSaga(r, orderID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i := range steps {
+		if steps[i].ProductID == productID {
+			return saga, steps, &steps[i], nil
+		}
+	}
+	return nil, nil, nil, fmt.Errorf("saga %d has no step for product %d", orderID, productID)
+}
+
+// loadSaga locks the saga of an order and returns it with its steps
+func (o *Orchestrator) loadSaga(r repository.RepositoryI, orderID int) (*model.OrderSaga, []model.OrderSagaStep, error) {
+	saga, err := r.GetSagaForUpdate(orderID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get saga: %w", err)
+	}
+
+	steps, err := r.GetSagaSteps(orderID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get saga steps: %w", err)
+	}
+	return saga, steps, nil
+}
+
+// allInStatus reports whether every step has the given status
+func allInStatus(steps []model.OrderSagaStep, status string) bool {
+	for _, step := range steps {
+		if step.Status != status {
+			return false
+		}
+	}
+	return len(steps) > 0
+}
+
+// deadline returns the deadline of a step started at now
+func deadline(now time.Time, timeout time.Duration) *time.Time {
+	d := now.Add(timeout)
+	return &d
+}
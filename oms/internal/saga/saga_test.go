@@ -0,0 +1,861 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"oms/internal/deadletter"
+	"oms/internal/envelope"
+	"oms/internal/kafka"
+	"oms/internal/messaging"
+	"oms/internal/model"
+	"oms/internal/repository"
+)
+
+// The tests run the checkout saga end to end in process: the orchestrator
+// writes to a memory repository, the outbox relay publishes to a memory
+// broker, a fake inventory answers the requests and the response handler
+// feeds the answers back to the orchestrator.
+
+func TestSagaReservesAndConfirms(t *testing.T) {
+	h := newHarness(t, map[int]int{1: 10, 2: 5})
+
+	orderID := h.start(t, map[int]int{1: 2, 2: 5})
+	saga, steps := h.waitForEnd(t, orderID)
+
+	if saga.Status != model.SagaStatusCompleted {
+		t.Fatalf("got saga status %s, want %s", saga.Status, model.SagaStatusCompleted)
+	}
+	for _, step := range steps {
+		if step.Status != model.StepStatusConfirmed {
+			t.Fatalf("got step status %s for product %d, want %s", step.Status, step.ProductID, model.StepStatusConfirmed)
+		}
+	}
+	if status := h.orderStatus(t, orderID); status != model.OrderStatusCompleted {
+		t.Fatalf("got order status %s, want %s", status, model.OrderStatusCompleted)
+	}
+	h.inventory.expectStock(t, map[int]int{1: 8, 2: 0})
+	h.inventory.expectRequests(t, kafka.ConfirmInventoryTopic, 2)
+	h.inventory.expectRequests(t, kafka.CancelInventoryTopic, 0)
+}
+
+func TestSagaCancelsReservationsWhenReserveFails(t *testing.T) {
+	h := newHarness(t, map[int]int{1: 10, 2: 1})
+
+	orderID := h.start(t, map[int]int{1: 2, 2: 3})
+	saga, steps := h.waitForEnd(t, orderID)
+
+	if saga.Status != model.SagaStatusFailed {
+		t.Fatalf("got saga status %s, want %s", saga.Status, model.SagaStatusFailed)
+	}
+	want := map[int]string{1: model.StepStatusReleased, 2: model.StepStatusFailed}
+	for _, step := range steps {
+		if step.Status != want[step.ProductID] {
+			t.Fatalf("got step status %s for product %d, want %s", step.Status, step.ProductID, want[step.ProductID])
+		}
+	}
+	if status := h.orderStatus(t, orderID); status != model.OrderStatusFailed {
+		t.Fatalf("got order status %s, want %s", status, model.OrderStatusFailed)
+	}
+	h.inventory.expectStock(t, map[int]int{1: 10, 2: 1})
+	h.inventory.expectRequests(t, kafka.CancelInventoryTopic, 1)
+	h.inventory.expectRequests(t, kafka.ConfirmInventoryTopic, 0)
+}
+
+func TestExpireOverdueCancelsAnUnansweredReservation(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, map[int]int{1: 10, 2: 10})
+
+	// Inventory reserves the items but its reply does not arrive in time
+	h.inventory.withhold(kafka.ReserveOrderTopic)
+	orderID := h.start(t, map[int]int{1: 2, 2: 3})
+	h.inventory.waitForRequests(t, kafka.ReserveOrderTopic, 1)
+
+	if err := h.o.ExpireOverdue(ctx, time.Now()); err != nil {
+		t.Fatalf("ExpireOverdue: %v", err)
+	}
+	if saga := h.saga(t, orderID); saga.Status != model.SagaStatusStarted {
+		t.Fatalf("got saga status %s before the reserve timeout, want %s", saga.Status, model.SagaStatusStarted)
+	}
+
+	if err := h.o.ExpireOverdue(ctx, time.Now().Add(DefaultTimeouts().Reserve+time.Second)); err != nil {
+		t.Fatalf("ExpireOverdue: %v", err)
+	}
+	saga, steps := h.waitForEnd(t, orderID)
+	if saga.Status != model.SagaStatusTimedOutReleased {
+		t.Fatalf("got saga status %s, want %s", saga.Status, model.SagaStatusTimedOutReleased)
+	}
+	for _, step := range steps {
+		if step.Status != model.StepStatusReleased {
+			t.Fatalf("got step status %s for product %d, want %s", step.Status, step.ProductID, model.StepStatusReleased)
+		}
+	}
+	h.inventory.expectStock(t, map[int]int{1: 10, 2: 10})
+	h.inventory.expectRequests(t, kafka.CancelInventoryTopic, 2)
+
+	// The reply arriving after the timeout changes nothing
+	late := h.inventory.withheldReplies()
+	if len(late) != 1 || !late[0].Success {
+		t.Fatalf("got withheld replies %+v, want the successful reservation", late)
+	}
+	if err := h.o.HandleInventoryResponse(ctx, late[0]); err != nil {
+		t.Fatalf("HandleInventoryResponse: %v", err)
+	}
+	if saga := h.saga(t, orderID); saga.Status != model.SagaStatusTimedOutReleased || saga.Deadline != nil {
+		t.Fatalf("got saga status %s with deadline %v after the late reply", saga.Status, saga.Deadline)
+	}
+	if status := h.orderStatus(t, orderID); status != model.OrderStatusTimedOut {
+		t.Fatalf("got order status %s, want %s", status, model.OrderStatusTimedOut)
+	}
+	h.inventory.expectRequests(t, kafka.ConfirmInventoryTopic, 0)
+	h.inventory.expectRequests(t, kafka.CancelInventoryTopic, 2)
+}
+
+func TestRecoverMovesEveryInFlightSagaToItsEnd(t *testing.T) {
+	tests := []struct {
+		name        string
+		sagaStatus  string
+		orderStatus string
+		steps       map[int]string
+		wantSaga    string
+		wantOrder   string
+		wantStock   map[int]int
+	}{
+		{
+			name:        "reserving with every item reserved",
+			sagaStatus:  model.SagaStatusStarted,
+			orderStatus: model.OrderStatusCreated,
+			steps:       map[int]string{1: model.StepStatusReserved, 2: model.StepStatusReserved},
+			wantSaga:    model.SagaStatusCompleted,
+			wantOrder:   model.OrderStatusCompleted,
+			wantStock:   map[int]int{1: 9, 2: 9},
+		},
+		{
+			name:        "reserving with a failed item",
+			sagaStatus:  model.SagaStatusStarted,
+			orderStatus: model.OrderStatusCreated,
+			steps:       map[int]string{1: model.StepStatusReserved, 2: model.StepStatusFailed},
+			wantSaga:    model.SagaStatusFailed,
+			wantOrder:   model.OrderStatusFailed,
+			wantStock:   map[int]int{1: 10, 2: 10},
+		},
+		{
+			name:        "reserving with unanswered items",
+			sagaStatus:  model.SagaStatusStarted,
+			orderStatus: model.OrderStatusCreated,
+			steps:       map[int]string{1: model.StepStatusReserved, 2: model.StepStatusPending},
+			wantSaga:    model.SagaStatusTimedOutReleased,
+			wantOrder:   model.OrderStatusTimedOut,
+			wantStock:   map[int]int{1: 10, 2: 10},
+		},
+		{
+			name:        "confirming with every item confirmed",
+			sagaStatus:  model.SagaStatusInventoryReserved,
+			orderStatus: model.OrderStatusCreated,
+			steps:       map[int]string{1: model.StepStatusConfirmed, 2: model.StepStatusConfirmed},
+			wantSaga:    model.SagaStatusCompleted,
+			wantOrder:   model.OrderStatusCompleted,
+			wantStock:   map[int]int{1: 9, 2: 9},
+		},
+		{
+			name:        "confirming with unanswered confirms",
+			sagaStatus:  model.SagaStatusInventoryReserved,
+			orderStatus: model.OrderStatusCreated,
+			steps:       map[int]string{1: model.StepStatusConfirmed, 2: model.StepStatusConfirming},
+			wantSaga:    model.SagaStatusCompleted,
+			wantOrder:   model.OrderStatusCompleted,
+			wantStock:   map[int]int{1: 9, 2: 9},
+		},
+		{
+			name:        "compensating with an unanswered release",
+			sagaStatus:  model.SagaStatusCompensating,
+			orderStatus: model.OrderStatusFailed,
+			steps:       map[int]string{1: model.StepStatusReleasing, 2: model.StepStatusFailed},
+			wantSaga:    model.SagaStatusFailed,
+			wantOrder:   model.OrderStatusFailed,
+			wantStock:   map[int]int{1: 10, 2: 10},
+		},
+		{
+			name:        "timed out with an unanswered release",
+			sagaStatus:  model.SagaStatusTimedOut,
+			orderStatus: model.OrderStatusTimedOut,
+			steps:       map[int]string{1: model.StepStatusReleasing, 2: model.StepStatusReleased},
+			wantSaga:    model.SagaStatusTimedOutReleased,
+			wantOrder:   model.OrderStatusTimedOut,
+			wantStock:   map[int]int{1: 10, 2: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, map[int]int{1: 10, 2: 10})
+			orderID := h.seed(t, tt.sagaStatus, tt.orderStatus, tt.steps)
+
+			// Recovery runs at startup, the scheduler then resends what
+			// is still unanswered once the saga is overdue
+			if err := h.o.Recover(context.Background()); err != nil {
+				t.Fatalf("Recover: %v", err)
+			}
+			if err := h.o.ExpireOverdue(context.Background(), time.Now()); err != nil {
+				t.Fatalf("ExpireOverdue: %v", err)
+			}
+
+			saga, _ := h.waitForEnd(t, orderID)
+			if saga.Status != tt.wantSaga {
+				t.Fatalf("got saga status %s, want %s", saga.Status, tt.wantSaga)
+			}
+			if status := h.orderStatus(t, orderID); status != tt.wantOrder {
+				t.Fatalf("got order status %s, want %s", status, tt.wantOrder)
+			}
+			h.inventory.expectStock(t, tt.wantStock)
+		})
+	}
+}
+
+// harness wires an orchestrator to a fake inventory over a memory broker
+type harness struct {
+	r         *memoryRepository
+	o         *Orchestrator
+	inventory *fakeInventory
+}
+
+// newHarness starts the saga components and a fake inventory holding stock,
+// everything stops when the test ends
+func newHarness(t *testing.T, stock map[int]int) *harness {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	broker := messaging.NewMemory()
+	r := newMemoryRepository()
+	o := New(l, r, DefaultTimeouts())
+
+	client, err := kafka.New(l, r, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kafka.NewOutboxRelay(l, r, client, 10*time.Millisecond).Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := kafka.NewInventoryResponseHandler(l, o, deadletter.NewPublisher(l, broker), broker, 0)
+	t.Cleanup(func() { handler.Close() })
+	if err := handler.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	inventory := newFakeInventory(broker, stock)
+	go inventory.run(ctx)
+
+	return &harness{r: r, o: o, inventory: inventory}
+}
+
+// start starts the saga of an order of quantity by product ID
+func (h *harness) start(t *testing.T, items map[int]int) int {
+	t.Helper()
+
+	order := model.CreateOrder{Status: model.OrderStatusCreated, CreatedAt: time.Now()}
+	for productID, quantity := range items {
+		order.Items = append(order.Items, model.OrderItem{Product: model.Product{ID: productID}, Quantity: quantity})
+	}
+
+	orderID, err := h.o.Start(context.Background(), order)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return orderID
+}
+
+// seed stores an order of one unit of each product whose saga was left in
+// sagaStatus with the given step statuses by a previous run, its deadline
+// already passed. The fake inventory holds the stock of reserved steps and
+// has given out the stock of confirmed ones.
+func (h *harness) seed(t *testing.T, sagaStatus string, orderStatus string, steps map[int]string) int {
+	t.Helper()
+
+	stepOf := map[string]int{
+		model.SagaStatusStarted:           model.SagaStepReserveInventory,
+		model.SagaStatusInventoryReserved: model.SagaStepConfirmInventory,
+		model.SagaStatusCompensating:      model.SagaStepCompensate,
+		model.SagaStatusTimedOut:          model.SagaStepCompensate,
+	}
+
+	var orderID int
+	err := h.r.WithTx(func(r repository.RepositoryI) error {
+		now := time.Now()
+		var err error
+		if orderID, err = r.CreateOrder(model.CreateOrder{Status: orderStatus, CreatedAt: now}); err != nil {
+			return err
+		}
+		if err := r.CreateSaga(model.OrderSaga{
+			OrderID:   orderID,
+			Status:    sagaStatus,
+			Step:      stepOf[sagaStatus],
+			CreatedAt: now,
+			Deadline:  deadline(now, -time.Second),
+		}); err != nil {
+			return err
+		}
+
+		var sagaSteps []model.OrderSagaStep
+		for productID, status := range steps {
+			sagaSteps = append(sagaSteps, model.OrderSagaStep{
+				OrderID:   orderID,
+				ProductID: productID,
+				Quantity:  1,
+				Status:    status,
+				UpdatedAt: now,
+			})
+		}
+		return r.CreateSagaSteps(sagaSteps)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for productID, status := range steps {
+		switch status {
+		case model.StepStatusReserved, model.StepStatusConfirming, model.StepStatusReleasing:
+			h.inventory.hold(orderID, productID, 1)
+		case model.StepStatusConfirmed:
+			h.inventory.hold(orderID, productID, 1)
+			h.inventory.confirm(orderID, productID)
+		}
+	}
+	return orderID
+}
+
+// waitForEnd waits until the saga of an order no longer waits for inventory
+// and returns it with its steps
+func (h *harness) waitForEnd(t *testing.T, orderID int) (*model.OrderSaga, []model.OrderSagaStep) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		var saga *model.OrderSaga
+		var steps []model.OrderSagaStep
+		err := h.r.WithTx(func(r repository.RepositoryI) error {
+			var err error
+			if saga, err = r.GetSaga(orderID); err != nil {
+				return err
+			}
+			steps, err = r.GetSagaSteps(orderID)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saga.Deadline == nil {
+			return saga, steps
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("saga of order %d did not end, status %s", orderID, saga.Status)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// saga returns the saga of an order
+func (h *harness) saga(t *testing.T, orderID int) *model.OrderSaga {
+	t.Helper()
+
+	var saga *model.OrderSaga
+	err := h.r.WithTx(func(r repository.RepositoryI) error {
+		var err error
+		saga, err = r.GetSaga(orderID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saga
+}
+
+// orderStatus returns the status of an order
+func (h *harness) orderStatus(t *testing.T, orderID int) string {
+	t.Helper()
+
+	var order *model.Order
+	err := h.r.WithTx(func(r repository.RepositoryI) error {
+		var err error
+		order, err = r.GetOrder(orderID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order.Status
+}
+
+// fakeInventory answers the inventory requests of OMS from stock kept in
+// memory. Unlike the inventory service it reserves every item of an order
+// on its own, so an order can hold some items while others are refused.
+type fakeInventory struct {
+	subscriber messaging.Subscriber
+	publisher  messaging.Publisher
+
+	mu       sync.Mutex
+	stock    map[int]int
+	reserved map[[2]int]int
+	requests map[string]int
+	// withheld holds the replies to the requests of the topics in withholds
+	// instead of sending them
+	withholds map[string]bool
+	withheld  []model.InventoryResponse
+}
+
+// newFakeInventory creates a fake inventory reading the request topics of broker
+func newFakeInventory(broker messaging.Broker, stock map[int]int) *fakeInventory {
+	return &fakeInventory{
+		subscriber: broker.NewSubscriber(messaging.SubscriberConfig{
+			Topics: []string{
+				kafka.ReserveOrderTopic,
+				kafka.ConfirmInventoryTopic,
+				kafka.CancelInventoryTopic,
+				kafka.ReleaseInventoryTopic,
+			},
+			GroupID: "inventory-group",
+		}),
+		publisher: broker.NewPublisher(),
+		stock:     stock,
+		reserved:  make(map[[2]int]int),
+		requests:  make(map[string]int),
+		withholds: make(map[string]bool),
+	}
+}
+
+// run answers requests until the context is canceled
+func (f *fakeInventory) run(ctx context.Context) {
+	for {
+		msg, err := f.subscriber.Fetch(ctx)
+		if err != nil {
+			return
+		}
+
+		env, response, err := f.handle(msg)
+		if err != nil {
+			panic(err)
+		}
+		if f.holdBack(msg.Topic, response) {
+			continue
+		}
+		reply, err := envelope.New(kafka.InventoryResponseMessageType, kafka.SchemaVersion, "inventory", env.CorrelationID, response)
+		if err != nil {
+			panic(err)
+		}
+		value, err := reply.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		err = f.publisher.Publish(ctx, messaging.Message{
+			Topic:   kafka.InventoryResponseTopic,
+			Key:     msg.Key,
+			Value:   value,
+			Headers: reply.MessageHeaders(),
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle applies a request to the stock and returns its envelope and response
+func (f *fakeInventory) handle(msg messaging.Message) (envelope.Envelope, model.InventoryResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[msg.Topic]++
+
+	if msg.Topic == kafka.ReserveOrderTopic {
+		var request kafka.ReserveOrderEvent
+		env, err := envelope.Open(msg, kafka.ReserveOrderMessageType, kafka.SchemaVersion, &request)
+		if err != nil {
+			return env, model.InventoryResponse{}, err
+		}
+
+		response := model.InventoryResponse{
+			OrderID:   request.OrderID,
+			Operation: model.InventoryOperationReserveOrder,
+			Success:   true,
+		}
+		for _, item := range request.Items {
+			result := model.InventoryItemResult{ProductID: item.ProductID, Success: true}
+			if f.stock[item.ProductID] < item.Quantity {
+				result = model.InventoryItemResult{ProductID: item.ProductID, Error: "insufficient stock"}
+				response.Success = false
+			} else {
+				f.stock[item.ProductID] -= item.Quantity
+				f.reserved[[2]int{request.OrderID, item.ProductID}] = item.Quantity
+			}
+			response.Items = append(response.Items, result)
+		}
+		return env, response, nil
+	}
+
+	operations := map[string]string{
+		kafka.ConfirmInventoryTopic: model.InventoryOperationConfirm,
+		kafka.CancelInventoryTopic:  model.InventoryOperationCancel,
+		kafka.ReleaseInventoryTopic: model.InventoryOperationRelease,
+	}
+	msgTypes := map[string]string{
+		kafka.ConfirmInventoryTopic: kafka.ConfirmInventoryMessageType,
+		kafka.CancelInventoryTopic:  kafka.CancelInventoryMessageType,
+		kafka.ReleaseInventoryTopic: kafka.ReleaseInventoryMessageType,
+	}
+
+	var request kafka.InventoryEvent
+	env, err := envelope.Open(msg, msgTypes[msg.Topic], kafka.SchemaVersion, &request)
+	if err != nil {
+		return env, model.InventoryResponse{}, err
+	}
+
+	// Like inventory, a cancel or release of a reservation that was never
+	// made or is already given back succeeds without changing the stock
+	key := [2]int{request.OrderID, request.ProductID}
+	quantity, ok := f.reserved[key]
+	if !ok && msg.Topic == kafka.ConfirmInventoryTopic {
+		return env, model.InventoryResponse{}, fmt.Errorf("no reservation of product %d for order %d", request.ProductID, request.OrderID)
+	}
+	delete(f.reserved, key)
+	if msg.Topic != kafka.ConfirmInventoryTopic {
+		f.stock[request.ProductID] += quantity
+	}
+
+	return env, model.InventoryResponse{
+		OrderID:   request.OrderID,
+		ProductID: request.ProductID,
+		Operation: operations[msg.Topic],
+		Success:   true,
+	}, nil
+}
+
+// withhold makes the fake apply the requests of topic without replying
+func (f *fakeInventory) withhold(topic string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.withholds[topic] = true
+}
+
+// holdBack keeps the reply to a request of a withheld topic and reports
+// whether it did
+func (f *fakeInventory) holdBack(topic string, response model.InventoryResponse) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.withholds[topic] {
+		return false
+	}
+	f.withheld = append(f.withheld, response)
+	return true
+}
+
+// withheldReplies returns the replies that were not sent
+func (f *fakeInventory) withheldReplies() []model.InventoryResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]model.InventoryResponse(nil), f.withheld...)
+}
+
+// waitForRequests waits until n requests were read from topic
+func (f *fakeInventory) waitForRequests(t *testing.T, topic string, n int) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		f.mu.Lock()
+		got := f.requests[topic]
+		f.mu.Unlock()
+		if got >= n {
+			return
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("got %d requests on %s, want %d", got, topic, n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// hold reserves quantity of a product for an order, as a previous run did
+func (f *fakeInventory) hold(orderID int, productID int, quantity int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stock[productID] -= quantity
+	f.reserved[[2]int{orderID, productID}] = quantity
+}
+
+// confirm confirms the reservation of a product for an order, as a previous
+// run did
+func (f *fakeInventory) confirm(orderID int, productID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.reserved, [2]int{orderID, productID})
+}
+
+// expectStock fails the test unless the stock is the given one
+func (f *fakeInventory) expectStock(t *testing.T, want map[int]int) {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for productID, quantity := range want {
+		if f.stock[productID] != quantity {
+			t.Fatalf("got stock %d of product %d, want %d", f.stock[productID], productID, quantity)
+		}
+	}
+}
+
+// expectRequests fails the test unless n requests were read from topic
+func (f *fakeInventory) expectRequests(t *testing.T, topic string, n int) {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.requests[topic] != n {
+		t.Fatalf("got %d requests on %s, want %d", f.requests[topic], topic, n)
+	}
+}
+
+// errUnsupported is returned by the memory repository for dead letters
+var errUnsupported = errors.New("not supported by the memory repository")
+
+// memoryRepository keeps orders, sagas and the outbox in memory. Transactions
+// are serialized but not rolled back, the tests never rely on a rollback.
+type memoryRepository struct {
+	mu *sync.Mutex
+	s  *memoryState
+	// tx is set on the repository passed to WithTx callbacks
+	tx bool
+}
+
+// memoryState is the data of a memory repository
+type memoryState struct {
+	orderID  int
+	outboxID int64
+	orders   map[int]*model.Order
+	sagas    map[int]*model.OrderSaga
+	steps    map[int][]model.OrderSagaStep
+	outbox   []model.OutboxMessage
+}
+
+// newMemoryRepository creates an empty memory repository
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		mu: &sync.Mutex{},
+		s: &memoryState{
+			orders: make(map[int]*model.Order),
+			sagas:  make(map[int]*model.OrderSaga),
+			steps:  make(map[int][]model.OrderSagaStep),
+		},
+	}
+}
+
+func (r *memoryRepository) WithTx(fn func(r repository.RepositoryI) error) error {
+	if r.tx {
+		return fn(r)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fn(&memoryRepository{mu: r.mu, s: r.s, tx: true})
+}
+
+func (r *memoryRepository) WithContext(ctx context.Context) repository.RepositoryI {
+	return r
+}
+
+func (r *memoryRepository) CreateOrder(order model.CreateOrder) (int, error) {
+	r.s.orderID++
+	r.s.orders[r.s.orderID] = &model.Order{ID: r.s.orderID, Status: order.Status, CreatedAt: order.CreatedAt}
+	return r.s.orderID, nil
+}
+
+func (r *memoryRepository) GetOrder(id int) (*model.Order, error) {
+	order, ok := r.s.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order %d not found", id)
+	}
+	o := *order
+	return &o, nil
+}
+
+func (r *memoryRepository) GetOrders() ([]model.Order, error) {
+	orders := make([]model.Order, 0, len(r.s.orders))
+	for _, order := range r.s.orders {
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+func (r *memoryRepository) CreateOrderItems(orderID int, items []model.OrderItem) error {
+	order, ok := r.s.orders[orderID]
+	if !ok {
+		return fmt.Errorf("order %d not found", orderID)
+	}
+	order.Items = append(order.Items, items...)
+	return nil
+}
+
+func (r *memoryRepository) GetOrderItems() (map[int][]model.OrderItem, error) {
+	items := make(map[int][]model.OrderItem, len(r.s.orders))
+	for id, order := range r.s.orders {
+		items[id] = order.Items
+	}
+	return items, nil
+}
+
+func (r *memoryRepository) UpdateOrderStatus(orderID int, status string) error {
+	order, ok := r.s.orders[orderID]
+	if !ok {
+		return fmt.Errorf("order %d not found", orderID)
+	}
+	order.Status = status
+	return nil
+}
+
+func (r *memoryRepository) CreateSaga(saga model.OrderSaga) error {
+	r.s.sagas[saga.OrderID] = &saga
+	return nil
+}
+
+func (r *memoryRepository) GetSaga(orderID int) (*model.OrderSaga, error) {
+	saga, ok := r.s.sagas[orderID]
+	if !ok {
+		return nil, fmt.Errorf("saga %d not found", orderID)
+	}
+	s := *saga
+	return &s, nil
+}
+
+func (r *memoryRepository) GetSagaForUpdate(orderID int) (*model.OrderSaga, error) {
+	return r.GetSaga(orderID)
+}
+
+func (r *memoryRepository) GetSagasByStatus(status string) ([]*model.OrderSaga, error) {
+	var sagas []*model.OrderSaga
+	for _, saga := range r.s.sagas {
+		if saga.Status == status {
+			s := *saga
+			sagas = append(sagas, &s)
+		}
+	}
+	return sagas, nil
+}
+
+func (r *memoryRepository) GetExpiredSagas(now time.Time) ([]*model.OrderSaga, error) {
+	var sagas []*model.OrderSaga
+	for _, saga := range r.s.sagas {
+		if saga.Deadline != nil && saga.Deadline.Before(now) {
+			s := *saga
+			sagas = append(sagas, &s)
+		}
+	}
+	return sagas, nil
+}
+
+func (r *memoryRepository) UpdateSagaStatus(orderID int, status string) error {
+	saga, ok := r.s.sagas[orderID]
+	if !ok {
+		return fmt.Errorf("saga %d not found", orderID)
+	}
+	saga.Status = status
+	return nil
+}
+
+func (r *memoryRepository) UpdateSagaStep(orderID int, status string, step int, deadline *time.Time) error {
+	saga, ok := r.s.sagas[orderID]
+	if !ok {
+		return fmt.Errorf("saga %d not found", orderID)
+	}
+	saga.Status = status
+	saga.Step = step
+	saga.Deadline = deadline
+	return nil
+}
+
+func (r *memoryRepository) CreateSagaSteps(steps []model.OrderSagaStep) error {
+	for _, step := range steps {
+		r.s.steps[step.OrderID] = append(r.s.steps[step.OrderID], step)
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetSagaSteps(orderID int) ([]model.OrderSagaStep, error) {
+	return append([]model.OrderSagaStep(nil), r.s.steps[orderID]...), nil
+}
+
+func (r *memoryRepository) UpdateSagaStepStatus(orderID int, productID int, status string, errMsg string) error {
+	steps := r.s.steps[orderID]
+	for i := range steps {
+		if steps[i].ProductID == productID {
+			steps[i].Status = status
+			steps[i].Error = errMsg
+			steps[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("saga %d has no step for product %d", orderID, productID)
+}
+
+func (r *memoryRepository) CreateOutboxMessage(msg model.OutboxMessage) error {
+	r.s.outboxID++
+	msg.ID = r.s.outboxID
+	r.s.outbox = append(r.s.outbox, msg)
+	return nil
+}
+
+func (r *memoryRepository) GetPendingOutboxMessages(limit int) ([]model.OutboxMessage, error) {
+	var msgs []model.OutboxMessage
+	for _, msg := range r.s.outbox {
+		if msg.SentAt == nil && len(msgs) < limit {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (r *memoryRepository) MarkOutboxMessageSent(id int64, sentAt time.Time) error {
+	for i := range r.s.outbox {
+		if r.s.outbox[i].ID == id {
+			r.s.outbox[i].SentAt = &sentAt
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox message %d not found", id)
+}
+
+func (r *memoryRepository) CreateDeadLetter(dl model.DeadLetter) error {
+	return errUnsupported
+}
+
+func (r *memoryRepository) GetDeadLetters(status, sourceTopic string) ([]model.DeadLetter, error) {
+	return nil, errUnsupported
+}
+
+func (r *memoryRepository) GetDeadLetter(id int64) (*model.DeadLetter, error) {
+	return nil, errUnsupported
+}
+
+func (r *memoryRepository) GetDeadLetterForUpdate(id int64) (*model.DeadLetter, error) {
+	return nil, errUnsupported
+}
+
+func (r *memoryRepository) UpdateDeadLetterStatus(id int64, status string) error {
+	return errUnsupported
+}
+
+func (r *memoryRepository) CreateDeadLetterAudit(a model.DeadLetterAudit) error {
+	return errUnsupported
+}
+
+func (r *memoryRepository) GetDeadLetterAudits(deadLetterID int64) ([]model.DeadLetterAudit, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,174 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"oms/internal/model"
+	"oms/internal/repository"
+	"time"
+)
+
+// Scheduler periodically expires saga steps that ran past their deadline
+type Scheduler struct {
+	l        *slog.Logger
+	o        *Orchestrator
+	interval time.Duration
+}
+
+// NewScheduler creates a new saga timeout scheduler
+func NewScheduler(l *slog.Logger, o *Orchestrator, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		l:        l,
+		o:        o,
+		interval: interval,
+	}
+}
+
+// Start starts the scheduler
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.l.InfoContext(ctx, "Starting saga timeout scheduler", "interval", s.interval)
+
+	go s.run(ctx)
+
+	return nil
+}
+
+// run checks for overdue sagas until the context is canceled
+func (s *Scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.l.InfoContext(ctx, "Context canceled, stopping saga timeout scheduler")
+			return
+		case now := <-ticker.C:
+			if err := s.o.ExpireOverdue(ctx, now); err != nil {
+				s.l.ErrorContext(ctx, "failed to expire overdue sagas", "error", err)
+			}
+		}
+	}
+}
+
+// ExpireOverdue handles every saga whose current step is past its deadline
+func (o *Orchestrator) ExpireOverdue(ctx context.Context, now time.Time) error {
+	sagas, err := o.r.WithContext(ctx).GetExpiredSagas(now)
+	if err != nil {
+		return fmt.Errorf("failed to get expired sagas: %w", err)
+	}
+
+	for _, saga := range sagas {
+		if err := o.expire(ctx, saga.OrderID, now); err != nil {
+			o.l.ErrorContext(ctx, "failed to expire saga", "error", err, "order_id", saga.OrderID, "status", saga.Status)
+		}
+	}
+	return nil
+}
+
+// expire handles a single overdue saga. A reservation that takes too long
+// times the order out and cancels every item that might have been reserved,
+// an overdue confirmation or compensation sends its outstanding requests again.
+func (o *Orchestrator) expire(ctx context.Context, orderID int, now time.Time) error {
+	return o.inTx(ctx, func(r repository.RepositoryI, m *outcome) error {
+		saga, err := r.GetSagaForUpdate(orderID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga: %w", err)
+		}
+
+		// The saga may have moved on since it was selected
+		if saga.Deadline == nil || saga.Deadline.After(now) {
+			return nil
+		}
+
+		steps, err := r.GetSagaSteps(orderID)
+		if err != nil {
+			return fmt.Errorf("failed to get saga steps: %w", err)
+		}
+
+		switch saga.Status {
+		case model.SagaStatusStarted:
+			o.l.InfoContext(ctx, "Saga timed out while reserving inventory", "order_id", orderID, "deadline", saga.Deadline)
+
+			saga.Status = model.SagaStatusTimedOut
+			saga.Deadline = deadline(now, o.t.Release)
+			if err := r.UpdateSagaStep(orderID, saga.Status, model.SagaStepCompensate, saga.Deadline); err != nil {
+				return err
+			}
+			if err := r.UpdateOrderStatus(orderID, model.OrderStatusTimedOut); err != nil {
+				return err
+			}
+			m.fail(failedTimedOut)
+
+			// Unanswered reservations may have been applied by inventory,
+			// so they are cancelled together with the reserved ones
+			for i := range steps {
+				if steps[i].Status != model.StepStatusPending && steps[i].Status != model.StepStatusReserved {
+					continue
+				}
+				if err := o.release(r, &steps[i], "timed out"); err != nil {
+					return err
+				}
+			}
+
+			return o.finishCompensation(ctx, r, m, saga, steps)
+
+		case model.SagaStatusInventoryReserved:
+			// Reservations are held until they expire, so confirmations
+			// are retried instead of giving up on the order
+			o.l.InfoContext(ctx, "Saga confirmation overdue, retrying confirms", "order_id", orderID, "deadline", saga.Deadline)
+			return o.retryConfirmation(r, saga, steps)
+
+		case model.SagaStatusCompensating, model.SagaStatusTimedOut:
+			o.l.InfoContext(ctx, "Saga compensation overdue, retrying releases", "order_id", orderID, "deadline", saga.Deadline)
+			return o.retryCompensation(ctx, r, m, saga, steps)
+		}
+
+		// Terminal sagas have nothing left to wait for
+		return r.UpdateSagaStep(orderID, saga.Status, saga.Step, nil)
+	})
+}
+
+// retryConfirmation restarts the confirmation deadline and requests every
+// outstanding confirm again. Inventory answers a confirm it already applied
+// with the recorded outcome.
+func (o *Orchestrator) retryConfirmation(r repository.RepositoryI, saga *model.OrderSaga, steps []model.OrderSagaStep) error {
+	for _, step := range steps {
+		if step.Status != model.StepStatusConfirming {
+			continue
+		}
+		if err := o.enqueueConfirm(r, step); err != nil {
+			return err
+		}
+	}
+
+	saga.Deadline = deadline(time.Now(), o.t.Confirm)
+	return r.UpdateSagaStep(saga.OrderID, saga.Status, model.SagaStepConfirmInventory, saga.Deadline)
+}
+
+// retryCompensation restarts the compensation deadline and requests every
+// outstanding release again. Steps still waiting for a reservation reply are
+// cancelled as well since they might have been reserved. Retries always send
+// a release, which gives back held and confirmed stock alike.
+func (o *Orchestrator) retryCompensation(ctx context.Context, r repository.RepositoryI, m *outcome, saga *model.OrderSaga, steps []model.OrderSagaStep) error {
+	for i := range steps {
+		switch steps[i].Status {
+		case model.StepStatusPending:
+			if err := o.release(r, &steps[i], "timed out"); err != nil {
+				return err
+			}
+		case model.StepStatusReleasing:
+			if err := o.enqueueRelease(r, steps[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	saga.Deadline = deadline(time.Now(), o.t.Release)
+	if err := r.UpdateSagaStep(saga.OrderID, saga.Status, model.SagaStepCompensate, saga.Deadline); err != nil {
+		return err
+	}
+
+	return o.compensate(ctx, r, m, saga, steps)
+}
@@ -1,35 +1,54 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"oms/internal/kafka"
+	"oms/internal/deadletter"
 	"oms/internal/model"
 	"oms/internal/repository"
+	"oms/internal/saga"
 	"time"
 )
 
+// ErrOutOfStock is returned when inventory reports an item of an order as out
+// of stock
+var ErrOutOfStock = errors.New("not enough stock")
+
+// StockChecker asks inventory for the stock of the items of an order
+type StockChecker interface {
+	CheckStock(ctx context.Context, items []model.OrderItem) (*model.StockCheckResponse, error)
+}
+
 type Service struct {
-	l *slog.Logger
-	r repository.RepositoryI
-	k *kafka.KafkaClient
+	l     *slog.Logger
+	r     repository.RepositoryI
+	o     *saga.Orchestrator
+	stock StockChecker
 }
 
-func New(l *slog.Logger, r repository.RepositoryI, k *kafka.KafkaClient) (*Service, error) {
+func New(l *slog.Logger, r repository.RepositoryI, o *saga.Orchestrator, stock StockChecker) (*Service, error) {
 	return &Service{
-		l: l,
-		r: r,
-		k: k,
+		l:     l,
+		r:     r,
+		o:     o,
+		stock: stock,
 	}, nil
 }
 
 type ServiceI interface {
-	CreateOrder(order model.CreateOrder) (int, error)
-	CreateOrderFromRequest(req model.CreateOrderRequest) error
-	GetOrders() ([]model.Order, error)
+	CreateOrder(ctx context.Context, order model.CreateOrder) (int, error)
+	CreateOrderFromRequest(ctx context.Context, req model.CreateOrderRequest) error
+	GetOrders(ctx context.Context) ([]model.Order, error)
+
+	GetDeadLetters(ctx context.Context, status, sourceTopic string) ([]model.DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int64) (*model.DeadLetterDetail, error)
+	RepublishDeadLetter(ctx context.Context, id int64, req model.RepublishDeadLetterRequest) error
+	DiscardDeadLetter(ctx context.Context, id int64, req model.DiscardDeadLetterRequest) error
 }
 
-func (s *Service) CreateOrderFromRequest(req model.CreateOrderRequest) error {
+func (s *Service) CreateOrderFromRequest(ctx context.Context, req model.CreateOrderRequest) error {
 	// Validate request
 	if len(req.Items) == 0 {
 		return fmt.Errorf("order must contain at least one item")
@@ -38,85 +57,62 @@ func (s *Service) CreateOrderFromRequest(req model.CreateOrderRequest) error {
 	// Create order from request
 	order := model.CreateOrder{
 		Items:     req.Items,
-		Status:    "CREATED",
+		Status:    model.OrderStatusCreated,
 		CreatedAt: time.Now(),
 	}
 
 	// Create order
-	_, err := s.CreateOrder(order)
+	_, err := s.CreateOrder(ctx, order)
 	return err
 }
 
-func (s *Service) CreateOrder(order model.CreateOrder) (int, error) {
-	// Create order in database and get the ID
-	orderID, err := s.r.CreateOrder(order)
-	if err != nil {
-		s.l.Error("failed to create order", "error", err)
-		return 0, fmt.Errorf("failed to create order: %w", err)
-	}
-
-	// Start saga
-	saga := model.OrderSaga{
-		OrderID:   orderID,
-		Status:    "STARTED",
-		Step:      0,
-		CreatedAt: time.Now(),
-	}
-
-	// Save saga state
-	err = s.r.CreateSaga(saga)
-	if err != nil {
-		s.l.Error("failed to create saga", "error", err, "order_id", orderID)
-		return orderID, fmt.Errorf("failed to create saga: %w", err)
-	}
-
-	// Step 1: Reserve inventory for all items
+func (s *Service) CreateOrder(ctx context.Context, order model.CreateOrder) (int, error) {
+	seen := make(map[int]bool, len(order.Items))
 	for _, item := range order.Items {
 		if item.Quantity <= 0 {
-			return orderID, fmt.Errorf("invalid quantity for product %d", item.Product.ID)
+			return 0, fmt.Errorf("invalid quantity for product %d", item.Product.ID)
 		}
+		if seen[item.Product.ID] {
+			return 0, fmt.Errorf("duplicate product %d in order", item.Product.ID)
+		}
+		seen[item.Product.ID] = true
+	}
 
-		if err := s.reserveInventory(orderID, item.Product.ID, item.Quantity); err != nil {
-			// Compensating transaction: Release all previously reserved inventory
-			for _, releasedItem := range order.Items {
-				if releasedItem.Product.ID == item.Product.ID {
-					break // Skip the current item as it wasn't reserved
-				}
-				s.releaseInventory(orderID, releasedItem.Product.ID, releasedItem.Quantity)
+	// Orders that cannot be reserved are refused before a saga is started.
+	// The check is advisory, the reservation of the saga is what counts, so
+	// the order goes ahead when inventory does not answer in time.
+	stock, err := s.stock.CheckStock(ctx, order.Items)
+	switch {
+	case err != nil:
+		s.l.WarnContext(ctx, "failed to check stock, starting order without it", "error", err)
+	case !stock.Available:
+		for _, item := range stock.Items {
+			if item.Available < item.Requested {
+				return 0, fmt.Errorf("%w for product %d: requested %d, available %d", ErrOutOfStock, item.ProductID, item.Requested, item.Available)
 			}
-			s.r.UpdateSagaStatus(saga.OrderID, "FAILED")
-			return orderID, fmt.Errorf("failed to reserve inventory for product %d: %w", item.Product.ID, err)
 		}
+		return 0, ErrOutOfStock
 	}
 
-	// Update saga step
-	s.r.UpdateSagaStatus(saga.OrderID, "INVENTORY_RESERVED")
-
-	// Step 2: Create order items
-	err = s.r.CreateOrderItems(orderID, order.Items)
+	// The saga persists the order and reserves its inventory, the order
+	// status is settled asynchronously by the inventory responses
+	orderID, err := s.o.Start(ctx, order)
 	if err != nil {
-		// Compensating transaction: Release all inventory
-		for _, item := range order.Items {
-			s.releaseInventory(orderID, item.Product.ID, item.Quantity)
-		}
-		s.r.UpdateSagaStatus(saga.OrderID, "FAILED")
-		return orderID, fmt.Errorf("failed to create order items: %w", err)
+		s.l.Error("failed to create order", "error", err, "order_id", orderID)
+		return orderID, fmt.Errorf("failed to create order: %w", err)
 	}
 
-	// Update saga status to completed
-	s.r.UpdateSagaStatus(saga.OrderID, "COMPLETED")
-
 	return orderID, nil
 }
 
-func (s *Service) GetOrders() ([]model.Order, error) {
-	orders, err := s.r.GetOrders()
+func (s *Service) GetOrders(ctx context.Context) ([]model.Order, error) {
+	orders, err := s.r.WithContext(ctx).GetOrders()
 	if err != nil {
 		s.l.Error("failed to get orders", "error", err)
 		return nil, fmt.Errorf("failed to get orders: %w", err)
 	}
 
-	orderItems, err := s.r.GetOrderItems()
+	orderItems, err := s.r.WithContext(ctx).GetOrderItems()
 	if err != nil {
 		s.l.Error("failed to get order items", "error", err)
 		return nil, fmt.Errorf("failed to get order items: %w", err)
@@ -132,22 +128,54 @@ func (s *Service) GetOrders() ([]model.Order, error) {
 	return orders, nil
 }
 
-func (s *Service) reserveInventory(orderID int, productID int, quantity int) error {
-	// Send reserve inventory request via Kafka
-	err := s.k.ReserveInventory(orderID, productID, quantity)
+func (s *Service) GetDeadLetters(ctx context.Context, status, sourceTopic string) ([]model.DeadLetter, error) {
+	deadLetters, err := s.r.WithContext(ctx).GetDeadLetters(status, sourceTopic)
 	if err != nil {
-		return fmt.Errorf("failed to send reserve inventory request: %w", err)
+		s.l.Error("failed to get dead letters", "error", err)
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
 	}
 
-	return nil
+	// Payloads are only returned for a single dead letter
+	for i := range deadLetters {
+		deadLetters[i].Payload = ""
+	}
+	return deadLetters, nil
 }
 
-func (s *Service) releaseInventory(orderID int, productID int, quantity int) error {
-	// Send release inventory request via Kafka
-	err := s.k.ReleaseInventory(orderID, productID, quantity)
+func (s *Service) GetDeadLetter(ctx context.Context, id int64) (*model.DeadLetterDetail, error) {
+	dl, err := s.r.WithContext(ctx).GetDeadLetter(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+
+	audit, err := s.r.WithContext(ctx).GetDeadLetterAudits(id)
 	if err != nil {
-		return fmt.Errorf("failed to send release inventory request: %w", err)
+		s.l.Error("failed to get dead letter audit", "error", err, "id", id)
+		return nil, fmt.Errorf("failed to get dead letter audit: %w", err)
+	}
+
+	return &model.DeadLetterDetail{DeadLetter: *dl, Audit: audit}, nil
+}
+
+// RepublishDeadLetter writes a dead letter, or its edited payload, back to
+// its source topic through the outbox and records the action
+func (s *Service) RepublishDeadLetter(ctx context.Context, id int64, req model.RepublishDeadLetterRequest) error {
+	if err := deadletter.Republish(s.r.WithContext(ctx), id, req); err != nil {
+		s.l.Error("failed to republish dead letter", "error", err, "id", id)
+		return fmt.Errorf("failed to republish dead letter: %w", err)
+	}
+
+	s.l.Info("Republished dead letter", "id", id, "actor", req.Actor)
+	return nil
+}
+
+// DiscardDeadLetter marks a dead letter as discarded and records the action
+func (s *Service) DiscardDeadLetter(ctx context.Context, id int64, req model.DiscardDeadLetterRequest) error {
+	if err := deadletter.Discard(s.r.WithContext(ctx), id, req); err != nil {
+		s.l.Error("failed to discard dead letter", "error", err, "id", id)
+		return fmt.Errorf("failed to discard dead letter: %w", err)
 	}
 
+	s.l.Info("Discarded dead letter", "id", id, "actor", req.Actor)
 	return nil
 }
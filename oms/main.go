@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"oms/internal/admin"
+	"oms/internal/deadletter"
+	"oms/internal/env"
 	"oms/internal/handler"
 	"oms/internal/kafka"
 	"oms/internal/logger"
+	"oms/internal/messaging"
+	"oms/internal/metrics"
 	"oms/internal/repository"
 	"oms/internal/routes"
+	"oms/internal/saga"
 	"oms/internal/server"
 	"oms/internal/service"
+	"oms/internal/tracing"
 	"os"
 	"os/signal"
 	"syscall"
@@ -54,18 +62,55 @@ func main() {
 
 	logger := logger.Init()
 
+	// Spans are exported with OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	// and written to TRACE_FILE when it is set
+	shutdownTracing, err := tracing.Init(context.Background(), "oms")
+	if err != nil {
+		logger.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 
 	repository := repository.New(logger, db)
 
-	// Get Kafka brokers from environment or use default
-	brokers := []string{"localhost:9092"}
-	if envBrokers := os.Getenv("KAFKA_BROKERS"); envBrokers != "" {
-		brokers = []string{envBrokers}
+	// Messages go through Kafka unless MESSAGING_BACKEND selects the
+	// Postgres queue at MESSAGING_POSTGRES_URL or an in-process broker
+	messagingConfig, err := messaging.ConfigFromEnv()
+	if err != nil {
+		logger.Error("Invalid messaging configuration", "error", err)
+		os.Exit(1)
+	}
+	broker, err := messaging.New(messagingConfig)
+	if err != nil {
+		logger.Error("Failed to create message broker", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := broker.Close(); err != nil {
+			logger.Error("Failed to close message broker", "error", err)
+		}
+	}()
+
+	// Track the progress of every consumer for the health check, the
+	// consumers endpoint, the consumers expvar and the metrics
+	monitor := messaging.NewMonitor(messagingConfig.StallTimeout)
+	broker = messaging.WithMonitor(broker, monitor)
+	expvar.Publish("consumers", expvar.Func(func() any { return monitor.Stats() }))
+	if err := messaging.RegisterMonitor(monitor); err != nil {
+		logger.Error("Failed to register consumer metrics", "error", err)
+		os.Exit(1)
 	}
 
 	// Initialize Kafka client
-	kafkaClient, err := kafka.New(logger, repository)
+	kafkaClient, err := kafka.New(logger, repository, broker)
 	if err != nil {
 		logger.Error("Failed to create Kafka client", "error", err)
 		os.Exit(1)
@@ -76,20 +121,63 @@ func main() {
 		}
 	}()
 
+	// Create the saga orchestrator driven by inventory responses
+	timeouts := saga.DefaultTimeouts()
+	for key, timeout := range map[string]*time.Duration{
+		"SAGA_RESERVE_TIMEOUT": &timeouts.Reserve,
+		"SAGA_CONFIRM_TIMEOUT": &timeouts.Confirm,
+		"SAGA_RELEASE_TIMEOUT": &timeouts.Release,
+	} {
+		if *timeout, err = env.Interval(key, *timeout); err != nil {
+			logger.Error("Invalid saga configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+	orchestrator := saga.New(logger, repository, timeouts)
+
+	// Resume or compensate sagas interrupted by a previous shutdown
+	if err := orchestrator.Recover(context.Background()); err != nil {
+		logger.Error("Failed to recover sagas", "error", err)
+		os.Exit(1)
+	}
+
+	// Offsets are committed once a message is processed, a commit interval
+	// batches the commits and 0 commits every message on its own
+	commitInterval, err := env.Duration("KAFKA_COMMIT_INTERVAL", 0)
+	if err != nil {
+		logger.Error("Invalid Kafka configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Unprocessable responses go to the dead-letter topic of the response topic
+	dlq := deadletter.NewPublisher(logger, broker)
+	defer dlq.Close()
+
+	// Copy dead-lettered responses into the database for the admin API
+	deadLetterCollector := kafka.NewDeadLetterCollector(logger, repository, broker, commitInterval, []string{kafka.InventoryResponseTopic})
+	defer deadLetterCollector.Stop()
+
 	// Create inventory response handler
-	responseHandler := kafka.NewInventoryResponseHandler(logger, repository, brokers)
+	responseHandler := kafka.NewInventoryResponseHandler(logger, orchestrator, dlq, broker, commitInterval)
 	defer responseHandler.Close()
 
-	// Create service with Kafka client
-	svc, err := service.New(logger, repository, kafkaClient)
+	// Create service with the saga orchestrator
+	svc, err := service.New(logger, repository, orchestrator, kafkaClient)
 	if err != nil {
 		logger.Error("Failed to create service", "error", err)
 		os.Exit(1)
 	}
 
-	handler := handler.New(logger, svc)
+	handler := handler.New(logger, svc, monitor)
 
-	routes.RegisterRoutes(mux, handler)
+	// The dead letter admin API accepts the operators of ADMIN_TOKENS
+	adminTokens, err := admin.TokensFromEnv()
+	if err != nil {
+		logger.Error("Invalid admin configuration", "error", err)
+		os.Exit(1)
+	}
+
+	routes.RegisterRoutes(mux, handler, adminTokens)
 
 	// Create a context for the application
 	ctx, cancel := context.WithCancel(context.Background())
@@ -101,13 +189,49 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Start consuming the replies to stock checks
+	if err := kafkaClient.Start(ctx); err != nil {
+		logger.Error("Failed to start Kafka client", "error", err)
+		os.Exit(1)
+	}
+
+	// Start storing dead letters
+	if err := deadLetterCollector.Start(ctx); err != nil {
+		logger.Error("Failed to start dead letter collector", "error", err)
+		os.Exit(1)
+	}
+
+	// Start the outbox relay publishing the saga's inventory requests
+	relayInterval, err := env.Interval("OUTBOX_RELAY_INTERVAL", 500*time.Millisecond)
+	if err != nil {
+		logger.Error("Invalid outbox relay configuration", "error", err)
+		os.Exit(1)
+	}
+	outboxRelay := kafka.NewOutboxRelay(logger, repository, kafkaClient, relayInterval)
+	if err := outboxRelay.Start(ctx); err != nil {
+		logger.Error("Failed to start outbox relay", "error", err)
+		os.Exit(1)
+	}
+
+	// Start the scheduler expiring overdue saga steps
+	schedulerInterval, err := env.Interval("SAGA_SCHEDULER_INTERVAL", 5*time.Second)
+	if err != nil {
+		logger.Error("Invalid saga configuration", "error", err)
+		os.Exit(1)
+	}
+	scheduler := saga.NewScheduler(logger, orchestrator, schedulerInterval)
+	if err := scheduler.Start(ctx); err != nil {
+		logger.Error("Failed to start saga scheduler", "error", err)
+		os.Exit(1)
+	}
+
 	// Create a channel to receive the server instance from server.Init
 	serverReady := make(chan struct{})
 
 	// Start the server in a goroutine
 	go func() {
 		logger.Info("Starting HTTP server at", "port", port)
-		err := server.Init(port, mux)
+		err := server.Init(port, tracing.Middleware(metrics.Middleware(mux)))
 		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Failed to start HTTP server", "error", err)
 			os.Exit(1)
@@ -41,7 +41,7 @@ func (h *Handler) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.s.CreateProduct(*productReq)
+	err = h.s.CreateProduct(r.Context(), *productReq)
 	if err != nil {
 		h.l.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -64,7 +64,7 @@ func (h *Handler) GetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	product, err := h.s.GetProduct(id)
+	product, err := h.s.GetProduct(r.Context(), id)
 	if err != nil {
 		h.l.Error("failed to get product", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -92,7 +92,7 @@ func (h *Handler) DeleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.s.DeleteProduct(id); err != nil {
+	if err := h.s.DeleteProduct(r.Context(), id); err != nil {
 		h.l.Error("failed to delete product", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -121,7 +121,7 @@ func (h *Handler) GetProducts(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get products from service
-	products, err := h.s.GetProducts(ids)
+	products, err := h.s.GetProducts(r.Context(), ids)
 	if err != nil {
 		h.l.Error("failed to get products", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -3,10 +3,12 @@ package logger
 import (
 	"log/slog"
 	"os"
+
+	"product/internal/tracing"
 )
 
 func Init() *slog.Logger {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger := slog.New(tracing.NewLogHandler(slog.NewJSONHandler(os.Stdout, nil)))
 	// logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	return logger
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"context"
+	"product/internal/model"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("repository")
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Time taken by repository calls, by method and result.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "result"})
+
+// instrumentedRepository times every call made on a repository bound to a
+// context and records a span for it. Calls are only traced as part of a
+// trace.
+type instrumentedRepository struct {
+	r   RepositoryI
+	ctx context.Context
+}
+
+// WithContext returns the repository with its calls timed and traced as
+// children of the span of ctx
+func (r *Repository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: r, ctx: ctx}
+}
+
+func (t *instrumentedRepository) WithContext(ctx context.Context) RepositoryI {
+	return &instrumentedRepository{r: t.r, ctx: ctx}
+}
+
+// call is a repository call being timed and traced
+type call struct {
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+// start starts timing a call and its span, the span is the non-recording
+// span of the context when it is not part of a trace
+func (t *instrumentedRepository) start(method string) call {
+	c := call{method: method, start: time.Now(), span: trace.SpanFromContext(t.ctx)}
+	if c.span.SpanContext().IsValid() {
+		_, c.span = tracer.Start(t.ctx, "repository."+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNamePostgreSQL,
+				semconv.CodeFunctionName("repository."+method),
+			),
+		)
+	}
+	return c
+}
+
+// end ends the span of a call, recording its error, and observes its latency
+func (c call) end(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, err.Error())
+	}
+	c.span.End()
+	queryDuration.WithLabelValues(c.method, result).Observe(time.Since(c.start).Seconds())
+}
+
+func (t *instrumentedRepository) CreateProduct(req model.CreateProductRequest) error {
+	c := t.start("CreateProduct")
+	err := t.r.CreateProduct(req)
+	c.end(err)
+	return err
+}
+
+func (t *instrumentedRepository) GetProduct(id int) (*model.Product, error) {
+	c := t.start("GetProduct")
+	v, err := t.r.GetProduct(id)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) GetProducts(ids []int) ([]model.Product, error) {
+	c := t.start("GetProducts")
+	v, err := t.r.GetProducts(ids)
+	c.end(err)
+	return v, err
+}
+
+func (t *instrumentedRepository) DeleteProduct(id int) error {
+	c := t.start("DeleteProduct")
+	err := t.r.DeleteProduct(id)
+	c.end(err)
+	return err
+}
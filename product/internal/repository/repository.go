@@ -1,10 +1,16 @@
 package repository
 
-import "product/internal/model"
+import (
+	"context"
+	"product/internal/model"
+)
 
 type RepositoryI interface {
 	CreateProduct(req model.CreateProductRequest) error
 	GetProduct(id int) (*model.Product, error)
 	GetProducts(ids []int) ([]model.Product, error)
 	DeleteProduct(id int) error
+	// WithContext returns the repository with its calls timed and traced
+	// as part of the trace of ctx
+	WithContext(ctx context.Context) RepositoryI
 }
@@ -3,13 +3,14 @@ package routes
 import (
 	"net/http"
 	"product/internal/handler"
+	"product/internal/metrics"
 )
 
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, traceparent, tracestate")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -26,4 +27,7 @@ func RegisterRoutes(mux *http.ServeMux, h *handler.Handler) {
 	mux.HandleFunc("GET /product/{id}", corsMiddleware(h.GetProduct))
 	mux.HandleFunc("GET /product", corsMiddleware(h.GetProducts))
 	mux.HandleFunc("DELETE /product/{id}", corsMiddleware(h.DeleteProduct))
+
+	// Prometheus metrics
+	mux.Handle("GET /metrics", metrics.Handler())
 }
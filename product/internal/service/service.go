@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"product/internal/model"
@@ -20,16 +21,16 @@ func New(l *slog.Logger, r repository.RepositoryI) *Service {
 }
 
 type ServiceI interface {
-	CreateProduct(req model.CreateProductRequest) error
-	GetProduct(id int) (*model.Product, error)
-	GetProducts(ids []int) ([]model.Product, error)
-	DeleteProduct(id int) error
+	CreateProduct(ctx context.Context, req model.CreateProductRequest) error
+	GetProduct(ctx context.Context, id int) (*model.Product, error)
+	GetProducts(ctx context.Context, ids []int) ([]model.Product, error)
+	DeleteProduct(ctx context.Context, id int) error
 }
 
-func (s *Service) CreateProduct(req model.CreateProductRequest) error {
+func (s *Service) CreateProduct(ctx context.Context, req model.CreateProductRequest) error {
 	s.l.Info("creating new product", "name", req.Name)
 
-	err := s.r.CreateProduct(req)
+	err := s.r.WithContext(ctx).CreateProduct(req)
 	if err != nil {
 		s.l.Error("failed to create product", "error", err)
 		return fmt.Errorf("failed to create product: %w", err)
@@ -39,10 +40,10 @@ func (s *Service) CreateProduct(req model.CreateProductRequest) error {
 	return nil
 }
 
-func (s *Service) GetProduct(id int) (*model.Product, error) {
+func (s *Service) GetProduct(ctx context.Context, id int) (*model.Product, error) {
 	s.l.Info("getting product", "id", id)
 
-	product, err := s.r.GetProduct(id)
+	product, err := s.r.WithContext(ctx).GetProduct(id)
 	if err != nil {
 		s.l.Error("failed to get product", "id", id, "error", err)
 		return nil, fmt.Errorf("failed to get product: %w", err)
@@ -52,10 +53,10 @@ func (s *Service) GetProduct(id int) (*model.Product, error) {
 	return product, nil
 }
 
-func (s *Service) DeleteProduct(id int) error {
+func (s *Service) DeleteProduct(ctx context.Context, id int) error {
 	s.l.Info("deleting product", "id", id)
 
-	err := s.r.DeleteProduct(id)
+	err := s.r.WithContext(ctx).DeleteProduct(id)
 	if err != nil {
 		s.l.Error("failed to delete product", "id", id, "error", err)
 		return fmt.Errorf("failed to delete product: %w", err)
@@ -65,10 +66,10 @@ func (s *Service) DeleteProduct(id int) error {
 	return nil
 }
 
-func (s *Service) GetProducts(ids []int) ([]model.Product, error) {
+func (s *Service) GetProducts(ctx context.Context, ids []int) ([]model.Product, error) {
 	s.l.Info("getting products", "ids", ids)
 
-	products, err := s.r.GetProducts(ids)
+	products, err := s.r.WithContext(ctx).GetProducts(ids)
 	if err != nil {
 		s.l.Error("failed to get products", "ids", ids, "error", err)
 		return nil, fmt.Errorf("failed to get products: %w", err)
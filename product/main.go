@@ -1,20 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 
 	"product/internal/handler"
 	"product/internal/logger"
+	"product/internal/metrics"
 	"product/internal/repository"
 	"product/internal/routes"
 	"product/internal/server"
 	"product/internal/service"
+	"product/internal/tracing"
 )
 
 const (
@@ -51,6 +55,21 @@ func main() {
 
 	logger := logger.Init()
 
+	// Spans are exported with OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	// and written to TRACE_FILE when it is set
+	shutdownTracing, err := tracing.Init(context.Background(), "product")
+	if err != nil {
+		logger.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 
 	repository := repository.New(logger, db)
@@ -60,7 +79,7 @@ func main() {
 	routes.RegisterRoutes(mux, handler)
 
 	logger.Info("Starting HTTP server at", "port", port)
-	err = server.Init(port, mux)
+	err = server.Init(port, tracing.Middleware(metrics.Middleware(mux)))
 	if err != nil {
 		logger.Error("Failed to start HTTP server", "error", err)
 		os.Exit(1)
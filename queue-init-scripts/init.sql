@@ -0,0 +1,35 @@
+-- Messages published to the Postgres queue, kept until every subscribed
+-- group processed them and their retention passed
+CREATE TABLE IF NOT EXISTS message_log (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    key BYTEA,
+    value BYTEA,
+    headers JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_log_topic ON message_log(topic, id);
+CREATE INDEX IF NOT EXISTS idx_message_log_created_at ON message_log(created_at);
+
+-- Consumer groups and the topics they read
+CREATE TABLE IF NOT EXISTS message_subscriptions (
+    group_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, topic)
+);
+
+-- Messages not processed yet by a group, claimed by one of its consumers
+-- until locked_until and deleted once committed
+CREATE TABLE IF NOT EXISTS message_queue (
+    group_id VARCHAR(255) NOT NULL,
+    message_id BIGINT NOT NULL REFERENCES message_log(id) ON DELETE CASCADE,
+    topic VARCHAR(255) NOT NULL,
+    key BYTEA,
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (group_id, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_queue_group_topic ON message_queue(group_id, topic, message_id);
+CREATE INDEX IF NOT EXISTS idx_message_queue_message_id ON message_queue(message_id);
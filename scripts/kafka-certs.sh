@@ -0,0 +1,56 @@
+#!/bin/sh
+# Generates a self-signed CA, a broker certificate for kafka/localhost and a
+# client certificate in ./certs, plus the JKS stores, credential files and
+# JAAS configuration used by docker-compose.kafka-tls.yaml.
+# keytool runs from the Kafka image when it is not installed.
+set -eu
+
+DIR=${CERTS_DIR:-certs}
+PASSWORD=${CERTS_PASSWORD:-changeit}
+DAYS=${CERTS_DAYS:-365}
+KAFKA_IMAGE=confluentinc/cp-kafka:7.5.3
+
+mkdir -p "$DIR"
+cd "$DIR"
+
+keytool() {
+	if command -v keytool >/dev/null 2>&1; then
+		command keytool "$@"
+	else
+		docker run --rm -v "$PWD:/certs" -w /certs --entrypoint keytool "$KAFKA_IMAGE" "$@"
+	fi
+}
+
+echo "Creating CA"
+openssl req -x509 -newkey rsa:2048 -nodes -days "$DAYS" \
+	-subj "/CN=nivogo-ca" -keyout ca.key -out ca.pem
+
+echo "Creating broker certificate"
+openssl req -newkey rsa:2048 -nodes -subj "/CN=kafka" -keyout kafka.key -out kafka.csr
+printf 'subjectAltName=DNS:kafka,DNS:localhost\n' > kafka.ext
+openssl x509 -req -in kafka.csr -CA ca.pem -CAkey ca.key -CAcreateserial \
+	-days "$DAYS" -extfile kafka.ext -out kafka.pem
+
+echo "Creating client certificate"
+openssl req -newkey rsa:2048 -nodes -subj "/CN=nivogo-client" -keyout client.key -out client.csr
+openssl x509 -req -in client.csr -CA ca.pem -CAkey ca.key -CAcreateserial \
+	-days "$DAYS" -out client.pem
+
+echo "Creating broker key and trust stores"
+openssl pkcs12 -export -in kafka.pem -inkey kafka.key -certfile ca.pem \
+	-name kafka -passout "pass:$PASSWORD" -out kafka.p12
+rm -f kafka.keystore.jks kafka.truststore.jks
+keytool -importkeystore -noprompt -srckeystore kafka.p12 -srcstoretype PKCS12 \
+	-srcstorepass "$PASSWORD" -destkeystore kafka.keystore.jks -deststorepass "$PASSWORD"
+keytool -importcert -noprompt -alias ca -file ca.pem \
+	-keystore kafka.truststore.jks -storepass "$PASSWORD"
+printf '%s' "$PASSWORD" > kafka.credentials
+
+cat > kafka_server_jaas.conf <<JAAS
+KafkaServer {
+  org.apache.kafka.common.security.scram.ScramLoginModule required;
+};
+JAAS
+
+rm -f kafka.csr kafka.ext client.csr ca.srl kafka.p12
+echo "Certificates written to $DIR"